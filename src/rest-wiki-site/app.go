@@ -2,9 +2,13 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/gorilla/mux"
+	"log"
 	"net/http"
+	"os"
 	"strconv"
+	"time"
 )
 
 var port = flag.Int64("port", 8080, "server port")
@@ -13,22 +17,122 @@ var sessiontimeout = flag.Int64("sessiontimeout", 30*60, "api secret")
 var adminuserid = flag.String("adminuserid", "admin", "user id")
 var adminpassword = flag.String("adminpassword", "admin", "user password")
 var alloworigins = flag.String("alloworigins", "*", "allow these origins")
+var datadir = flag.String("datadir", "data", "page storage directory")
+var maxattachmentsize = flag.Int64("maxattachmentsize", 10<<20, "largest attachment upload in bytes")
+var storage = flag.String("storage", "file", "page storage: file, git to commit every change, or log for a single append-only file")
+var cachesize = flag.Int64("cachesize", 64<<20, "page cache size in bytes, or no cache if 0")
+var trashretention = flag.Duration("trashretention", 30*24*time.Hour, "purge deleted pages after this long, or never if 0")
+
+func CreateRouter(store PageStore, attachments AttachmentStore, secret string, sessiontimeout int64, adminuserid string, adminpassword string, alloworigins string, maxattachmentsize int64) *mux.Router {
+	index := NewSearchIndex()
+	if err := index.Build(store); err != nil {
+		log.Printf("building search index: %v", err)
+	}
+	graph := NewLinkGraph()
+	if err := graph.Build(store); err != nil {
+		log.Printf("building link graph: %v", err)
+	}
+	cached, _ := store.(*CachedPageStore)
+	store = NewObservedPageStore(store, index, graph)
 
-func CreateRouter(secret string, sessiontimeout int64, adminuserid string, adminpassword string, alloworigins string) *mux.Router {
 	r := mux.NewRouter()
 	r.HandleFunc("/sessionsignature", CreateSessionSigningHandler(secret, sessiontimeout, alloworigins, func(userid string, password string) bool {
 		return userid == adminuserid && password == adminpassword
 	})).Methods("OPTIONS", "GET", "POST").Name("sessionsignature")
-	r.HandleFunc("/page", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "GET, OPTIONS", CreatePageListHandler(alloworigins))).Methods("OPTIONS", "GET").Name("pagelist")
-	r.HandleFunc("/page/{title:[a-zA-Z0-9]+}", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "GET, OPTIONS, POST, DELETE", CreatePageHandler(alloworigins))).Methods("OPTIONS", "GET", "POST", "DELETE").Name("page")
+	r.HandleFunc("/page", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "GET, HEAD, OPTIONS", CreatePageListHandler(store, alloworigins))).Methods("OPTIONS", "GET", "HEAD").Name("pagelist")
+	r.HandleFunc("/page/{title:"+titlePattern+"}/revisions", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "GET, OPTIONS", CreateRevisionListHandler(store, alloworigins))).Methods("OPTIONS", "GET").Name("revisionlist")
+	r.HandleFunc("/page/{title:"+titlePattern+"}/revisions/{id:[a-zA-Z0-9]+}", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "GET, OPTIONS", CreateRevisionHandler(store, alloworigins))).Methods("OPTIONS", "GET").Name("revision")
+	r.HandleFunc("/page/{title:"+titlePattern+"}/revert", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "OPTIONS, POST", CreateRevertHandler(store, alloworigins))).Methods("OPTIONS", "POST").Name("revert")
+	r.HandleFunc("/page/{title:"+titlePattern+"}/move", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "OPTIONS, POST", CreateMoveHandler(store, attachments, alloworigins))).Methods("OPTIONS", "POST").Name("move")
+	r.HandleFunc("/page/{title:"+titlePattern+"}/backlinks", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "GET, OPTIONS", CreateBacklinksHandler(graph, alloworigins))).Methods("OPTIONS", "GET").Name("backlinks")
+	r.HandleFunc("/page/{title:"+titlePattern+"}/attachments", CreateSizeLimitedRequestHandler(maxattachmentsize, alloworigins, CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "GET, OPTIONS, POST", CreateAttachmentListHandler(store, attachments, alloworigins)))).Methods("OPTIONS", "GET", "POST").Name("attachmentlist")
+	r.HandleFunc("/page/{title:"+titlePattern+"}/attachments/{name:[^/]+}", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "DELETE, GET, HEAD, OPTIONS", CreateAttachmentHandler(store, attachments, alloworigins))).Methods("OPTIONS", "GET", "HEAD", "DELETE").Name("attachment")
+	r.HandleFunc("/page/{title:"+titlePattern+"}/diff", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "GET, OPTIONS", CreateDiffHandler(store, alloworigins))).Methods("OPTIONS", "GET").Name("diff")
+	r.HandleFunc("/page/{title:"+titlePattern+"}", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "GET, HEAD, OPTIONS, POST, PUT, PATCH, DELETE", CreatePageHandler(store, attachments, alloworigins))).Methods("OPTIONS", "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE").Name("page")
+	r.HandleFunc("/tag", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "GET, OPTIONS", CreateTagListHandler(store, alloworigins))).Methods("OPTIONS", "GET").Name("taglist")
+	r.HandleFunc("/search", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "GET, OPTIONS", CreateSearchHandler(index, alloworigins))).Methods("OPTIONS", "GET").Name("search")
+	r.HandleFunc("/report/wanted", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "GET, OPTIONS", CreateWantedReportHandler(graph, alloworigins))).Methods("OPTIONS", "GET").Name("wantedreport")
+	r.HandleFunc("/report/orphans", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "GET, OPTIONS", CreateOrphansReportHandler(graph, alloworigins))).Methods("OPTIONS", "GET").Name("orphansreport")
+	r.HandleFunc("/export", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "GET, OPTIONS", CreateExportHandler(store, attachments, adminuserid, alloworigins))).Methods("OPTIONS", "GET").Name("export")
+	r.HandleFunc("/import", CreateSizeLimitedRequestHandler(maxImportSize, alloworigins, CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "OPTIONS, POST", CreateImportHandler(store, attachments, adminuserid, alloworigins)))).Methods("OPTIONS", "POST").Name("import")
+	r.HandleFunc("/trash", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "GET, OPTIONS", CreateTrashListHandler(store, alloworigins))).Methods("OPTIONS", "GET").Name("trash")
+	r.HandleFunc("/trash/{title:"+titlePattern+"}/restore", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "OPTIONS, POST", CreateTrashRestoreHandler(store, attachments, alloworigins))).Methods("OPTIONS", "POST").Name("trashrestore")
+	r.HandleFunc("/trash/{title:"+titlePattern+"}", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "OPTIONS, DELETE", CreateTrashPurgeHandler(store, attachments, adminuserid, alloworigins))).Methods("OPTIONS", "DELETE").Name("trashpurge")
+
+	if cached != nil {
+		r.HandleFunc("/cache", CreateAuthorizedRequestHandler(secret, sessiontimeout, alloworigins, "GET, OPTIONS", CreateCacheStatsHandler(cached, adminuserid, alloworigins))).Methods("OPTIONS", "GET").Name("cache")
+	}
 
 	return r
 }
 
+// OpenPageStore opens the page storage named by the storage flag in the
+// data directory, migrating the file names of pages stored by older
+// versions.
+func OpenPageStore(storage string, directory string) (PageStore, error) {
+	var store PageStore
+	var err error
+	switch storage {
+	case "file":
+		store, err = NewFilePageStore(directory)
+	case "git":
+		store, err = NewGitPageStore(directory)
+	case "log":
+		store, err = NewLogPageStore(directory)
+	default:
+		return nil, fmt.Errorf("unknown storage %q, expected file, git or log", storage)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// only stores keeping a file per page have file names to migrate
+	if files, ok := store.(interface {
+		MigrateFilenames() ([]string, error)
+	}); ok {
+		migrated, err := files.MigrateFilenames()
+		if err != nil {
+			return nil, fmt.Errorf("migrating page file names: %v", err)
+		}
+		for _, title := range migrated {
+			log.Printf("migrated page file name of %s", title)
+		}
+	}
+
+	return store, nil
+}
+
 func main() {
 	flag.Parse()
 
-	r := CreateRouter(*secret, *sessiontimeout, *adminuserid, *adminpassword, *alloworigins)
+	store, err := OpenPageStore(*storage, *datadir)
+	if err != nil {
+		log.Fatalf("opening data directory: %v", err)
+	}
+
+	attachments, err := NewFileAttachmentStore(*datadir)
+	if err != nil {
+		log.Fatalf("opening data directory: %v", err)
+	}
+
+	if flag.Arg(0) == "import" {
+		if err := RunImportCommand(flag.Args()[1:], store, attachments, os.Stdout); err != nil {
+			log.Fatalf("importing: %v", err)
+		}
+		return
+	}
+
+	if logs, ok := store.(*LogPageStore); ok {
+		StartLogCompactor(logs, time.Hour)
+	}
+	if *cachesize > 0 {
+		store = NewCachedPageStore(store, *cachesize)
+	}
+	if *trashretention > 0 {
+		StartTrashPurger(store, attachments, *trashretention, time.Hour)
+	}
+
+	r := CreateRouter(store, attachments, *secret, *sessiontimeout, *adminuserid, *adminpassword, *alloworigins, *maxattachmentsize)
 
 	http.Handle("/", r)
 	http.ListenAndServe(":"+strconv.FormatInt(*port, 10), nil)
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+var ErrNoAttachment = errors.New("No attachment provided")
+
+// inlineContentTypes are shown by browsers without running anything, so
+// they are safe to serve inline. Everything else is served for download.
+var inlineContentTypes = map[string]bool{
+	"application/pdf": true,
+	"image/gif":       true,
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/webp":      true,
+	"text/plain":      true,
+}
+
+type upload struct {
+	attachment *Attachment
+	data       []byte
+}
+
+// attachmentContentType returns the declared type of an upload, or one
+// guessed from its name and content if none was given.
+func attachmentContentType(declared string, name string, data []byte) string {
+	if mediatype, _, err := mime.ParseMediaType(declared); err == nil && mediatype != "application/octet-stream" {
+		return declared
+	}
+	if guessed := mime.TypeByExtension(filepath.Ext(name)); len(guessed) != 0 {
+		return guessed
+	}
+
+	return http.DetectContentType(data)
+}
+
+// readUploads returns the files sent in a request body: every file part
+// of multipart/form-data, or else the whole body as one file named by the
+// name parameter or the filename of its Content-Disposition.
+func readUploads(r *http.Request) ([]*upload, error) {
+	results := []*upload{}
+
+	if mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediatype == "multipart/form-data" {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			return nil, err
+		}
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if len(part.FileName()) == 0 {
+				continue
+			}
+
+			data, err := ioutil.ReadAll(part)
+			if err != nil {
+				return nil, err
+			}
+			name := NormalizeTitle(part.FileName())
+			results = append(results, &upload{attachment: &Attachment{Name: name, ContentType: attachmentContentType(part.Header.Get("Content-Type"), name, data)}, data: data})
+		}
+	} else {
+		name := r.URL.Query().Get("name")
+		if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil && len(name) == 0 {
+			name = filepath.Base(params["filename"])
+		}
+		if len(name) != 0 {
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				return nil, err
+			}
+			name = NormalizeTitle(name)
+			results = append(results, &upload{attachment: &Attachment{Name: name, ContentType: attachmentContentType(r.Header.Get("Content-Type"), name, data)}, data: data})
+		}
+	}
+
+	if len(results) == 0 {
+		return nil, ErrNoAttachment
+	}
+	for _, u := range results {
+		if !ValidAttachmentName(u.attachment.Name) {
+			return nil, ErrInvalidAttachmentName
+		}
+	}
+
+	return results, nil
+}
+
+// attachmentURL returns the path an attachment is served at.
+func attachmentURL(title string, name string) string {
+	return pageURL(title) + "/attachments/" + url.PathEscape(name)
+}
+
+// getAttachedPage loads the page whose attachments are requested, writing
+// an error response and returning false if it cannot.
+func getAttachedPage(w http.ResponseWriter, r *http.Request, store PageStore, title string) bool {
+	if _, err := store.Get(title); err == ErrPageNotFound {
+		ReturnError(w, r, http.StatusNotFound, err)
+		return false
+	} else if err != nil {
+		ReturnError(w, r, http.StatusInternalServerError, err)
+		return false
+	}
+
+	return true
+}
+
+func CreateAttachmentListHandler(store PageStore, attachments AttachmentStore, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		title := GetTitle(r)
+
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS, POST")
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Content-Disposition, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization")
+		w.Header().Set("Access-Control-Expose-Headers", "Location")
+
+		switch r.Method {
+		case "OPTIONS":
+			return
+		case "GET":
+			if !getAttachedPage(w, r, store, title) {
+				return
+			}
+
+			items, err := attachments.List(title)
+			if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			jsonResponse, _ := json.Marshal(&Attachments{Items: items})
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			w.Write(jsonResponse)
+		case "POST":
+			if !getAttachedPage(w, r, store, title) {
+				return
+			}
+
+			uploads, err := readUploads(r)
+			if err != nil {
+				ReturnError(w, r, http.StatusBadRequest, err)
+				return
+			}
+
+			results := &Attachments{Items: []*Attachment{}}
+			for _, u := range uploads {
+				u.attachment.Author = authenticatedUser(r)
+				if err := attachments.Put(title, u.attachment, u.data); err == ErrInvalidAttachmentName {
+					ReturnError(w, r, http.StatusBadRequest, err)
+					return
+				} else if err != nil {
+					ReturnError(w, r, http.StatusInternalServerError, err)
+					return
+				}
+				results.Items = append(results.Items, u.attachment)
+			}
+
+			if len(results.Items) == 1 {
+				w.Header().Set("Location", attachmentURL(title, results.Items[0].Name))
+			}
+			jsonResponse, _ := json.Marshal(results)
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			w.WriteHeader(http.StatusCreated)
+			w.Write(jsonResponse)
+		}
+	}
+}
+
+// CreateAttachmentHandler serves an attachment's content, supporting range
+// and conditional requests, and deletes attachments.
+func CreateAttachmentHandler(store PageStore, attachments AttachmentStore, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		title := GetTitle(r)
+		name := NormalizeTitle(mux.Vars(r)["name"])
+
+		w.Header().Set("Access-Control-Allow-Methods", "DELETE, GET, HEAD, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization, Range, If-Range, If-None-Match, If-Modified-Since")
+		w.Header().Set("Access-Control-Expose-Headers", "Accept-Ranges, Content-Disposition, Content-Length, Content-Range, ETag, Last-Modified")
+
+		switch r.Method {
+		case "OPTIONS":
+			return
+		case "GET", "HEAD":
+			if !getAttachedPage(w, r, store, title) {
+				return
+			}
+
+			a, content, err := attachments.Open(title, name)
+			if err == ErrAttachmentNotFound {
+				ReturnError(w, r, http.StatusNotFound, err)
+				return
+			} else if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			defer content.Close()
+
+			disposition := "attachment"
+			if mediatype, _, err := mime.ParseMediaType(a.ContentType); err == nil && inlineContentTypes[strings.ToLower(mediatype)] {
+				disposition = "inline"
+			}
+			w.Header().Set("Content-Type", a.ContentType)
+			w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Name}))
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Header().Set("ETag", "\""+a.Hash+"\"")
+
+			http.ServeContent(w, r, a.Name, a.Modified, content)
+		case "DELETE":
+			if !getAttachedPage(w, r, store, title) {
+				return
+			}
+
+			if err := attachments.Delete(title, name); err == ErrAttachmentNotFound {
+				ReturnError(w, r, http.StatusNotFound, err)
+				return
+			} else if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func CheckAttachmentStore(store AttachmentStore, t *testing.T) {
+	// missing attachments
+	if items, err := store.List("TestPage"); err != nil || len(items) != 0 {
+		t.Errorf("got %v, %v listing attachments of a new page, expected none", items, err)
+	}
+	if _, _, err := store.Open("TestPage", "test.txt"); err != ErrAttachmentNotFound {
+		t.Errorf("got error %v opening missing attachment, expected %v", err, ErrAttachmentNotFound)
+	}
+	if err := store.Delete("TestPage", "test.txt"); err != ErrAttachmentNotFound {
+		t.Errorf("got error %v deleting missing attachment, expected %v", err, ErrAttachmentNotFound)
+	}
+
+	// invalid names
+	for _, name := range []string{"", ".", "..", "a/b", " test.txt", "test\n.txt"} {
+		if err := store.Put("TestPage", &Attachment{Name: name}, []byte("x")); err != ErrInvalidAttachmentName {
+			t.Errorf("got error %v storing attachment %q, expected %v", err, name, ErrInvalidAttachmentName)
+		}
+	}
+
+	// put, replace and open
+	for _, a := range []*Attachment{
+		{Name: "test.txt", ContentType: "text/plain", Author: "test"},
+		{Name: "Diagram ü.png", ContentType: "image/png"},
+		{Name: ".hidden", ContentType: "text/plain"},
+	} {
+		if err := store.Put("Team/TestPage", a, []byte("first "+a.Name)); err != nil {
+			t.Fatalf("storing attachment %s returned error %v", a.Name, err)
+		}
+	}
+	a := &Attachment{Name: "test.txt", ContentType: "text/plain", Author: "test"}
+	if err := store.Put("Team/TestPage", a, []byte("Test result")); err != nil {
+		t.Fatalf("replacing attachment returned error %v", err)
+	}
+	if a.Size != 11 || a.Hash != "07d799ec6591cb484ec0ab41afd0798a" || a.Modified.IsZero() {
+		t.Errorf("got attachment %+v, expected its size, hash and modified time set", a)
+	}
+
+	stored, content, err := store.Open("Team/TestPage", "test.txt")
+	if err != nil {
+		t.Fatalf("opening attachment returned error %v", err)
+	}
+	data, err := ioutil.ReadAll(content)
+	content.Close()
+	if err != nil {
+		t.Fatalf("reading attachment returned error %v", err)
+	}
+	if string(data) != "Test result" || *stored != *a {
+		t.Errorf("got attachment %+v with %q, expected %+v with %q", stored, data, a, "Test result")
+	}
+
+	items, err := store.List("Team/TestPage")
+	if err != nil {
+		t.Fatalf("listing attachments returned error %v", err)
+	}
+	names := []string{}
+	for _, item := range items {
+		names = append(names, item.Name)
+	}
+	if strings.Join(names, ",") != ".hidden,Diagram ü.png,test.txt" {
+		t.Errorf("got attachments %v, expected %v", names, []string{".hidden", "Diagram ü.png", "test.txt"})
+	}
+	if items, err := store.List("Team"); err != nil || len(items) != 0 {
+		t.Errorf("got %v, %v listing attachments of the parent page, expected none", items, err)
+	}
+
+	// move and delete
+	if err := store.Move("Team/TestPage", "Archive/TestPage"); err != nil {
+		t.Fatalf("moving attachments returned error %v", err)
+	}
+	if items, err := store.List("Team/TestPage"); err != nil || len(items) != 0 {
+		t.Errorf("got %v, %v listing attachments after moving them, expected none", items, err)
+	}
+	for _, name := range names {
+		if err := store.Delete("Archive/TestPage", name); err != nil {
+			t.Errorf("deleting attachment %s returned error %v", name, err)
+		}
+	}
+	if items, err := store.List("Archive/TestPage"); err != nil || len(items) != 0 {
+		t.Errorf("got %v, %v listing attachments after deleting them, expected none", items, err)
+	}
+}
+
+func TestMemoryAttachmentStore(t *testing.T) {
+	CheckAttachmentStore(NewMemoryAttachmentStore(), t)
+}
+
+func TestFileAttachmentStore(t *testing.T) {
+	directory, err := ioutil.TempDir("", "rest-wiki-site")
+	if err != nil {
+		t.Fatalf("creating data directory returned error %v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	store, err := NewFileAttachmentStore(filepath.Join(directory, "data"))
+	if err != nil {
+		t.Fatalf("opening file store returned error %v", err)
+	}
+	CheckAttachmentStore(store, t)
+
+	// attachments share the data directory without showing up as pages
+	pages, err := NewFilePageStore(store.Directory)
+	if err != nil {
+		t.Fatalf("opening file store returned error %v", err)
+	}
+	if err := store.Put("TestPage", &Attachment{Name: "notes.txt"}, []byte("Test result")); err != nil {
+		t.Fatalf("storing attachment returned error %v", err)
+	}
+	if items, err := pages.List(); err != nil || len(items) != 0 {
+		t.Errorf("got %v, %v listing pages, expected none", items, err)
+	}
+}
+
+func TestAttachmentUpload(t *testing.T) {
+	store := NewMemoryPageStore()
+	p := &Page{Title: "TestPage", Body: "Test result"}
+	if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("creating test page returned error %v", err)
+	}
+	attachments := NewMemoryAttachmentStore()
+	router := CreateRouter(store, attachments, "test", 30*60, "test", "test", "*", 1<<10)
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	// raw upload, named by the query
+	r, dat, err := MakeRequestWithHeaders(router, "POST", "/page/TestPage/attachments?name=notes.txt", []byte("Test result"), map[string]string{"Content-Type": "text/plain"}, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+
+	// authorization headers
+	CheckAuthHeader("test", "test", r, t)
+
+	if r.Code != 201 {
+		t.Errorf("got response code = %d uploading attachment, expected %d", r.Code, 201)
+	}
+	if location := r.Header().Get("Location"); location != "/page/TestPage/attachments/notes.txt" {
+		t.Errorf("got location %s, expected %s", location, "/page/TestPage/attachments/notes.txt")
+	}
+	if items, _ := dat["items"].([]interface{}); len(items) != 1 {
+		t.Errorf("got items %v, expected the uploaded attachment", dat["items"])
+	}
+
+	// raw upload, named by Content-Disposition with the type guessed
+	if r, _, _ := MakeRequestWithHeaders(router, "POST", "/page/TestPage/attachments", []byte("%PDF-1.4"), map[string]string{"Content-Disposition": `attachment; filename="report.pdf"`}, a); r.Code != 201 {
+		t.Errorf("got response code = %d uploading named attachment, expected %d", r.Code, 201)
+	}
+
+	// multipart upload of two files
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("comment", "ignored")
+	for name, contentType := range map[string]string{"diagram.svg": "image/svg+xml", "Größe.txt": "text/plain"} {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="file"; filename="`+name+`"`)
+		header.Set("Content-Type", contentType)
+		part, _ := writer.CreatePart(header)
+		part.Write([]byte("<svg/>"))
+	}
+	writer.Close()
+	if r, dat, _ := MakeRequestWithHeaders(router, "POST", "/page/TestPage/attachments", body.Bytes(), map[string]string{"Content-Type": writer.FormDataContentType()}, a); r.Code != 201 {
+		t.Errorf("got response code = %d uploading multipart attachments, expected %d", r.Code, 201)
+	} else if items, _ := dat["items"].([]interface{}); len(items) != 2 {
+		t.Errorf("got items %v, expected the two uploaded attachments", dat["items"])
+	}
+
+	// failed uploads
+	for _, test := range []struct {
+		url     string
+		body    []byte
+		headers map[string]string
+		code    int
+	}{
+		{"/page/MissingPage/attachments?name=notes.txt", []byte("x"), nil, 404},
+		{"/page/TestPage/attachments", []byte("x"), nil, 400},
+		{"/page/TestPage/attachments?name=..", []byte("x"), nil, 400},
+		{"/page/TestPage/attachments?name=large.bin", bytes.Repeat([]byte("x"), 1<<10+1), nil, 413},
+	} {
+		if r, _, _ := MakeRequestWithHeaders(router, "POST", test.url, test.body, test.headers, a); r.Code != test.code {
+			t.Errorf("got response code = %d posting to %s, expected %d", r.Code, test.url, test.code)
+		}
+	}
+
+	// list
+	r, dat, _ = MakeRequest(router, "GET", "/page/TestPage/attachments", nil, a)
+	if r.Code != 200 {
+		t.Errorf("got response code = %d listing attachments, expected %d", r.Code, 200)
+	}
+	names := []string{}
+	items, _ := dat["items"].([]interface{})
+	for _, item := range items {
+		names = append(names, item.(map[string]interface{})["name"].(string))
+	}
+	if strings.Join(names, ",") != "Größe.txt,diagram.svg,notes.txt,report.pdf" {
+		t.Errorf("got attachments %v, expected %v", names, []string{"Größe.txt", "diagram.svg", "notes.txt", "report.pdf"})
+	}
+	if r, _, _ := MakeRequest(router, "GET", "/page/MissingPage/attachments", nil, a); r.Code != 404 {
+		t.Errorf("got response code = %d listing attachments of missing page, expected %d", r.Code, 404)
+	}
+
+	// download
+	for _, test := range []struct {
+		name        string
+		contentType string
+		disposition string
+		body        string
+	}{
+		{"notes.txt", "text/plain", `inline; filename=notes.txt`, "Test result"},
+		{"report.pdf", "application/pdf", `inline; filename=report.pdf`, "%PDF-1.4"},
+		{"diagram.svg", "image/svg+xml", `attachment; filename=diagram.svg`, "<svg/>"},
+		{"Größe.txt", "text/plain", `inline; filename*=utf-8''Gr%C3%B6%C3%9Fe.txt`, "<svg/>"},
+	} {
+		r, _, _ := MakeRequest(router, "GET", attachmentURL("TestPage", test.name), nil, a)
+		if r.Code != 200 {
+			t.Errorf("got response code = %d downloading %s, expected %d", r.Code, test.name, 200)
+			continue
+		}
+		if contentType := r.Header().Get("Content-Type"); contentType != test.contentType {
+			t.Errorf("got content type %s for %s, expected %s", contentType, test.name, test.contentType)
+		}
+		if disposition := r.Header().Get("Content-Disposition"); disposition != test.disposition {
+			t.Errorf("got content disposition %s for %s, expected %s", disposition, test.name, test.disposition)
+		}
+		if r.Body.String() != test.body {
+			t.Errorf("got body %q for %s, expected %q", r.Body.String(), test.name, test.body)
+		}
+	}
+
+	// ranges and validators
+	r, _, _ = MakeRequestWithHeaders(router, "GET", "/page/TestPage/attachments/notes.txt", nil, map[string]string{"Range": "bytes=5-"}, a)
+	if r.Code != 206 || r.Body.String() != "result" || r.Header().Get("Content-Range") != "bytes 5-10/11" {
+		t.Errorf("got response code = %d with %q and range %s, expected %d with %q", r.Code, r.Body.String(), r.Header().Get("Content-Range"), 206, "result")
+	}
+	if r, _, _ := MakeRequestWithHeaders(router, "GET", "/page/TestPage/attachments/notes.txt", nil, map[string]string{"Range": "bytes=20-"}, a); r.Code != 416 {
+		t.Errorf("got response code = %d for unsatisfiable range, expected %d", r.Code, 416)
+	}
+	etag := r.Header().Get("ETag")
+	if r, _, _ := MakeRequestWithHeaders(router, "GET", "/page/TestPage/attachments/notes.txt", nil, map[string]string{"If-None-Match": etag}, a); r.Code != 304 {
+		t.Errorf("got response code = %d for current copy, expected %d", r.Code, 304)
+	}
+
+	// attachments follow their page when it moves
+	if r, _, _ := MakeRequest(router, "POST", "/page/TestPage/move", []byte(`{"destination":"Archive/TestPage"}`), a); r.Code != 200 {
+		t.Fatalf("got response code = %d moving page, expected %d", r.Code, 200)
+	}
+	if r, _, _ := MakeRequest(router, "GET", "/page/Archive/TestPage/attachments/notes.txt", nil, a); r.Code != 200 || r.Body.String() != "Test result" {
+		t.Errorf("got response code = %d with %q downloading moved attachment, expected %d", r.Code, r.Body.String(), 200)
+	}
+
+	// delete
+	if r, _, _ := MakeRequest(router, "DELETE", "/page/Archive/TestPage/attachments/notes.txt", nil, a); r.Code != 204 {
+		t.Errorf("got response code = %d deleting attachment, expected %d", r.Code, 204)
+	}
+	for _, method := range []string{"GET", "DELETE"} {
+		if r, _, _ := MakeRequest(router, method, "/page/Archive/TestPage/attachments/notes.txt", nil, a); r.Code != 404 {
+			t.Errorf("got response code = %d for %s of deleted attachment, expected %d", r.Code, method, 404)
+		}
+	}
+}
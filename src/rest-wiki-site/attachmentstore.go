@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var ErrAttachmentNotFound = errors.New("Attachment not found")
+var ErrInvalidAttachmentName = errors.New("Invalid attachment name")
+
+// Attachment describes a file attached to a page.
+type Attachment struct {
+	Name        string    `json:"name"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	Hash        string    `json:"hash"`
+	Modified    time.Time `json:"modified"`
+	Author      string    `json:"author,omitempty"`
+}
+
+type Attachments struct {
+	Items []*Attachment `json:"items"`
+}
+
+// AttachmentContent is the stored data of an attachment. It can be read
+// from any offset, so that ranges can be served.
+type AttachmentContent interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// AttachmentStore keeps the files attached to pages, by page title.
+type AttachmentStore interface {
+	// List returns the page's attachments sorted by name.
+	List(title string) ([]*Attachment, error)
+	// Open returns an attachment and its content, which the caller must
+	// close, or ErrAttachmentNotFound.
+	Open(title string, name string) (*Attachment, AttachmentContent, error)
+	// Put creates or replaces an attachment, setting its Size, Hash and
+	// Modified from data.
+	Put(title string, a *Attachment, data []byte) error
+	// Delete removes an attachment, or returns ErrAttachmentNotFound.
+	Delete(title string, name string) error
+	// Move gives every attachment of a page to destination, replacing
+	// any it had.
+	Move(title string, destination string) error
+}
+
+// ValidAttachmentName reports whether name can name an attachment. Names
+// follow the rules of a single title segment, as they are used as paths.
+func ValidAttachmentName(name string) bool {
+	if len(name) == 0 || !utf8.ValidString(name) || NormalizeTitle(name) != name {
+		return false
+	}
+	if name == "." || name == ".." || strings.TrimSpace(name) != name || strings.Contains(name, "/") {
+		return false
+	}
+
+	return strings.IndexFunc(name, unicode.IsControl) < 0
+}
+
+// validAttachmentTitle reports whether title can own attachments: it is
+// the title of a page, or the one the attachments of a deleted page are
+// kept under.
+func validAttachmentTitle(title string) bool {
+	return ValidTitle(title) || (strings.HasSuffix(title, trashedAttachmentsSuffix) && ValidTitle(strings.TrimSuffix(title, trashedAttachmentsSuffix)))
+}
+
+// setAttachmentData fills in the fields of a that are derived from data.
+func setAttachmentData(a *Attachment, data []byte) {
+	hasher := md5.New()
+	hasher.Write(data)
+	a.Hash = hex.EncodeToString(hasher.Sum(nil))
+	a.Size = int64(len(data))
+	a.Modified = time.Now().UTC()
+}
+
+type byAttachmentName []*Attachment
+
+func (a byAttachmentName) Len() int           { return len(a) }
+func (a byAttachmentName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byAttachmentName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+// MemoryAttachmentStore keeps attachments in memory. It is safe for
+// concurrent use.
+type MemoryAttachmentStore struct {
+	mu          sync.RWMutex
+	attachments map[string]map[string]*memoryAttachment
+}
+
+type memoryAttachment struct {
+	attachment *Attachment
+	data       []byte
+}
+
+func NewMemoryAttachmentStore() *MemoryAttachmentStore {
+	return &MemoryAttachmentStore{attachments: map[string]map[string]*memoryAttachment{}}
+}
+
+func (s *MemoryAttachmentStore) List(title string) ([]*Attachment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := []*Attachment{}
+	for _, stored := range s.attachments[title] {
+		a := *stored.attachment
+		results = append(results, &a)
+	}
+	sort.Sort(byAttachmentName(results))
+
+	return results, nil
+}
+
+func (s *MemoryAttachmentStore) Open(title string, name string) (*Attachment, AttachmentContent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.attachments[title][name]
+	if !ok {
+		return nil, nil, ErrAttachmentNotFound
+	}
+	a := *stored.attachment
+
+	return &a, memoryAttachmentContent{bytes.NewReader(stored.data)}, nil
+}
+
+type memoryAttachmentContent struct {
+	*bytes.Reader
+}
+
+func (c memoryAttachmentContent) Close() error {
+	return nil
+}
+
+func (s *MemoryAttachmentStore) Put(title string, a *Attachment, data []byte) error {
+	if !ValidTitle(title) || !ValidAttachmentName(a.Name) {
+		return ErrInvalidAttachmentName
+	}
+	setAttachmentData(a, data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.attachments[title] == nil {
+		s.attachments[title] = map[string]*memoryAttachment{}
+	}
+	stored := *a
+	s.attachments[title][a.Name] = &memoryAttachment{attachment: &stored, data: append([]byte(nil), data...)}
+
+	return nil
+}
+
+func (s *MemoryAttachmentStore) Delete(title string, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.attachments[title][name]; !ok {
+		return ErrAttachmentNotFound
+	}
+	delete(s.attachments[title], name)
+	if len(s.attachments[title]) == 0 {
+		delete(s.attachments, title)
+	}
+
+	return nil
+}
+
+func (s *MemoryAttachmentStore) Move(title string, destination string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.attachments, destination)
+	if attachments, ok := s.attachments[title]; ok {
+		s.attachments[destination] = attachments
+		delete(s.attachments, title)
+	}
+
+	return nil
+}
+
+// FileAttachmentStore keeps the attachments of each page in
+// .attachments/<title>/ of Directory, every one as <name>.data with its
+// description in <name>.json beside it. Titles and names are escaped with
+// encodeFilename, as in FilePageStore, whose data directory it can share.
+type FileAttachmentStore struct {
+	Directory string
+
+	mu sync.Mutex
+}
+
+// NewFileAttachmentStore creates the data directory if it does not exist
+// yet.
+func NewFileAttachmentStore(directory string) (*FileAttachmentStore, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+
+	return &FileAttachmentStore{Directory: directory}, nil
+}
+
+func (s *FileAttachmentStore) attachmentDirectory(title string) string {
+	return filepath.Join(s.Directory, ".attachments", encodeFilename(title))
+}
+
+func (s *FileAttachmentStore) filename(title string, name string) string {
+	return filepath.Join(s.attachmentDirectory(title), encodeFilename(name))
+}
+
+func (s *FileAttachmentStore) readDescription(title string, name string) (*Attachment, error) {
+	data, err := ioutil.ReadFile(s.filename(title, name) + ".json")
+	if err != nil && os.IsNotExist(err) {
+		return nil, ErrAttachmentNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	a := &Attachment{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, err
+	}
+	a.Name = name
+
+	return a, nil
+}
+
+func (s *FileAttachmentStore) List(title string) ([]*Attachment, error) {
+	results := []*Attachment{}
+	if !validAttachmentTitle(title) {
+		return results, nil
+	}
+
+	files, err := ioutil.ReadDir(s.attachmentDirectory(title))
+	if err != nil && os.IsNotExist(err) {
+		return results, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		name, err := url.PathUnescape(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil || !ValidAttachmentName(name) {
+			continue
+		}
+		a, err := s.readDescription(title, name)
+		if err == ErrAttachmentNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		results = append(results, a)
+	}
+	sort.Sort(byAttachmentName(results))
+
+	return results, nil
+}
+
+func (s *FileAttachmentStore) Open(title string, name string) (*Attachment, AttachmentContent, error) {
+	if !ValidTitle(title) || !ValidAttachmentName(name) {
+		return nil, nil, ErrAttachmentNotFound
+	}
+
+	a, err := s.readDescription(title, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(s.filename(title, name) + ".data")
+	if err != nil && os.IsNotExist(err) {
+		return nil, nil, ErrAttachmentNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	return a, f, nil
+}
+
+func (s *FileAttachmentStore) Put(title string, a *Attachment, data []byte) error {
+	if !ValidTitle(title) || !storableTitle(title) || !ValidAttachmentName(a.Name) || len(encodeFilename(a.Name))+len(".data") > maxFilenameLength {
+		return ErrInvalidAttachmentName
+	}
+	setAttachmentData(a, data)
+
+	description, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(s.attachmentDirectory(title), 0700); err != nil {
+		return err
+	}
+	// the description is written last, so that a failed write leaves the
+	// previous attachment or none at all
+	if err := writeFileAtomic(s.filename(title, a.Name)+".data", data); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.filename(title, a.Name)+".json", description)
+}
+
+func (s *FileAttachmentStore) Delete(title string, name string) error {
+	if !validAttachmentTitle(title) || !ValidAttachmentName(name) {
+		return ErrAttachmentNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(s.filename(title, name) + ".json"); err != nil && os.IsNotExist(err) {
+		return ErrAttachmentNotFound
+	} else if err != nil {
+		return err
+	}
+	if err := os.Remove(s.filename(title, name) + ".data"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// leave no empty directory behind
+	os.Remove(s.attachmentDirectory(title))
+
+	return nil
+}
+
+func (s *FileAttachmentStore) Move(title string, destination string) error {
+	if !validAttachmentTitle(title) || !validAttachmentTitle(destination) {
+		return ErrInvalidTitle
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.RemoveAll(s.attachmentDirectory(destination)); err != nil {
+		return err
+	}
+	if err := os.Rename(s.attachmentDirectory(title), s.attachmentDirectory(destination)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -10,6 +10,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/gorilla/context"
 	"io/ioutil"
 	"net/http"
 	"regexp"
@@ -24,6 +25,12 @@ const (
 	Signature
 )
 
+type contextKey int
+
+const (
+	authenticationKey contextKey = iota
+)
+
 var validAuthorization = regexp.MustCompile("^HMAC ")
 
 type Authentication struct {
@@ -214,7 +221,7 @@ func CreateAuthorizedRequestHandler(secret string, sessiontimeout int64, allowOr
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Methods", methods)
 		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization, If-Match, If-None-Match, If-Modified-Since, Content-Disposition, Range, If-Range")
 
 		if r.Method == "OPTIONS" {
 			return
@@ -240,6 +247,40 @@ func CreateAuthorizedRequestHandler(secret string, sessiontimeout int64, allowOr
 			return
 		}
 
+		context.Set(r, authenticationKey, a)
+
 		fn(w, r)
 	}
 }
+
+// GetAuthentication returns the signed-in user of a request that passed
+// through CreateAuthorizedRequestHandler, or nil.
+func GetAuthentication(r *http.Request) *Authentication {
+	if a := context.Get(r, authenticationKey); a != nil {
+		return a.(*Authentication)
+	}
+
+	return nil
+}
+
+// authenticatedUser returns the username of the signed-in user of a
+// request, or "" if it has none.
+func authenticatedUser(r *http.Request) string {
+	if a := GetAuthentication(r); a != nil {
+		return a.Username
+	}
+
+	return ""
+}
+
+// authoredStore returns store with its changes attributed to the signed-in
+// user of the request, if it records authors.
+func authoredStore(store PageStore, r *http.Request) PageStore {
+	if authored, ok := store.(AuthoredPageStore); ok {
+		if user := authenticatedUser(r); len(user) != 0 {
+			return authored.ForAuthor(user)
+		}
+	}
+
+	return store
+}
@@ -8,7 +8,7 @@ import (
 )
 
 func TestBasicAuth(t *testing.T) {
-	router := CreateRouter("test", 30*60, "test", "test", "*")
+	router := CreateRouter(NewMemoryPageStore(), NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
 
 	// BasicAuth
 	r, err := MakeSignatureRequest(router, "BasicAuth", "test", "test")
@@ -20,7 +20,7 @@ func TestBasicAuth(t *testing.T) {
 }
 
 func TestPostAuth(t *testing.T) {
-	router := CreateRouter("test", 30*60, "test", "test", "*")
+	router := CreateRouter(NewMemoryPageStore(), NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
 
 	// BasicAuth
 	r, err := MakeSignatureRequest(router, "Post", "test", "test")
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// cacheEntryOverhead is roughly what a cached page costs beyond its text,
+// for the page, its metadata and the cache's own bookkeeping.
+const cacheEntryOverhead = 256
+
+// listCacheKey is the cache key of the page list, which no title can be.
+const listCacheKey = ""
+
+// CacheStats counts the lookups of a CachedPageStore.
+type CacheStats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+	Limit   int64 `json:"limit"`
+}
+
+// CachedPageStore keeps the most recently loaded pages, and the page list,
+// in memory in front of another store, up to a limit in bytes. Entries are
+// invalidated by every change made through the cache, so the underlying
+// store must not be changed past it. Revisions and the trash are not
+// cached.
+type CachedPageStore struct {
+	PageStore
+
+	cache *pageCache
+}
+
+// pageCache is shared by a CachedPageStore and those returned by its
+// ForAuthor.
+type pageCache struct {
+	mu      sync.Mutex
+	limit   int64
+	size    int64
+	entries map[string]*list.Element
+	order   *list.List
+	// generation counts invalidations, so that a load that raced one is
+	// not cached
+	generation int64
+	hits       int64
+	misses     int64
+}
+
+type cacheEntry struct {
+	key   string
+	page  *Page
+	pages []*Page
+	size  int64
+}
+
+// NewCachedPageStore caches up to limit bytes of pages in front of store.
+// With a limit of 0 nothing is cached, but lookups are still counted.
+func NewCachedPageStore(store PageStore, limit int64) *CachedPageStore {
+	return &CachedPageStore{PageStore: store, cache: &pageCache{limit: limit, entries: map[string]*list.Element{}, order: list.New()}}
+}
+
+// copyPage returns a copy of p that shares nothing it could change.
+func copyPage(p *Page) *Page {
+	result := *p
+	result.Tags = append([]string(nil), p.Tags...)
+	if p.Metadata != nil {
+		metadata := *p.Metadata
+		result.Metadata = &metadata
+	}
+
+	return &result
+}
+
+// cachedSize estimates the memory a cached page takes.
+func cachedSize(p *Page) int64 {
+	size := int64(cacheEntryOverhead + len(p.Title) + len(p.DisplayTitle) + len(p.Redirect) + len(p.Body))
+	for _, tag := range p.Tags {
+		size += int64(len(tag))
+	}
+
+	return size
+}
+
+// lookup returns the entry cached under key, counting the hit or miss,
+// and the generation to pass to add when it is missing.
+func (c *pageCache) lookup(key string) (*cacheEntry, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, c.generation
+	}
+	c.hits++
+	c.order.MoveToFront(element)
+
+	return element.Value.(*cacheEntry), c.generation
+}
+
+// add caches an entry loaded at generation, evicting the least recently
+// used entries to make room for it.
+func (c *pageCache) add(entry *cacheEntry, generation int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation || entry.size > c.limit {
+		return
+	}
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+	for c.size+entry.size > c.limit {
+		c.remove(c.order.Back())
+	}
+
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.size += entry.size
+}
+
+func (c *pageCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// invalidate drops the pages with the titles, and the page list.
+func (c *pageCache) invalidate(titles ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for _, key := range append(titles, listCacheKey) {
+		if element, ok := c.entries[key]; ok {
+			c.remove(element)
+		}
+	}
+}
+
+func (s *CachedPageStore) Get(title string) (*Page, error) {
+	entry, generation := s.cache.lookup(title)
+	if entry != nil {
+		return copyPage(entry.page), nil
+	}
+
+	p, err := s.PageStore.Get(title)
+	if err != nil {
+		return nil, err
+	}
+	s.cache.add(&cacheEntry{key: title, page: copyPage(p), size: cachedSize(p)}, generation)
+
+	return p, nil
+}
+
+func (s *CachedPageStore) List() ([]*Page, error) {
+	entry, generation := s.cache.lookup(listCacheKey)
+	if entry != nil {
+		results := make([]*Page, len(entry.pages))
+		for i, p := range entry.pages {
+			results[i] = copyPage(p)
+		}
+		return results, nil
+	}
+
+	pages, err := s.PageStore.List()
+	if err != nil {
+		return nil, err
+	}
+	entry = &cacheEntry{key: listCacheKey, pages: make([]*Page, len(pages)), size: cacheEntryOverhead}
+	for i, p := range pages {
+		entry.pages[i] = copyPage(p)
+		entry.size += cachedSize(p)
+	}
+	s.cache.add(entry, generation)
+
+	return pages, nil
+}
+
+func (s *CachedPageStore) Put(p *Page, r *Revision) error {
+	defer s.cache.invalidate(p.Title)
+
+	return s.PageStore.Put(p, r)
+}
+
+func (s *CachedPageStore) Delete(title string) error {
+	defer s.cache.invalidate(title)
+
+	return s.PageStore.Delete(title)
+}
+
+func (s *CachedPageStore) Restore(title string) error {
+	defer s.cache.invalidate(title)
+
+	return s.PageStore.Restore(title)
+}
+
+func (s *CachedPageStore) Move(title string, destination string) error {
+	defer s.cache.invalidate(title, destination)
+
+	return s.PageStore.Move(title, destination)
+}
+
+// ForAuthor attributes changes to author in the underlying store, if it
+// records authors, sharing the cache.
+func (s *CachedPageStore) ForAuthor(author string) PageStore {
+	store := s.PageStore
+	if authored, ok := store.(AuthoredPageStore); ok {
+		store = authored.ForAuthor(author)
+	}
+
+	return &CachedPageStore{PageStore: store, cache: s.cache}
+}
+
+// Stats returns the cache's hit and miss counts and its size.
+func (s *CachedPageStore) Stats() *CacheStats {
+	s.cache.mu.Lock()
+	defer s.cache.mu.Unlock()
+
+	return &CacheStats{Hits: s.cache.hits, Misses: s.cache.misses, Entries: len(s.cache.entries), Size: s.cache.size, Limit: s.cache.limit}
+}
+
+// CreateCacheStatsHandler reports the page cache's counters to the admin
+// user.
+func CreateCacheStatsHandler(store *CachedPageStore, adminuserid string, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization")
+
+		switch r.Method {
+		case "OPTIONS":
+			return
+		case "GET":
+			if user := authenticatedUser(r); len(user) == 0 || user != adminuserid {
+				ReturnError(w, r, http.StatusForbidden, errors.New("Only the admin user may read the cache statistics"))
+				return
+			}
+
+			jsonResponse, _ := json.Marshal(store.Stats())
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			w.Write(jsonResponse)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCachedPageStore(t *testing.T) {
+	CheckPageStore(NewCachedPageStore(NewMemoryPageStore(), 1<<20), t)
+}
+
+func TestCachedPageStoreInvalidation(t *testing.T) {
+	memory := NewMemoryPageStore()
+	store := NewCachedPageStore(memory, 1<<20)
+	p := &Page{Title: "TestPage", Body: "Test result", Tags: []string{"test"}}
+	if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("saving page returned error %v", err)
+	}
+
+	// the second load is a hit, and changing what was loaded does not
+	// change the cache
+	for i := 0; i < 2; i++ {
+		loaded, err := store.Get("TestPage")
+		if err != nil || loaded.Body != "Test result" || loaded.Tags[0] != "test" {
+			t.Fatalf("got %+v, %v loading page, expected it unchanged", loaded, err)
+		}
+		loaded.Body = "Changed"
+		loaded.Tags[0] = "changed"
+	}
+	if stats := store.Stats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("got stats %+v, expected a hit and a miss", stats)
+	}
+
+	// saving, moving, deleting and restoring invalidate the page and the
+	// list
+	for _, change := range []struct {
+		name  string
+		fn    func() error
+		title string
+		pages int
+	}{
+		{"save", func() error {
+			return (&Page{Title: "TestPage", Body: "Test result updated"}).Save(store, &Revision{Author: "test"})
+		}, "TestPage", 1},
+		{"move", func() error { return store.Move("TestPage", "Team/TestPage") }, "Team/TestPage", 1},
+		{"delete", func() error { return store.Delete("Team/TestPage") }, "", 0},
+		{"restore", func() error { return store.Restore("Team/TestPage") }, "Team/TestPage", 1},
+	} {
+		store.List()
+		store.Get("TestPage")
+		store.Get("Team/TestPage")
+		if err := change.fn(); err != nil {
+			t.Fatalf("%s returned error %v", change.name, err)
+		}
+
+		if pages, err := store.List(); err != nil || len(pages) != change.pages || (change.pages != 0 && pages[0].Title != change.title) {
+			t.Errorf("got pages %v, %v after %s, expected %q", pages, err, change.name, change.title)
+		}
+		for _, title := range []string{"TestPage", "Team/TestPage"} {
+			loaded, err := store.Get(title)
+			if title != change.title && err != ErrPageNotFound {
+				t.Errorf("got %+v, %v loading %s after %s, expected %v", loaded, err, title, change.name, ErrPageNotFound)
+			} else if title == change.title && (err != nil || loaded.Body != "Test result updated") {
+				t.Errorf("got %+v, %v loading %s after %s, expected the update", loaded, err, title, change.name)
+			}
+		}
+	}
+
+	// changes through ForAuthor share the cache
+	if err := (&Page{Title: "Team/TestPage", Body: "Authored"}).Save(store.ForAuthor("other"), &Revision{Author: "other"}); err != nil {
+		t.Fatalf("saving page returned error %v", err)
+	}
+	if loaded, err := store.Get("Team/TestPage"); err != nil || loaded.Body != "Authored" {
+		t.Errorf("got %+v, %v loading page saved for author, expected %q", loaded, err, "Authored")
+	}
+}
+
+func TestCachedPageStoreEviction(t *testing.T) {
+	memory := NewMemoryPageStore()
+	for _, title := range []string{"Page1", "Page2", "Page3"} {
+		p := &Page{Title: title, Body: "Test result"}
+		if err := p.Save(memory, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("saving page returned error %v", err)
+		}
+	}
+	size := cachedSize(&Page{Title: "Page1", Body: "Test result"})
+
+	// room for two pages, of which the least recently used is evicted
+	store := NewCachedPageStore(memory, 2*size)
+	for _, title := range []string{"Page1", "Page2", "Page1", "Page3", "Page1", "Page2"} {
+		if _, err := store.Get(title); err != nil {
+			t.Fatalf("loading page returned error %v", err)
+		}
+	}
+	if stats := store.Stats(); stats.Hits != 2 || stats.Misses != 4 || stats.Entries != 2 || stats.Size != 2*size {
+		t.Errorf("got stats %+v, expected 2 hits, 4 misses and 2 entries of %d bytes", stats, 2*size)
+	}
+
+	// pages larger than the cache, or any page with a size of 0, are not
+	// cached
+	for _, limit := range []int64{size - 1, 0} {
+		store := NewCachedPageStore(memory, limit)
+		store.Get("Page1")
+		store.Get("Page1")
+		if stats := store.Stats(); stats.Hits != 0 || stats.Entries != 0 || stats.Size != 0 {
+			t.Errorf("got stats %+v with limit %d, expected nothing cached", stats, limit)
+		}
+	}
+}
+
+func TestCacheStatsGet(t *testing.T) {
+	store := NewCachedPageStore(NewMemoryPageStore(), 1<<20)
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// users other than the admin may not read the statistics
+	other := &Authentication{Username: "other", Timestamp: time.Now().Unix()}
+	other.CreateSignature("test")
+	if r, _, _ := MakeRequest(router, "GET", "/cache", nil, other); r.Code != 403 {
+		t.Errorf("got response code = %d reading statistics as other user, expected %d", r.Code, 403)
+	}
+	if r := MakeUnauthenticatedRequest(CreateCacheStatsHandler(store, "test", "*"), "/cache", "GET", "/cache"); r.Code != 403 {
+		t.Errorf("got response code = %d reading statistics without a signed-in user, expected %d", r.Code, 403)
+	}
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	p := &Page{Title: "TestPage", Body: "Test result"}
+	if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("saving page returned error %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if r, _, _ := MakeRequest(router, "GET", "/page/TestPage", nil, a); r.Code != 200 {
+			t.Fatalf("got response code = %d loading page, expected %d", r.Code, 200)
+		}
+	}
+
+	r, dat, err := MakeRequest(router, "GET", "/cache", nil, a)
+	if err != nil || r.Code != 200 {
+		t.Fatalf("got response code = %d, %v reading statistics, expected %d", r.Code, err, 200)
+	}
+	if hits, _ := dat["hits"].(float64); hits == 0 || dat["limit"] != float64(1<<20) {
+		t.Errorf("got statistics %v, expected hits and the limit", dat)
+	}
+
+	// without a cache there are no statistics
+	router = CreateRouter(NewMemoryPageStore(), NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+	if r, _, _ := MakeRequest(router, "GET", "/cache", nil, a); r.Code != 404 {
+		t.Errorf("got response code = %d without a cache, expected %d", r.Code, 404)
+	}
+}
+
+// RunRouterBenchmark runs requests against a file store of a thousand pages,
+// with and without the cache in front of it.
+func RunRouterBenchmark(b *testing.B, method string, url string) {
+	directory, err := ioutil.TempDir("", "rest-wiki-site")
+	if err != nil {
+		b.Fatalf("creating data directory returned error %v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	files, err := NewFilePageStore(directory)
+	if err != nil {
+		b.Fatalf("opening file store returned error %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		p := &Page{Title: fmt.Sprintf("TestPage%d", i), Body: "Test result", Tags: []string{"test"}}
+		if err := p.Save(files, &Revision{Author: "test"}); err != nil {
+			b.Fatalf("saving page returned error %v", err)
+		}
+	}
+
+	for _, store := range []PageStore{files, NewCachedPageStore(files, 64<<20)} {
+		name := "uncached"
+		if _, ok := store.(*CachedPageStore); ok {
+			name = "cached"
+		}
+		b.Run(name, func(b *testing.B) {
+			router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+			a, err := GetAuthorization(router)
+			if err != nil {
+				b.Fatalf("retrieving authorization returned error %v", err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if r, _, _ := MakeRequest(router, method, url, nil, a); r.Code != 200 {
+					b.Fatalf("got response code = %d, expected %d", r.Code, 200)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPageGet(b *testing.B) {
+	RunRouterBenchmark(b, "GET", "/page/TestPage500")
+}
+
+func BenchmarkPageList(b *testing.B) {
+	RunRouterBenchmark(b, "GET", "/page")
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const diffContext = 3
+
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+type DiffHunk struct {
+	FromLine  int         `json:"fromline"`
+	FromCount int         `json:"fromcount"`
+	ToLine    int         `json:"toline"`
+	ToCount   int         `json:"tocount"`
+	Lines     []*DiffLine `json:"lines"`
+}
+
+type Diff struct {
+	From    string      `json:"from"`
+	To      string      `json:"to"`
+	Unified string      `json:"unified"`
+	Hunks   []*DiffHunk `json:"hunks"`
+}
+
+// splitLines splits text into lines, ignoring the final newline.
+func splitLines(text string) []string {
+	if len(text) == 0 {
+		return []string{}
+	}
+
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// maxDiffLines is the most lines a version may have to be compared, which
+// bounds the time a diff takes.
+const maxDiffLines = 5000
+
+var ErrDiffTooLarge = fmt.Errorf("Versions longer than %d lines cannot be compared", maxDiffLines)
+
+// diffLines returns the shortest edit script turning a into b, using the
+// linear space refinement of Myers' O(ND) algorithm: the middle snake of
+// an optimal path is found by searching from both ends at once, and the
+// parts before and after it are diffed in turn. Ops are " " (unchanged),
+// "-" and "+", with the deletions of every change before its insertions.
+func diffLines(a []string, b []string) []*DiffLine {
+	size := 2*(len(a)+len(b)) + 4
+	script := diffRange(make([]*DiffLine, 0, len(a)+len(b)), a, b, make([]int, size), make([]int, size))
+
+	// order each run of changes
+	for i := 0; i < len(script); {
+		if script[i].Op == " " {
+			i++
+			continue
+		}
+		j := i
+		changes := []*DiffLine{}
+		for ; j < len(script) && script[j].Op != " "; j++ {
+			if script[j].Op == "-" {
+				changes = append(changes, script[j])
+			}
+		}
+		for _, l := range script[i:j] {
+			if l.Op == "+" {
+				changes = append(changes, l)
+			}
+		}
+		copy(script[i:j], changes)
+		i = j
+	}
+
+	return script
+}
+
+// diffRange appends the edit script turning a into b to script. vf and vb
+// hold the furthest paths on each diagonal searching forwards and
+// backwards, and are shared by every call.
+func diffRange(script []*DiffLine, a []string, b []string, vf []int, vb []int) []*DiffLine {
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		script = append(script, &DiffLine{Op: " ", Text: a[0]})
+		a, b = a[1:], b[1:]
+	}
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	common := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	switch {
+	case len(a) == 0:
+		for _, line := range b {
+			script = append(script, &DiffLine{Op: "+", Text: line})
+		}
+	case len(b) == 0:
+		for _, line := range a {
+			script = append(script, &DiffLine{Op: "-", Text: line})
+		}
+	default:
+		x, y, u, v := middleSnake(a, b, vf, vb)
+		script = diffRange(script, a[:x], b[:y], vf, vb)
+		for _, line := range a[x:u] {
+			script = append(script, &DiffLine{Op: " ", Text: line})
+		}
+		script = diffRange(script, a[u:], b[v:], vf, vb)
+	}
+
+	for _, line := range common {
+		script = append(script, &DiffLine{Op: " ", Text: line})
+	}
+
+	return script
+}
+
+// middleSnake returns the start (x, y) and end (u, v) of the middle snake
+// of a shortest edit script turning a into b. The backward search works on
+// the reversed inputs, so its diagonal k is the forward diagonal
+// len(a)-len(b)-k.
+func middleSnake(a []string, b []string, vf []int, vb []int) (int, int, int, int) {
+	n, m := len(a), len(b)
+	delta := n - m
+	odd := delta%2 != 0
+	offset := len(vf) / 2
+	vf[offset+1] = 0
+	vb[offset+1] = 0
+
+	for d := 0; d <= (n+m+1)/2; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && vf[offset+k-1] < vf[offset+k+1]) {
+				x = vf[offset+k+1]
+			} else {
+				x = vf[offset+k-1] + 1
+			}
+			y := x - k
+			startx, starty := x, y
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			vf[offset+k] = x
+			if odd && delta-k >= -(d-1) && delta-k <= d-1 && x+vb[offset+delta-k] >= n {
+				return startx, starty, x, y
+			}
+		}
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && vb[offset+k-1] < vb[offset+k+1]) {
+				x = vb[offset+k+1]
+			} else {
+				x = vb[offset+k-1] + 1
+			}
+			y := x - k
+			startx, starty := x, y
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x++
+				y++
+			}
+			vb[offset+k] = x
+			if !odd && delta-k >= -d && delta-k <= d && x+vf[offset+delta-k] >= n {
+				return n - x, m - y, n - startx, m - starty
+			}
+		}
+	}
+
+	// not reached, since the searches meet within (n+m+1)/2 steps
+	return 0, 0, n, m
+}
+
+// makeHunks groups an edit script into hunks with up to context unchanged
+// lines around each change. Line numbers follow unified diff conventions.
+func makeHunks(script []*DiffLine, context int) []*DiffHunk {
+	// line numbers in a and b before each line of the script
+	fromlines := make([]int, len(script))
+	tolines := make([]int, len(script))
+	fromline, toline := 1, 1
+	for i, l := range script {
+		fromlines[i], tolines[i] = fromline, toline
+		if l.Op != "+" {
+			fromline++
+		}
+		if l.Op != "-" {
+			toline++
+		}
+	}
+
+	hunks := []*DiffHunk{}
+	for i := 0; i < len(script); i++ {
+		if script[i].Op == " " {
+			continue
+		}
+
+		// extend the hunk until the unchanged run is too long to bridge
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(script) && j-end <= 2*context+1; j++ {
+			if script[j].Op != " " {
+				end = j
+			}
+		}
+		end += context
+		if end >= len(script) {
+			end = len(script) - 1
+		}
+
+		hunk := &DiffHunk{FromLine: fromlines[start], ToLine: tolines[start], Lines: script[start : end+1]}
+		for _, l := range hunk.Lines {
+			if l.Op != "+" {
+				hunk.FromCount++
+			}
+			if l.Op != "-" {
+				hunk.ToCount++
+			}
+		}
+		if hunk.FromCount == 0 {
+			hunk.FromLine--
+		}
+		if hunk.ToCount == 0 {
+			hunk.ToLine--
+		}
+		hunks = append(hunks, hunk)
+
+		i = end
+	}
+
+	return hunks
+}
+
+func unifiedDiff(from string, to string, hunks []*DiffHunk) string {
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", from, to)
+	for _, hunk := range hunks {
+		fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n", hunk.FromLine, hunk.FromCount, hunk.ToLine, hunk.ToCount)
+		for _, l := range hunk.Lines {
+			buf.WriteString(l.Op + l.Text + "\n")
+		}
+	}
+
+	return buf.String()
+}
+
+func makeDiff(title string, from string, frombody string, to string, tobody string) *Diff {
+	hunks := makeHunks(diffLines(splitLines(frombody), splitLines(tobody)), diffContext)
+
+	return &Diff{
+		From:    from,
+		To:      to,
+		Unified: unifiedDiff(title+"@"+from, title+"@"+to, hunks),
+		Hunks:   hunks,
+	}
+}
+
+// loadVersion returns the body of a revision, or of the current page when
+// id is "current".
+func loadVersion(store PageStore, title string, id string) (string, error) {
+	if id == "current" {
+		p, err := store.Get(title)
+		if err != nil {
+			return "", err
+		}
+		return p.Body, nil
+	}
+
+	revision, err := store.Revision(title, id)
+	if err != nil {
+		return "", err
+	}
+
+	return revision.Body, nil
+}
+
+func CreateDiffHandler(store PageStore, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		title := GetTitle(r)
+
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization")
+
+		switch r.Method {
+		case "OPTIONS":
+			return
+		case "GET":
+			from := r.URL.Query().Get("from")
+			to := r.URL.Query().Get("to")
+			if len(from) == 0 {
+				ReturnError(w, r, http.StatusBadRequest, errors.New("No from revision provided"))
+				return
+			}
+			if len(to) == 0 {
+				to = "current"
+			}
+
+			bodies := make([]string, 2)
+			for i, id := range []string{from, to} {
+				body, err := loadVersion(store, title, id)
+				if err == ErrPageNotFound || err == ErrRevisionNotFound {
+					ReturnError(w, r, http.StatusNotFound, err)
+					return
+				} else if err != nil {
+					ReturnError(w, r, http.StatusInternalServerError, err)
+					return
+				}
+				bodies[i] = body
+			}
+			for _, body := range bodies {
+				if strings.Count(strings.TrimSuffix(body, "\n"), "\n") >= maxDiffLines {
+					ReturnError(w, r, http.StatusUnprocessableEntity, ErrDiffTooLarge)
+					return
+				}
+			}
+
+			jsonResponse, _ := json.Marshal(makeDiff(title, from, bodies[0], to, bodies[1]))
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			w.Write(jsonResponse)
+		}
+	}
+}
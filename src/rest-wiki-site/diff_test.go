@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		from     string
+		to       string
+		expected string
+	}{
+		{"", "", ""},
+		{"a\nb\nc\n", "a\nb\nc\n", " a b c"},
+		{"", "a\n", "+a"},
+		{"a\n", "", "-a"},
+		{"a\nb\nc\n", "a\nc\n", " a-b c"},
+		{"a\nc\n", "a\nb\nc\n", " a+b c"},
+		{"a\nb\nc\n", "a\nx\nc\n", " a-b+x c"},
+	}
+
+	for _, test := range tests {
+		result := ""
+		for _, l := range diffLines(splitLines(test.from), splitLines(test.to)) {
+			result += l.Op + l.Text
+		}
+		if result != test.expected {
+			t.Errorf("diff of %q and %q got %q, expected %q", test.from, test.to, result, test.expected)
+		}
+	}
+}
+
+// EditDistance returns the number of lines deleted and inserted by a
+// shortest edit script from a to b, by dynamic programming.
+func EditDistance(a []string, b []string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			current[j] = previous[j] + 1
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+			if a[i-1] == b[j-1] && previous[j-1] < current[j] {
+				current[j] = previous[j-1]
+			}
+		}
+		previous = current
+	}
+
+	return previous[len(b)]
+}
+
+func TestDiffLinesShortest(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		a := make([]string, random.Intn(12))
+		for j := range a {
+			a[j] = string(rune('a' + random.Intn(3)))
+		}
+		b := make([]string, random.Intn(12))
+		for j := range b {
+			b[j] = string(rune('a' + random.Intn(3)))
+		}
+
+		from, to, edits := []string{}, []string{}, 0
+		for _, l := range diffLines(a, b) {
+			if l.Op != "+" {
+				from = append(from, l.Text)
+			}
+			if l.Op != "-" {
+				to = append(to, l.Text)
+			}
+			if l.Op != " " {
+				edits++
+			}
+		}
+		if strings.Join(from, "") != strings.Join(a, "") || strings.Join(to, "") != strings.Join(b, "") {
+			t.Fatalf("diff of %v and %v gave %v and %v", a, b, from, to)
+		}
+		if expected := EditDistance(a, b); edits != expected {
+			t.Errorf("diff of %v and %v has %d edits, expected %d", a, b, edits, expected)
+		}
+	}
+}
+
+func TestDiffLinesRewrite(t *testing.T) {
+	// a rewrite of every line is the longest script, and is found in
+	// memory linear in the input
+	a, b := make([]string, maxDiffLines), make([]string, maxDiffLines)
+	for i := range a {
+		a[i] = fmt.Sprintf("old %d", i)
+		b[i] = fmt.Sprintf("new %d", i)
+	}
+
+	start := time.Now()
+	script := diffLines(a, b)
+	if len(script) != 2*maxDiffLines || script[0].Op != "-" || script[len(script)-1].Op != "+" {
+		t.Errorf("got %d lines starting %v, expected every line deleted then inserted", len(script), script[0])
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("diff took %v", elapsed)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	from := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n"
+	to := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\nsixteen\n"
+
+	diff := makeDiff("TestPage", "1", from, "2", to)
+	expected := "--- TestPage@1\n+++ TestPage@2\n" +
+		"@@ -1,6 +1,6 @@\n 1\n 2\n-3\n+three\n 4\n 5\n 6\n" +
+		"@@ -13,3 +13,4 @@\n 13\n 14\n 15\n+sixteen\n"
+	if diff.Unified != expected {
+		t.Errorf("got unified diff\n%s\nexpected\n%s", diff.Unified, expected)
+	}
+	if len(diff.Hunks) != 2 {
+		t.Fatalf("got %d hunks, expected %d", len(diff.Hunks), 2)
+	}
+	if h := diff.Hunks[1]; h.FromLine != 13 || h.FromCount != 3 || h.ToLine != 13 || h.ToCount != 4 {
+		t.Errorf("got hunk -%d,%d +%d,%d, expected -13,3 +13,4", h.FromLine, h.FromCount, h.ToLine, h.ToCount)
+	}
+
+	// changes close together share a hunk
+	diff = makeDiff("TestPage", "1", "1\n2\n3\n4\n5\n6\n7\n8\n", "2", "one\n2\n3\n4\n5\n6\n7\neight\n")
+	if len(diff.Hunks) != 1 {
+		t.Errorf("got %d hunks, expected %d", len(diff.Hunks), 1)
+	}
+}
+
+func TestDiffGet(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// create test revisions
+	for _, body := range []string{"Test\nresult\n", "Test\nresult updated\n", "Test\nresult updated again\n"} {
+		p := &Page{Title: "TestPage", Body: body}
+		if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("creating test page returned error %v", err)
+		}
+	}
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	tests := []struct {
+		url      string
+		to       string
+		expected string
+	}{
+		{"/page/TestPage/diff?from=1&to=2", "2", "+result updated"},
+		{"/page/TestPage/diff?from=1", "current", "+result updated again"},
+	}
+	for _, test := range tests {
+		r, dat, err := MakeRequest(router, "GET", test.url, nil, a)
+		if err != nil {
+			t.Fatalf("running request returned error %v", err)
+		}
+
+		// authorization headers
+		CheckAuthHeader("test", "test", r, t)
+
+		if to, _ := dat["to"].(string); to != test.to {
+			t.Errorf("got to %s, expected %s", to, test.to)
+		}
+		hunks, _ := dat["hunks"].([]interface{})
+		if len(hunks) != 1 {
+			t.Fatalf("got %d hunks, expected %d", len(hunks), 1)
+		}
+		lines := hunks[0].(map[string]interface{})["lines"].([]interface{})
+		if line := lines[2].(map[string]interface{}); line["op"].(string)+line["text"].(string) != test.expected {
+			t.Errorf("got line %v, expected %s", line, test.expected)
+		}
+	}
+
+	// missing revision
+	r, _, err := MakeRequest(router, "GET", "/page/TestPage/diff?from=7", nil, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if r.Code != 404 {
+		t.Errorf("got response code = %d, expected %d", r.Code, 404)
+	}
+
+	// versions too long to compare
+	p := &Page{Title: "TestPage", Body: strings.Repeat("line\n", maxDiffLines+1)}
+	if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("saving page returned error %v", err)
+	}
+	if r, _, _ := MakeRequest(router, "GET", "/page/TestPage/diff?from=1", nil, a); r.Code != 422 {
+		t.Errorf("got response code = %d comparing long versions, expected %d", r.Code, 422)
+	}
+}
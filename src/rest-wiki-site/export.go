@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// exportVersion is the version of the archive layout written by Export.
+const exportVersion = 1
+
+// An export archive holds every page, but not the trash, as
+//
+//	pages/<title>/page.json              the page without its body: title,
+//	                                     display title, redirect, tags and
+//	                                     metadata
+//	pages/<title>/body.txt               the body
+//	pages/<title>/revisions/<id>.json    every revision, with its body
+//	pages/<title>/attachments/<name>     every attachment's content
+//	manifest.json                        an ExportManifest, written last
+//
+// Titles and attachment names are escaped with encodeFilename, so that a
+// title's slashes do not nest one page's files inside another's.
+
+var ErrUnknownExportFormat = errors.New("Unknown export format, expected tar or zip")
+
+// ExportManifest describes the contents of an export archive.
+type ExportManifest struct {
+	Version  int             `json:"version"`
+	Exported time.Time       `json:"exported"`
+	Pages    []*ExportedPage `json:"pages"`
+}
+
+// ExportedPage lists the files of one page in an export archive.
+type ExportedPage struct {
+	Title       string        `json:"title"`
+	Path        string        `json:"path"`
+	Revisions   []string      `json:"revisions"`
+	Attachments []*Attachment `json:"attachments"`
+}
+
+// exportPath returns the directory of a page's files in an export archive.
+func exportPath(title string) string {
+	return "pages/" + encodeFilename(title)
+}
+
+// archiveWriter adds files to a tar or zip archive as they are read.
+type archiveWriter interface {
+	WriteFile(name string, modified time.Time, size int64, content io.Reader) error
+	Close() error
+}
+
+type tarArchiveWriter struct {
+	*tar.Writer
+}
+
+func (a tarArchiveWriter) WriteFile(name string, modified time.Time, size int64, content io.Reader) error {
+	if err := a.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: size, ModTime: modified, Typeflag: tar.TypeReg, Format: tar.FormatPAX}); err != nil {
+		return err
+	}
+	_, err := io.Copy(a.Writer, content)
+
+	return err
+}
+
+type zipArchiveWriter struct {
+	*zip.Writer
+}
+
+func (a zipArchiveWriter) WriteFile(name string, modified time.Time, size int64, content io.Reader) error {
+	f, err := a.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, content)
+
+	return err
+}
+
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case "tar":
+		return tarArchiveWriter{tar.NewWriter(w)}, nil
+	case "zip":
+		return zipArchiveWriter{zip.NewWriter(w)}, nil
+	}
+
+	return nil, ErrUnknownExportFormat
+}
+
+func writeJSONFile(archive archiveWriter, name string, modified time.Time, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return archive.WriteFile(name, modified, int64(len(data)), bytes.NewReader(data))
+}
+
+// exportPage writes one page's files to the archive, returning what was
+// written, or nil if the page has gone since it was listed.
+func exportPage(archive archiveWriter, store PageStore, attachments AttachmentStore, title string) (*ExportedPage, error) {
+	p, err := store.Get(title)
+	if err == ErrPageNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	exported := &ExportedPage{Title: title, Path: exportPath(title), Revisions: []string{}, Attachments: []*Attachment{}}
+	modified := p.Modified()
+	body := p.Body
+	p.Body = ""
+	if err := writeJSONFile(archive, exported.Path+"/page.json", modified, p); err != nil {
+		return nil, err
+	}
+	if err := archive.WriteFile(exported.Path+"/body.txt", modified, int64(len(body)), strings.NewReader(body)); err != nil {
+		return nil, err
+	}
+
+	revisions, err := store.Revisions(title)
+	if err != nil && err != ErrPageNotFound {
+		return nil, err
+	}
+	for _, item := range revisions {
+		revision, err := store.Revision(title, item.ID)
+		if err == ErrRevisionNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if err := writeJSONFile(archive, exported.Path+"/revisions/"+encodeFilename(revision.ID)+".json", revision.Timestamp, revision); err != nil {
+			return nil, err
+		}
+		exported.Revisions = append(exported.Revisions, revision.ID)
+	}
+
+	items, err := attachments.List(title)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		a, content, err := attachments.Open(title, item.Name)
+		if err == ErrAttachmentNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		// the size of what was opened, in case it was replaced since
+		size, err := content.Seek(0, io.SeekEnd)
+		if err == nil {
+			_, err = content.Seek(0, io.SeekStart)
+		}
+		if err == nil {
+			err = archive.WriteFile(exported.Path+"/attachments/"+encodeFilename(a.Name), a.Modified, size, content)
+		}
+		content.Close()
+		if err != nil {
+			return nil, err
+		}
+		exported.Attachments = append(exported.Attachments, a)
+	}
+
+	return exported, nil
+}
+
+// Export writes every page in the store to w as a tar or zip archive. The
+// archive is written as the pages are read, so it is never held in memory.
+func Export(w io.Writer, format string, store PageStore, attachments AttachmentStore) error {
+	archive, err := newArchiveWriter(w, format)
+	if err != nil {
+		return err
+	}
+
+	pages, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	manifest := &ExportManifest{Version: exportVersion, Exported: time.Now().UTC(), Pages: []*ExportedPage{}}
+	for _, item := range pages {
+		exported, err := exportPage(archive, store, attachments, item.Title)
+		if err != nil {
+			return err
+		}
+		if exported != nil {
+			manifest.Pages = append(manifest.Pages, exported)
+		}
+	}
+	if err := writeJSONFile(archive, "manifest.json", manifest.Exported, manifest); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// CreateExportHandler streams the whole wiki as an archive in the format
+// given by the format parameter, tar by default. Only the admin user may
+// export the wiki.
+func CreateExportHandler(store PageStore, attachments AttachmentStore, adminuserid string, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization")
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition")
+
+		switch r.Method {
+		case "OPTIONS":
+			return
+		case "GET":
+			if user := authenticatedUser(r); len(user) == 0 || user != adminuserid {
+				ReturnError(w, r, http.StatusForbidden, errors.New("Only the admin user may export the wiki"))
+				return
+			}
+
+			format := r.URL.Query().Get("format")
+			if len(format) == 0 {
+				format = "tar"
+			}
+			contentType := map[string]string{"tar": "application/x-tar", "zip": "application/zip"}[format]
+			if len(contentType) == 0 {
+				ReturnError(w, r, http.StatusBadRequest, ErrUnknownExportFormat)
+				return
+			}
+
+			filename := "wiki-" + time.Now().UTC().Format("20060102-150405") + "." + format
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+
+			// the response has begun, so a failure can only cut the archive
+			// short, which leaves it unreadable rather than incomplete
+			if err := Export(w, format, store, attachments); err != nil {
+				log.Printf("exporting wiki: %v", err)
+				panic(http.ErrAbortHandler)
+			}
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// ReadArchive returns the files of a tar or zip archive in order.
+func ReadArchive(format string, data []byte) ([]string, map[string]string, error) {
+	names := []string{}
+	files := map[string]string{}
+
+	switch format {
+	case "tar":
+		reader := tar.NewReader(bytes.NewReader(data))
+		for {
+			header, err := reader.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, nil, err
+			}
+			content, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return nil, nil, err
+			}
+			names = append(names, header.Name)
+			files[header.Name] = string(content)
+		}
+	case "zip":
+		reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, f := range reader.File {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, nil, err
+			}
+			content, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, nil, err
+			}
+			names = append(names, f.Name)
+			files[f.Name] = string(content)
+		}
+	}
+
+	return names, files, nil
+}
+
+func TestExportGetUnauthenticated(t *testing.T) {
+	handler := CreateExportHandler(NewMemoryPageStore(), NewMemoryAttachmentStore(), "test", "*")
+	if r := MakeUnauthenticatedRequest(handler, "/export", "GET", "/export"); r.Code != 403 {
+		t.Errorf("got response code = %d without a signed-in user, expected %d", r.Code, 403)
+	}
+}
+
+func TestExportGet(t *testing.T) {
+	store := NewMemoryPageStore()
+	attachments := NewMemoryAttachmentStore()
+	router := CreateRouter(store, attachments, "test", 30*60, "test", "test", "*", 1<<20)
+
+	// create test pages, one with two revisions and an attachment, and a
+	// deleted page that is not exported
+	p := &Page{Title: "Team/Backend", Tags: []string{"test"}}
+	for _, body := range []string{"Test result", "Test result updated"} {
+		p.Body = body
+		if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("creating test page returned error %v", err)
+		}
+	}
+	for _, title := range []string{"Team", "Deleted"} {
+		other := &Page{Title: title, Body: "Other result"}
+		if err := other.Save(store, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("creating test page returned error %v", err)
+		}
+	}
+	if err := store.Delete("Deleted"); err != nil {
+		t.Fatalf("deleting test page returned error %v", err)
+	}
+	if err := attachments.Put("Team/Backend", &Attachment{Name: "diagram.png", ContentType: "image/png"}, []byte("PNG")); err != nil {
+		t.Fatalf("storing attachment returned error %v", err)
+	}
+
+	// users other than the admin may not export
+	other := &Authentication{Username: "other", Timestamp: time.Now().Unix()}
+	other.CreateSignature("test")
+	if r, _, _ := MakeRequest(router, "GET", "/export", nil, other); r.Code != 403 {
+		t.Errorf("got response code = %d exporting as other user, expected %d", r.Code, 403)
+	}
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	if r, _, _ := MakeRequest(router, "GET", "/export?format=rar", nil, a); r.Code != 400 {
+		t.Errorf("got response code = %d for unknown format, expected %d", r.Code, 400)
+	}
+
+	for format, contentType := range map[string]string{"tar": "application/x-tar", "zip": "application/zip"} {
+		r, _, _ := MakeRequest(router, "GET", "/export?format="+format, nil, a)
+		if r.Code != 200 {
+			t.Errorf("got response code = %d exporting %s, expected %d", r.Code, format, 200)
+			continue
+		}
+		if r.Header().Get("Content-Type") != contentType {
+			t.Errorf("got content type %s exporting %s, expected %s", r.Header().Get("Content-Type"), format, contentType)
+		}
+
+		names, files, err := ReadArchive(format, r.Body.Bytes())
+		if err != nil {
+			t.Fatalf("reading %s archive returned error %v", format, err)
+		}
+		expected := []string{
+			"pages/Team/page.json",
+			"pages/Team/body.txt",
+			"pages/Team/revisions/1.json",
+			"pages/Team%2FBackend/page.json",
+			"pages/Team%2FBackend/body.txt",
+			"pages/Team%2FBackend/revisions/1.json",
+			"pages/Team%2FBackend/revisions/2.json",
+			"pages/Team%2FBackend/attachments/diagram.png",
+			"manifest.json",
+		}
+		if len(names) != len(expected) {
+			t.Fatalf("got files %v in %s archive, expected %v", names, format, expected)
+		}
+		for i, name := range expected {
+			if names[i] != name {
+				t.Errorf("got file %s in %s archive, expected %s", names[i], format, name)
+			}
+		}
+
+		if files["pages/Team%2FBackend/body.txt"] != "Test result updated" || files["pages/Team%2FBackend/attachments/diagram.png"] != "PNG" {
+			t.Errorf("got files %v in %s archive, expected the body and attachment", files, format)
+		}
+		exported := &Page{}
+		if err := json.Unmarshal([]byte(files["pages/Team%2FBackend/page.json"]), exported); err != nil {
+			t.Fatalf("parsing exported page returned error %v", err)
+		}
+		if exported.Title != "Team/Backend" || len(exported.Body) != 0 || len(exported.Tags) != 1 || exported.Metadata == nil || exported.Metadata.Revisions != 2 {
+			t.Errorf("got exported page %+v, expected its tags and metadata without its body", exported)
+		}
+		revision := &Revision{}
+		if err := json.Unmarshal([]byte(files["pages/Team%2FBackend/revisions/1.json"]), revision); err != nil {
+			t.Fatalf("parsing exported revision returned error %v", err)
+		}
+		if revision.Body != "Test result" || revision.Author != "test" {
+			t.Errorf("got exported revision %+v, expected the first revision", revision)
+		}
+
+		manifest := &ExportManifest{}
+		if err := json.Unmarshal([]byte(files["manifest.json"]), manifest); err != nil {
+			t.Fatalf("parsing manifest returned error %v", err)
+		}
+		if manifest.Version != exportVersion || len(manifest.Pages) != 2 {
+			t.Fatalf("got manifest %+v, expected two pages", manifest)
+		}
+		backend := manifest.Pages[1]
+		if backend.Title != "Team/Backend" || backend.Path != "pages/Team%2FBackend" || len(backend.Revisions) != 2 || len(backend.Attachments) != 1 || backend.Attachments[0].Name != "diagram.png" {
+			t.Errorf("got manifest entry %+v, expected Team/Backend with two revisions and an attachment", backend)
+		}
+	}
+}
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// FilePageStore keeps each page in its own <title>.txt file in Directory,
+// its tags and metadata in <title>.json beside it, and every saved revision of it
+// as <id>.json in .history/<title>/. Deleted pages are moved with their
+// metadata and history into .trash/<title>/.
+//
+// Hierarchical titles map onto subdirectories, so Team/Backend is kept in
+// Team/Backend.txt. In .history and .trash the slashes are escaped instead,
+// so that a page's directory never contains its children's. Every name is
+// escaped with encodeFilename.
+type FilePageStore struct {
+	Directory string
+
+	mu sync.Mutex
+}
+
+// NewFilePageStore creates the data directory if it does not exist yet.
+func NewFilePageStore(directory string) (*FilePageStore, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+
+	return &FilePageStore{Directory: directory}, nil
+}
+
+// maxFilenameLength is the longest file name most filesystems allow.
+const maxFilenameLength = 255
+
+// encodeFilename escapes name for use as a file name. Letters, digits and
+// some punctuation are kept, apart from a leading dot, and every other
+// byte becomes %XX. Titles of plain letters and digits are therefore their
+// own file names, and url.PathUnescape reverses the encoding.
+func encodeFilename(name string) string {
+	var encoded strings.Builder
+	for i, c := range name {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) || unicode.IsMark(c) || (strings.ContainsRune(" !&'()+,-.;=@_~", c) && !(i == 0 && c == '.')) {
+			encoded.WriteRune(c)
+			continue
+		}
+
+		for _, b := range []byte(string(c)) {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	return encoded.String()
+}
+
+// titlePath returns the path of a title's files relative to the data
+// directory, without an extension.
+func titlePath(title string) string {
+	segments := strings.Split(title, "/")
+	for i, segment := range segments {
+		segments[i] = encodeFilename(segment)
+	}
+
+	return filepath.Join(segments...)
+}
+
+// storableTitle reports whether every file name derived from title fits
+// the filesystem.
+func storableTitle(title string) bool {
+	for _, segment := range strings.Split(title, "/") {
+		if len(encodeFilename(segment))+len(".json") > maxFilenameLength {
+			return false
+		}
+	}
+
+	return len(encodeFilename(title)) <= maxFilenameLength
+}
+
+func (s *FilePageStore) Filename(title string) string {
+	return filepath.Join(s.Directory, titlePath(title)+".txt")
+}
+
+func (s *FilePageStore) sidecarFilename(title string) string {
+	return filepath.Join(s.Directory, titlePath(title)+".json")
+}
+
+func (s *FilePageStore) historyDirectory(title string) string {
+	return filepath.Join(s.Directory, ".history", encodeFilename(title))
+}
+
+// readSidecar loads the page without its body, deriving the metadata from
+// the body file for pages written before sidecars were kept.
+func (s *FilePageStore) readSidecar(title string, info os.FileInfo) (*Page, error) {
+	data, err := ioutil.ReadFile(s.sidecarFilename(title))
+	if err != nil && os.IsNotExist(err) {
+		ids, err := s.revisionIDs(title)
+		if err != nil {
+			return nil, err
+		}
+
+		metadata := &PageMetadata{Created: info.ModTime(), Modified: info.ModTime(), Size: int(info.Size()), Revisions: len(ids)}
+		return &Page{Title: title, Metadata: metadata}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	p := &Page{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	p.Title = title
+
+	return p, nil
+}
+
+func (s *FilePageStore) Get(title string) (*Page, error) {
+	if !ValidTitle(title) {
+		return nil, ErrPageNotFound
+	}
+
+	f, err := os.Open(s.Filename(title))
+	if err != nil && os.IsNotExist(err) {
+		return nil, ErrPageNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	p, err := s.readSidecar(title, info)
+	if err != nil {
+		return nil, err
+	}
+	p.Body = string(body)
+
+	return p, nil
+}
+
+func (s *FilePageStore) Put(p *Page, r *Revision) error {
+	if !ValidTitle(p.Title) || !storableTitle(p.Title) {
+		return ErrInvalidTitle
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids, err := s.revisionIDs(p.Title)
+	if err != nil {
+		return err
+	}
+	r.ID = "1"
+	if len(ids) > 0 {
+		r.ID = strconv.Itoa(ids[len(ids)-1] + 1)
+	}
+
+	metadata, data, err := s.sidecar(p, r)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.Filename(p.Title)), 0700); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.Filename(p.Title), []byte(p.Body)); err != nil {
+		return err
+	}
+	if err := s.writeRevision(p.Title, r); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(s.sidecarFilename(p.Title), data); err != nil {
+		return err
+	}
+	p.Metadata = metadata
+
+	return nil
+}
+
+// sidecar returns the metadata of p after it is saved as r, and the
+// sidecar to write for it.
+func (s *FilePageStore) sidecar(p *Page, r *Revision) (*PageMetadata, []byte, error) {
+	var previous *PageMetadata
+	if info, err := os.Stat(s.Filename(p.Title)); err == nil {
+		existing, err := s.readSidecar(p.Title, info)
+		if err != nil {
+			return nil, nil, err
+		}
+		previous = existing.Metadata
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	metadata := updateMetadata(previous, p, r)
+	data, err := sidecarData(p, metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return metadata, data, nil
+}
+
+// sidecarPage returns the sidecar of p with metadata.
+func sidecarPage(p *Page, metadata *PageMetadata) *Page {
+	return &Page{Title: p.Title, DisplayTitle: p.DisplayTitle, Redirect: p.Redirect, Tags: p.Tags, Metadata: metadata}
+}
+
+// sidecarData returns the encoded sidecar of p with metadata.
+func sidecarData(p *Page, metadata *PageMetadata) ([]byte, error) {
+	return json.Marshal(sidecarPage(p, metadata))
+}
+
+func (s *FilePageStore) writeRevision(title string, r *Revision) error {
+	directory := s.historyDirectory(title)
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(directory, r.ID+".json"), data)
+}
+
+func (s *FilePageStore) trashDirectory(title string) string {
+	return filepath.Join(s.Directory, ".trash", encodeFilename(title))
+}
+
+// removeEmptyParents removes the directories of a nested page that no
+// longer hold any pages.
+func (s *FilePageStore) removeEmptyParents(title string) {
+	for parent := ParentTitle(title); len(parent) != 0; parent = ParentTitle(parent) {
+		if err := os.Remove(filepath.Join(s.Directory, titlePath(parent))); err != nil {
+			return
+		}
+	}
+}
+
+func (s *FilePageStore) Delete(title string) error {
+	if !ValidTitle(title) {
+		return ErrPageNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(s.Filename(title)); err != nil && os.IsNotExist(err) {
+		return ErrPageNotFound
+	} else if err != nil {
+		return err
+	}
+
+	// replace any earlier trashed page of the same title
+	trash := s.trashDirectory(title)
+	if err := os.RemoveAll(trash); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(trash, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&TrashedPage{Title: title, Deleted: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(trash, "deleted.json"), data); err != nil {
+		return err
+	}
+	if err := os.Rename(s.historyDirectory(title), filepath.Join(trash, "history")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(s.sidecarFilename(title), filepath.Join(trash, "page.json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Rename(s.Filename(title), filepath.Join(trash, "page.txt")); err != nil {
+		return err
+	}
+	s.removeEmptyParents(title)
+
+	return nil
+}
+
+func (s *FilePageStore) Trash() ([]*TrashedPage, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.Directory, ".trash"))
+	if err != nil && os.IsNotExist(err) {
+		return []*TrashedPage{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	results := []*TrashedPage{}
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(s.Directory, ".trash", file.Name(), "deleted.json"))
+		if err != nil && os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		trashed := &TrashedPage{}
+		if err := json.Unmarshal(data, trashed); err != nil {
+			return nil, err
+		}
+		results = append(results, trashed)
+	}
+	sort.Sort(byDeletion(results))
+
+	return results, nil
+}
+
+func (s *FilePageStore) Restore(title string) error {
+	if !ValidTitle(title) {
+		return ErrPageNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	trash := s.trashDirectory(title)
+	if _, err := os.Stat(filepath.Join(trash, "page.txt")); err != nil && os.IsNotExist(err) {
+		return ErrPageNotFound
+	} else if err != nil {
+		return err
+	}
+	if _, err := os.Stat(s.Filename(title)); err == nil {
+		return ErrPageExists
+	}
+
+	if err := os.RemoveAll(s.historyDirectory(title)); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.historyDirectory(title)), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(trash, "history"), s.historyDirectory(title)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.Filename(title)), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(trash, "page.json"), s.sidecarFilename(title)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(filepath.Join(trash, "page.txt"), s.Filename(title)); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(trash)
+}
+
+func (s *FilePageStore) Purge(title string) error {
+	if !ValidTitle(title) {
+		return ErrPageNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	trash := s.trashDirectory(title)
+	if _, err := os.Stat(trash); err != nil && os.IsNotExist(err) {
+		return ErrPageNotFound
+	} else if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(trash)
+}
+
+func (s *FilePageStore) Move(title string, destination string) error {
+	if !ValidTitle(title) {
+		return ErrPageNotFound
+	}
+	if !ValidTitle(destination) || !storableTitle(destination) {
+		return ErrInvalidTitle
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(s.Filename(title)); err != nil && os.IsNotExist(err) {
+		return ErrPageNotFound
+	} else if err != nil {
+		return err
+	}
+	if _, err := os.Stat(s.Filename(destination)); err == nil {
+		return ErrPageExists
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.Filename(destination)), 0700); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(s.historyDirectory(destination)); err != nil {
+		return err
+	}
+	if err := os.Rename(s.historyDirectory(title), s.historyDirectory(destination)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(s.sidecarFilename(title), s.sidecarFilename(destination)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(s.Filename(title), s.Filename(destination)); err != nil {
+		return err
+	}
+	s.removeEmptyParents(title)
+
+	return nil
+}
+
+// walkPages calls fn with the path relative to the data directory, without
+// its extension, of every page body file.
+func (s *FilePageStore) walkPages(fn func(path string, file os.FileInfo) error) error {
+	return filepath.Walk(s.Directory, func(path string, file os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(file.Name(), ".") && path != s.Directory {
+			if file.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".txt") {
+			return nil
+		}
+
+		relative, err := filepath.Rel(s.Directory, path)
+		if err != nil {
+			return err
+		}
+
+		return fn(strings.TrimSuffix(relative, ".txt"), file)
+	})
+}
+
+// decodeTitle returns the title stored at path, or false if path is not
+// the encoding of a valid title.
+func decodeTitle(path string) (string, bool) {
+	segments := strings.Split(filepath.ToSlash(path), "/")
+	for i, segment := range segments {
+		decoded, err := url.PathUnescape(segment)
+		if err != nil {
+			return "", false
+		}
+		segments[i] = decoded
+	}
+
+	title := strings.Join(segments, "/")
+	if !ValidTitle(title) || titlePath(title) != path {
+		return "", false
+	}
+
+	return title, true
+}
+
+func (s *FilePageStore) List() ([]*Page, error) {
+	results := []*Page{}
+	err := s.walkPages(func(path string, file os.FileInfo) error {
+		title, ok := decodeTitle(path)
+		if !ok {
+			return nil
+		}
+		p, err := s.readSidecar(title, file)
+		if err != nil {
+			return err
+		}
+		results = append(results, p)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byTitle(results))
+
+	return results, nil
+}
+
+// MigrateFilenames renames the files of pages that were stored before
+// titles were encoded, such as names in decomposed Unicode or with
+// characters that are now escaped, taking each file name as the title.
+// Files already named by a valid encoding are left alone, as are those
+// whose new name is taken. It returns the titles of the migrated pages.
+func (s *FilePageStore) MigrateFilenames() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths := []string{}
+	err := s.walkPages(func(path string, file os.FileInfo) error {
+		if _, ok := decodeTitle(path); !ok {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	migrated := []string{}
+	for _, path := range paths {
+		legacy := filepath.ToSlash(path)
+		title := NormalizeTitle(legacy)
+		if !ValidTitle(title) || !storableTitle(title) {
+			continue
+		}
+		if _, err := os.Stat(s.Filename(title)); err == nil {
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(s.Filename(title)), 0700); err != nil {
+			return migrated, err
+		}
+		for _, name := range []string{url.PathEscape(legacy), legacy} {
+			if err := os.Rename(filepath.Join(s.Directory, ".history", name), s.historyDirectory(title)); err == nil {
+				break
+			} else if !os.IsNotExist(err) {
+				return migrated, err
+			}
+		}
+		if err := os.Rename(filepath.Join(s.Directory, path+".json"), s.sidecarFilename(title)); err != nil && !os.IsNotExist(err) {
+			return migrated, err
+		}
+		if err := os.Rename(filepath.Join(s.Directory, path+".txt"), s.Filename(title)); err != nil {
+			return migrated, err
+		}
+		migrated = append(migrated, title)
+	}
+
+	return migrated, nil
+}
+
+// syncFile flushes a written file to disk. Tests replace it to simulate
+// failed writes.
+var syncFile = func(f *os.File) error {
+	return f.Sync()
+}
+
+// writeFileAtomic replaces filename with data so that readers and crashes
+// see either the old or the new content, never a partial write. The data
+// goes to a hidden temporary file in the same directory, which is synced
+// and then renamed into place.
+func writeFileAtomic(filename string, data []byte) error {
+	directory := filepath.Dir(filename)
+
+	f, err := ioutil.TempFile(directory, ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = syncFile(f)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	// make the rename itself durable
+	d, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return syncFile(d)
+}
+
+// revisionIDs returns the ids in the page's history directory in
+// ascending order.
+func (s *FilePageStore) revisionIDs(title string) ([]int, error) {
+	files, err := ioutil.ReadDir(s.historyDirectory(title))
+	if err != nil && os.IsNotExist(err) {
+		return []int{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ids := []int{}
+	for _, file := range files {
+		if id, err := strconv.Atoi(strings.TrimSuffix(file.Name(), ".json")); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	return ids, nil
+}
+
+func (s *FilePageStore) Revisions(title string) ([]*Revision, error) {
+	if !ValidTitle(title) {
+		return nil, ErrPageNotFound
+	}
+
+	ids, err := s.revisionIDs(title)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		if _, err := os.Stat(s.Filename(title)); err != nil && os.IsNotExist(err) {
+			return nil, ErrPageNotFound
+		}
+	}
+
+	results := make([]*Revision, len(ids))
+	for i, id := range ids {
+		r, err := s.Revision(title, strconv.Itoa(id))
+		if err != nil {
+			return nil, err
+		}
+		r.Body = ""
+		results[i] = r
+	}
+
+	return results, nil
+}
+
+func (s *FilePageStore) Revision(title string, id string) (*Revision, error) {
+	if _, err := strconv.Atoi(id); err != nil || !ValidTitle(title) {
+		return nil, ErrRevisionNotFound
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(s.historyDirectory(title), id+".json"))
+	if err != nil && os.IsNotExist(err) {
+		return nil, ErrRevisionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	r := &Revision{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
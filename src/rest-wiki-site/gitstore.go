@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultGitAuthor is recorded on changes that no user is known to have
+// made, such as purges of expired trash.
+const defaultGitAuthor = "rest-wiki-site"
+
+// gitIgnore keeps what else is written to the data directory, such as
+// attachments, out of the repository.
+const gitIgnore = "/.attachments/\n/.history/\n.tmp-*\n"
+
+// GitPageStore keeps pages in the layout of FilePageStore in a git
+// repository, committing every change, so that the history can be read
+// with git itself. Saves are committed as the author of their revision,
+// at its time, and other changes as the author given to ForAuthor.
+//
+// A page's revisions are the commits that saved it, found by following
+// its sidecar back through moves, deletions and restores to the commit
+// that created it. Their IDs count from 1 as in the other stores, and
+// Commit names the commit. The revision count in a page's metadata is
+// kept to the number of those commits. Pages already in the directory
+// when the repository is created are committed as their first revision,
+// without their earlier history.
+//
+// A page's sidecar also maps the IDs of its revisions to their commits, so
+// that a single revision is found without reading the page's history. A
+// save cannot hold its own commit, so until the page is next changed the
+// commit of its latest save is the last one to touch its sidecar.
+type GitPageStore struct {
+	*FilePageStore
+
+	author string
+	git    *gitRepository
+}
+
+// gitRepository runs the git command line tool in a repository. Its lock
+// is held from a change to the working tree until it is committed.
+type gitRepository struct {
+	directory string
+
+	mu sync.Mutex
+}
+
+// gitRevision is a commit that saved a page, with the path of the page's
+// sidecar in it.
+type gitRevision struct {
+	commit string
+	author string
+	revert string
+	path   string
+}
+
+// gitSidecar is the sidecar of a page in a GitPageStore, with the commits
+// of its revisions by ID.
+type gitSidecar struct {
+	*Page
+	Commits map[string]*gitCommit `json:"commits,omitempty"`
+}
+
+// gitCommit is the commit that saved a revision and the title the page
+// had then.
+type gitCommit struct {
+	Commit string `json:"commit"`
+	Title  string `json:"title"`
+}
+
+// NewGitPageStore creates the data directory and the repository in it if
+// they do not exist yet. It needs git to be installed.
+func NewGitPageStore(directory string) (*GitPageStore, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, err
+	}
+
+	files, err := NewFilePageStore(directory)
+	if err != nil {
+		return nil, err
+	}
+	repository := &gitRepository{directory: directory}
+
+	if _, err := os.Stat(filepath.Join(directory, ".git")); err != nil && os.IsNotExist(err) {
+		if _, err := repository.run(nil, "init", "-q"); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(filepath.Join(directory, ".gitignore"), []byte(gitIgnore), 0600); err != nil {
+			return nil, err
+		}
+		if err := startHistory(files); err != nil {
+			return nil, err
+		}
+		if _, err := repository.commit(defaultGitAuthor, time.Now(), "Create wiki"); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &GitPageStore{FilePageStore: files, author: defaultGitAuthor, git: repository}, nil
+}
+
+// startHistory sets the revision count of every page in the directory to
+// 1, since the commit adding them will be their only revision.
+func startHistory(files *FilePageStore) error {
+	return files.walkPages(func(path string, file os.FileInfo) error {
+		title, ok := decodeTitle(path)
+		if !ok {
+			return nil
+		}
+		p, err := files.readSidecar(title, file)
+		if err != nil {
+			return err
+		}
+		p.Metadata.Revisions = 1
+		data, err := sidecarData(p, p.Metadata)
+		if err != nil {
+			return err
+		}
+
+		return writeFileAtomic(files.sidecarFilename(title), data)
+	})
+}
+
+func (g *gitRepository) command(env []string, args ...string) *exec.Cmd {
+	cmd := exec.Command("git", append([]string{"-c", "core.quotePath=false", "-c", "commit.gpgSign=false", "-c", "core.hooksPath=" + os.DevNull}, args...)...)
+	cmd.Dir = g.directory
+	cmd.Env = append(os.Environ(), env...)
+
+	return cmd
+}
+
+func (g *gitRepository) run(env []string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := g.command(env, args...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return string(out), nil
+}
+
+// commit records every change in the working tree as author, returning
+// the commit. If that fails the working tree is put back as it was last
+// committed.
+func (g *gitRepository) commit(author string, when time.Time, message ...string) (string, error) {
+	if len(author) == 0 {
+		author = defaultGitAuthor
+	}
+	if when.IsZero() {
+		when = time.Now()
+	}
+	date := fmt.Sprintf("%d +0000", when.Unix())
+	env := []string{"GIT_AUTHOR_NAME=" + author, "GIT_AUTHOR_EMAIL=", "GIT_AUTHOR_DATE=" + date, "GIT_COMMITTER_NAME=" + author, "GIT_COMMITTER_EMAIL="}
+
+	args := []string{"commit", "-q"}
+	for _, paragraph := range message {
+		args = append(args, "-m", paragraph)
+	}
+	_, err := g.run(nil, "add", "-A")
+	if err == nil {
+		_, err = g.run(env, args...)
+	}
+	if err != nil {
+		g.reset()
+		return "", err
+	}
+
+	commit, err := g.run(nil, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(commit), nil
+}
+
+// reset discards the changes to the working tree since the last commit.
+func (g *gitRepository) reset() {
+	g.run(nil, "reset", "-q", "--hard")
+	g.run(nil, "clean", "-q", "-f", "-d")
+}
+
+// readFiles returns the contents of files given as <commit>:<path>, with
+// nil for those that do not exist.
+func (g *gitRepository) readFiles(files []string) ([][]byte, error) {
+	results := make([][]byte, len(files))
+	if len(files) == 0 {
+		return results, nil
+	}
+
+	cmd := g.command(nil, "cat-file", "--batch")
+	cmd.Stdin = strings.NewReader(strings.Join(files, "\n") + "\n")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git cat-file: %v", err)
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(out))
+	for i := range files {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(header, " missing\n") {
+			continue
+		}
+
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("git cat-file: unexpected output %q", header)
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		results[i] = make([]byte, size)
+		if _, err := io.ReadFull(reader, results[i]); err != nil {
+			return nil, err
+		}
+		if _, err := reader.ReadByte(); err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+// ForAuthor returns the store with its changes other than saves committed
+// as author.
+func (s *GitPageStore) ForAuthor(author string) PageStore {
+	return &GitPageStore{FilePageStore: s.FilePageStore, author: author, git: s.git}
+}
+
+// change makes a change to the working tree with fn and commits it, or
+// puts the working tree back if fn fails.
+func (s *GitPageStore) change(fn func() error, message ...string) error {
+	if err := fn(); err != nil {
+		s.git.reset()
+		return err
+	}
+
+	_, err := s.git.commit(s.author, time.Now(), message...)
+
+	return err
+}
+
+func (s *GitPageStore) Put(p *Page, r *Revision) error {
+	if !ValidTitle(p.Title) || !storableTitle(p.Title) {
+		return ErrInvalidTitle
+	}
+
+	s.git.mu.Lock()
+	defer s.git.mu.Unlock()
+
+	// the sidecar's revision count numbers the save, as it is kept to the
+	// commits history finds without reading them
+	previous, err := s.commits(p.Title)
+	if err != nil {
+		return err
+	}
+	metadata, _, err := s.sidecar(p, r)
+	if err != nil {
+		return err
+	}
+	sidecar := &gitSidecar{Page: sidecarPage(p, metadata), Commits: map[string]*gitCommit{}}
+	if previous != nil {
+		sidecar.Commits = previous.Commits
+	}
+	data, err := json.Marshal(sidecar)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(s.Filename(p.Title)), 0700)
+	if err == nil {
+		err = writeFileAtomic(s.Filename(p.Title), []byte(p.Body))
+	}
+	if err == nil {
+		err = writeFileAtomic(s.sidecarFilename(p.Title), data)
+	}
+	if err != nil {
+		s.git.reset()
+		return err
+	}
+
+	message := []string{"Save " + p.Title}
+	if len(r.Revert) != 0 {
+		message = append(message, "Revert: "+r.Revert)
+	}
+	commit, err := s.git.commit(r.Author, r.Timestamp, message...)
+	if err != nil {
+		return err
+	}
+	r.ID = strconv.Itoa(metadata.Revisions)
+	r.Commit = commit
+	p.Metadata = metadata
+
+	return nil
+}
+
+func (s *GitPageStore) Delete(title string) error {
+	if !ValidTitle(title) {
+		return ErrPageNotFound
+	}
+
+	s.git.mu.Lock()
+	defer s.git.mu.Unlock()
+
+	if _, err := os.Stat(s.Filename(title)); err != nil && os.IsNotExist(err) {
+		return ErrPageNotFound
+	} else if err != nil {
+		return err
+	}
+
+	// an earlier trashed page of the same title is purged in a commit of
+	// its own, so that the deletion is a rename git can follow
+	if _, err := os.Stat(s.trashDirectory(title)); err == nil {
+		if err := s.change(func() error { return s.FilePageStore.Purge(title) }, "Purge "+title); err != nil {
+			return err
+		}
+	}
+
+	return s.change(func() error {
+		if err := s.recordCommits(title); err != nil {
+			return err
+		}
+		return s.FilePageStore.Delete(title)
+	}, "Delete "+title)
+}
+
+func (s *GitPageStore) Restore(title string) error {
+	s.git.mu.Lock()
+	defer s.git.mu.Unlock()
+
+	return s.change(func() error { return s.FilePageStore.Restore(title) }, "Restore "+title)
+}
+
+func (s *GitPageStore) Purge(title string) error {
+	s.git.mu.Lock()
+	defer s.git.mu.Unlock()
+
+	return s.change(func() error { return s.FilePageStore.Purge(title) }, "Purge "+title)
+}
+
+func (s *GitPageStore) Move(title string, destination string) error {
+	s.git.mu.Lock()
+	defer s.git.mu.Unlock()
+
+	return s.change(func() error {
+		if err := s.recordCommits(title); err != nil {
+			return err
+		}
+		return s.FilePageStore.Move(title, destination)
+	}, "Move "+title+" to "+destination)
+}
+
+// commits returns the sidecar of a stored page, or nil if there is none,
+// with the commit of its latest save added to its commits if it was not
+// recorded yet.
+func (s *GitPageStore) commits(title string) (*gitSidecar, error) {
+	if _, err := os.Stat(s.Filename(title)); err != nil && os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(s.sidecarFilename(title))
+	if err != nil && os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	sidecar := &gitSidecar{}
+	if err := json.Unmarshal(data, sidecar); err != nil {
+		return nil, err
+	}
+	if sidecar.Commits == nil {
+		sidecar.Commits = map[string]*gitCommit{}
+	}
+	if sidecar.Page == nil || sidecar.Metadata == nil {
+		return sidecar, nil
+	}
+
+	id := strconv.Itoa(sidecar.Metadata.Revisions)
+	if _, ok := sidecar.Commits[id]; ok {
+		return sidecar, nil
+	}
+	out, err := s.git.run(nil, "log", "-1", "--format=%H%x1f%s", "--", filepath.ToSlash(titlePath(title))+".json")
+	if err != nil {
+		return nil, err
+	}
+	// the sidecar may have been touched since by a change that did not
+	// record the commit, such as a migration of file names, in which case
+	// the history has to be read
+	fields := strings.SplitN(strings.TrimSpace(out), "\x1f", 2)
+	if len(fields) != 2 || (fields[1] != "Save "+title && fields[1] != "Create wiki") {
+		return sidecar, nil
+	}
+	latest := &gitCommit{Commit: fields[0], Title: title}
+	if r, err := s.readRevision(id, latest); err != nil {
+		return nil, err
+	} else if r != nil {
+		sidecar.Commits[id] = latest
+	}
+
+	return sidecar, nil
+}
+
+// recordCommits records the commit of the page's latest save in its
+// sidecar before a change that touches it.
+func (s *GitPageStore) recordCommits(title string) error {
+	sidecar, err := s.commits(title)
+	if err != nil || sidecar == nil {
+		return err
+	}
+	data, err := json.Marshal(sidecar)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.sidecarFilename(title), data)
+}
+
+// readRevision returns the revision id saved by commit, or nil if the page
+// saved there is not that revision.
+func (s *GitPageStore) readRevision(id string, commit *gitCommit) (*Revision, error) {
+	if len(commit.Commit) == 0 {
+		return nil, nil
+	}
+	path := filepath.ToSlash(titlePath(commit.Title))
+	files, err := s.git.readFiles([]string{commit.Commit + ":" + path + ".json", commit.Commit + ":" + path + ".txt"})
+	if err != nil {
+		return nil, err
+	}
+	if files[0] == nil {
+		return nil, nil
+	}
+	sidecar := &Page{}
+	if err := json.Unmarshal(files[0], sidecar); err != nil {
+		return nil, err
+	}
+	if sidecar.Metadata == nil || strconv.Itoa(sidecar.Metadata.Revisions) != id {
+		return nil, nil
+	}
+
+	out, err := s.git.run(nil, "show", "-s", "--format=%an%x1f%(trailers:key=Revert,valueonly)", commit.Commit)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.SplitN(out, "\x1f", 2)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("git show: unexpected output %q", out)
+	}
+
+	return &Revision{ID: id, Author: fields[0], Tags: sidecar.Tags, Revert: strings.TrimSpace(fields[1]), Commit: commit.Commit, Timestamp: sidecar.Metadata.Modified, Body: string(files[1])}, nil
+}
+
+// MigrateFilenames renames the files of pages stored before titles were
+// encoded, as FilePageStore does, and commits the renames.
+func (s *GitPageStore) MigrateFilenames() ([]string, error) {
+	s.git.mu.Lock()
+	defer s.git.mu.Unlock()
+
+	migrated, err := s.FilePageStore.MigrateFilenames()
+	if err != nil {
+		s.git.reset()
+		return nil, err
+	}
+	if len(migrated) == 0 {
+		return migrated, nil
+	}
+	if _, err := s.git.commit(s.author, time.Now(), "Migrate page file names"); err != nil {
+		return nil, err
+	}
+
+	return migrated, nil
+}
+
+// history returns the commits that saved the page, newest first. It reads
+// the page's whole log, so it is only used to list revisions and to find
+// those not recorded in its sidecar.
+func (s *GitPageStore) history(title string) ([]*gitRevision, error) {
+	sidecar := filepath.ToSlash(titlePath(title)) + ".json"
+	out, err := s.git.run(nil, "log", "--follow", "--name-status", "--format=%x1e%H%x1f%an%x1f%(trailers:key=Revert,valueonly)", "--", sidecar)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*gitRevision{}
+	for _, record := range strings.Split(out, "\x1e")[1:] {
+		fields := strings.SplitN(record, "\x1f", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("git log: unexpected output %q", record)
+		}
+
+		revision := &gitRevision{commit: fields[0], author: fields[1]}
+		status := ""
+		for _, line := range strings.Split(fields[2], "\n") {
+			if parts := strings.Split(line, "\t"); len(parts) > 1 {
+				status = parts[0]
+				revision.path = parts[len(parts)-1]
+			} else if line = strings.TrimSpace(line); len(line) != 0 && len(revision.revert) == 0 {
+				revision.revert = line
+			}
+		}
+
+		// saves change or add the sidecar, and the page was created where
+		// it was added; moves, deletions and restores rename it
+		switch {
+		case strings.HasPrefix(status, "M"):
+			results = append(results, revision)
+		case strings.HasPrefix(status, "A"):
+			return append(results, revision), nil
+		case !strings.HasPrefix(status, "R"):
+			return results, nil
+		}
+	}
+
+	return results, nil
+}
+
+// revisions returns the page's revisions oldest first, with their commits
+// newest first.
+func (s *GitPageStore) revisions(title string) ([]*Revision, []*gitRevision, error) {
+	if !ValidTitle(title) {
+		return nil, nil, ErrPageNotFound
+	}
+	if _, err := os.Stat(s.Filename(title)); err != nil && os.IsNotExist(err) {
+		return nil, nil, ErrPageNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	history, err := s.history(title)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := make([]string, len(history))
+	for i, revision := range history {
+		files[i] = revision.commit + ":" + revision.path
+	}
+	sidecars, err := s.git.readFiles(files)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	results := make([]*Revision, len(history))
+	for i, revision := range history {
+		sidecar := &Page{}
+		if sidecars[i] != nil {
+			if err := json.Unmarshal(sidecars[i], sidecar); err != nil {
+				return nil, nil, err
+			}
+		}
+		r := &Revision{ID: strconv.Itoa(len(history) - i), Author: revision.author, Tags: sidecar.Tags, Revert: revision.revert, Commit: revision.commit}
+		if sidecar.Metadata != nil {
+			r.Timestamp = sidecar.Metadata.Modified
+		}
+		results[len(history)-1-i] = r
+	}
+
+	return results, history, nil
+}
+
+func (s *GitPageStore) Revisions(title string) ([]*Revision, error) {
+	results, _, err := s.revisions(title)
+
+	return results, err
+}
+
+// Revision returns a revision by its ID or its commit, from the commits
+// recorded in the page's sidecar, or else from its history.
+func (s *GitPageStore) Revision(title string, id string) (*Revision, error) {
+	if !ValidTitle(title) {
+		return nil, ErrRevisionNotFound
+	}
+
+	s.git.mu.Lock()
+	sidecar, err := s.commits(title)
+	s.git.mu.Unlock()
+	if err != nil {
+		return nil, err
+	} else if sidecar == nil {
+		return nil, ErrRevisionNotFound
+	}
+	for recorded, commit := range sidecar.Commits {
+		if recorded != id && commit.Commit != id {
+			continue
+		}
+		if r, err := s.readRevision(recorded, commit); err != nil || r != nil {
+			return r, err
+		}
+	}
+	if sidecar.Metadata != nil && len(sidecar.Commits) == sidecar.Metadata.Revisions {
+		return nil, ErrRevisionNotFound
+	}
+
+	results, history, err := s.revisions(title)
+	if err == ErrPageNotFound {
+		return nil, ErrRevisionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	for i, r := range results {
+		if r.ID != id && r.Commit != id {
+			continue
+		}
+
+		revision := history[len(history)-1-i]
+		bodies, err := s.git.readFiles([]string{revision.commit + ":" + strings.TrimSuffix(revision.path, ".json") + ".txt"})
+		if err != nil {
+			return nil, err
+		}
+		r.Body = string(bodies[0])
+
+		return r, nil
+	}
+
+	return nil, ErrRevisionNotFound
+}
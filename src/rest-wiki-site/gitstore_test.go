@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// OpenGitPageStore opens a git store in a new directory, skipping the test
+// if git is not installed.
+func OpenGitPageStore(t *testing.T) (*GitPageStore, func()) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	directory, err := ioutil.TempDir("", "rest-wiki-site")
+	if err != nil {
+		t.Fatalf("creating data directory returned error %v", err)
+	}
+	store, err := NewGitPageStore(filepath.Join(directory, "data"))
+	if err != nil {
+		os.RemoveAll(directory)
+		t.Fatalf("opening git store returned error %v", err)
+	}
+
+	return store, func() { os.RemoveAll(directory) }
+}
+
+func TestGitPageStore(t *testing.T) {
+	store, cleanup := OpenGitPageStore(t)
+	defer cleanup()
+
+	CheckPageStore(store, t)
+
+	// the working tree is left committed
+	if status, err := store.git.run(nil, "status", "--porcelain"); err != nil || len(status) != 0 {
+		t.Errorf("got status %q, %v, expected a clean working tree", status, err)
+	}
+}
+
+func TestGitPageStoreCommits(t *testing.T) {
+	store, cleanup := OpenGitPageStore(t)
+	defer cleanup()
+
+	p := &Page{Title: "Team/Backend", Body: "Test result"}
+	if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("saving page returned error %v", err)
+	}
+	p.Body = "Test result updated"
+	r := &Revision{Author: "other"}
+	if err := p.Save(store, r); err != nil {
+		t.Fatalf("saving page returned error %v", err)
+	}
+	if r.ID != "2" || len(r.Commit) != 40 {
+		t.Errorf("got revision %q with commit %q, expected revision 2 with its commit", r.ID, r.Commit)
+	}
+
+	// moves, deletions and restores are committed as the signed-in user
+	// and keep the page's revisions
+	authored := store.ForAuthor("other")
+	if err := authored.Move("Team/Backend", "Backend"); err != nil {
+		t.Fatalf("moving page returned error %v", err)
+	}
+	if err := authored.Delete("Backend"); err != nil {
+		t.Fatalf("deleting page returned error %v", err)
+	}
+	if err := authored.Restore("Backend"); err != nil {
+		t.Fatalf("restoring page returned error %v", err)
+	}
+
+	log, err := store.git.run(nil, "log", "--format=%an %s")
+	if err != nil {
+		t.Fatalf("reading log returned error %v", err)
+	}
+	expected := "other Restore Backend\nother Delete Backend\nother Move Team/Backend to Backend\nother Save Team/Backend\ntest Save Team/Backend\nrest-wiki-site Create wiki\n"
+	if log != expected {
+		t.Errorf("got log %q, expected %q", log, expected)
+	}
+
+	revisions, err := store.Revisions("Backend")
+	if err != nil || len(revisions) != 2 {
+		t.Fatalf("got revisions %v, %v, expected 2", revisions, err)
+	}
+	if revisions[0].ID != "1" || revisions[0].Author != "test" || revisions[1].Commit != r.Commit {
+		t.Errorf("got revisions %+v, %+v, expected the saves in order", revisions[0], revisions[1])
+	}
+
+	// revisions can be named by their commits, and come from them
+	for _, id := range []string{"1", revisions[0].Commit} {
+		revision, err := store.Revision("Backend", id)
+		if err != nil || revision.Body != "Test result" {
+			t.Errorf("got %+v, %v loading revision %s, expected the first body", revision, err, id)
+		}
+	}
+	// the commits of the saves are recorded in the sidecar as the page
+	// is changed, so that revisions are found without its history
+	data, err := ioutil.ReadFile(store.sidecarFilename("Backend"))
+	if err != nil {
+		t.Fatalf("reading sidecar returned error %v", err)
+	}
+	sidecar := &gitSidecar{}
+	if err := json.Unmarshal(data, sidecar); err != nil {
+		t.Fatalf("decoding sidecar returned error %v", err)
+	}
+	if len(sidecar.Commits) != 2 || sidecar.Commits["1"].Commit != revisions[0].Commit || sidecar.Commits["2"].Commit != r.Commit || sidecar.Commits["2"].Title != "Team/Backend" {
+		t.Errorf("got sidecar commits %v, expected both saves", sidecar.Commits)
+	}
+	for _, id := range []string{"2", r.Commit} {
+		revision, err := store.Revision("Backend", id)
+		if err != nil || revision.Body != "Test result updated" || revision.Author != "other" || revision.Commit != r.Commit || !revision.Timestamp.Equal(revisions[1].Timestamp) {
+			t.Errorf("got %+v, %v loading revision %s, expected the second save", revision, err, id)
+		}
+	}
+	body, err := store.git.run(nil, "show", r.Commit+":"+filepath.ToSlash(titlePath("Team/Backend"))+".txt")
+	if err != nil || body != "Test result updated" {
+		t.Errorf("got %q, %v reading body from commit, expected %q", body, err, "Test result updated")
+	}
+
+	// reverts are recorded in their commits
+	revert := &Revision{Author: "test", Revert: "1"}
+	p = &Page{Title: "Backend", Body: "Test result"}
+	if err := p.Save(store, revert); err != nil {
+		t.Fatalf("saving page returned error %v", err)
+	}
+	if revert.ID != "3" || p.Metadata.Revisions != 3 {
+		t.Errorf("got revision %q and %d revisions saving revert, expected revision 3 of 3", revert.ID, p.Metadata.Revisions)
+	}
+	if message, _ := store.git.run(nil, "log", "-1", "--format=%B"); !strings.Contains(message, "Revert: 1") {
+		t.Errorf("got message %q, expected a revert trailer", message)
+	}
+	if revision, err := store.Revision("Backend", "3"); err != nil || revision.Revert != "1" {
+		t.Errorf("got %+v, %v loading revert, expected it to revert 1", revision, err)
+	}
+
+	// a page created again after a purge starts its revisions afresh
+	if err := authored.Delete("Backend"); err != nil {
+		t.Fatalf("deleting page returned error %v", err)
+	}
+	if err := authored.Purge("Backend"); err != nil {
+		t.Fatalf("purging page returned error %v", err)
+	}
+	r = &Revision{Author: "test"}
+	if err := p.Save(store, r); err != nil {
+		t.Fatalf("saving page returned error %v", err)
+	}
+	if revisions, err := store.Revisions("Backend"); err != nil || len(revisions) != 1 || r.ID != "1" || revisions[0].Commit != r.Commit {
+		t.Errorf("got revision %q and revisions %v, %v after purge, expected only the new save", r.ID, revisions, err)
+	}
+}
+
+func TestGitPageStoreExisting(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	directory, err := ioutil.TempDir("", "rest-wiki-site")
+	if err != nil {
+		t.Fatalf("creating data directory returned error %v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	// pages in the directory before the repository are committed with it
+	files, err := NewFilePageStore(directory)
+	if err != nil {
+		t.Fatalf("opening file store returned error %v", err)
+	}
+	p := &Page{Title: "TestPage", Body: "Test result"}
+	for i := 0; i < 3; i++ {
+		if err := p.Save(files, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("saving page returned error %v", err)
+		}
+	}
+
+	store, err := NewGitPageStore(directory)
+	if err != nil {
+		t.Fatalf("opening git store returned error %v", err)
+	}
+	if revisions, err := store.Revisions("TestPage"); err != nil || len(revisions) != 1 || revisions[0].Author != defaultGitAuthor {
+		t.Errorf("got revisions %v, %v, expected the initial commit", revisions, err)
+	}
+	if files, err := store.git.run(nil, "ls-files"); err != nil || files != ".gitignore\nTestPage.json\nTestPage.txt\n" {
+		t.Errorf("got files %q, %v, expected the page without its history", files, err)
+	}
+
+	if p, err := store.Get("TestPage"); err != nil || p.Metadata.Revisions != 1 {
+		t.Errorf("got %+v, %v loading page, expected its earlier revisions not counted", p, err)
+	}
+
+	// opening the repository again does not commit
+	if _, err := NewGitPageStore(directory); err != nil {
+		t.Fatalf("reopening git store returned error %v", err)
+	}
+	if count, err := store.git.run(nil, "rev-list", "--count", "HEAD"); err != nil || count != "1\n" {
+		t.Errorf("got %q, %v commits, expected 1", count, err)
+	}
+
+	// saves are numbered after the initial commit, and can be loaded by the
+	// IDs they were given
+	r := &Revision{Author: "test"}
+	p.Body = "Test result updated"
+	if err := p.Save(store, r); err != nil {
+		t.Fatalf("saving page returned error %v", err)
+	}
+	if r.ID != "2" || p.Metadata.Revisions != 2 {
+		t.Errorf("got revision %s and %d revisions, expected revision 2", r.ID, p.Metadata.Revisions)
+	}
+	if revisions, err := store.Revisions("TestPage"); err != nil || len(revisions) != 2 || revisions[1].ID != r.ID {
+		t.Errorf("got revisions %v, %v, expected the initial commit and the save", revisions, err)
+	}
+	if revision, err := store.Revision("TestPage", r.ID); err != nil || revision.Body != "Test result updated" {
+		t.Errorf("got %+v, %v loading revision %s, expected the save", revision, err, r.ID)
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrNoManifest = errors.New("Archive has no manifest.json")
+var ErrUnknownConflictPolicy = errors.New("Unknown conflict policy, expected skip, overwrite or rename")
+var ErrArchiveTooLarge = errors.New("Archive expands to more than the import limit")
+
+// Conflict policies decide what happens to an imported page whose title
+// is already taken.
+const (
+	ConflictSkip      = "skip"
+	ConflictOverwrite = "overwrite"
+	ConflictRename    = "rename"
+)
+
+// maxRenames limits the titles tried for a page imported with
+// ConflictRename.
+const maxRenames = 100
+
+// Limits on imported archives: the request body, each file in it once
+// decompressed, and all of its files together. Tests lower them.
+var (
+	maxImportSize      int64 = 256 << 20
+	maxImportEntrySize int64 = 64 << 20
+	maxImportTotalSize int64 = 1 << 30
+)
+
+type ImportOptions struct {
+	DryRun   bool
+	Conflict string
+	// Author is recorded on the revisions of overwritten pages and of
+	// pages imported without history.
+	Author string
+}
+
+// ImportResult is one imported page. Source is where the page was read
+// from, and RenamedFrom the title it was given there if it had to be
+// renamed.
+type ImportResult struct {
+	Title       string `json:"title"`
+	Source      string `json:"source"`
+	RenamedFrom string `json:"renamedFrom,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+type ImportReport struct {
+	DryRun  bool            `json:"dryRun"`
+	Created []*ImportResult `json:"created"`
+	Updated []*ImportResult `json:"updated"`
+	Skipped []*ImportResult `json:"skipped"`
+}
+
+// importedPage is a page read from an archive or directory.
+type importedPage struct {
+	source      string
+	page        *Page
+	revisions   []*Revision
+	attachments []*upload
+}
+
+type byImportedTitle []*importedPage
+
+func (a byImportedTitle) Len() int           { return len(a) }
+func (a byImportedTitle) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byImportedTitle) Less(i, j int) bool { return a[i].page.Title < a[j].page.Title }
+
+// ParseImportOptions reads the dryrun and conflict parameters of a query.
+// Pages whose title is taken are skipped unless a policy is given.
+func ParseImportOptions(query url.Values) (*ImportOptions, error) {
+	options := &ImportOptions{Conflict: ConflictSkip}
+
+	if dryrun := query.Get("dryrun"); len(dryrun) != 0 {
+		value, err := strconv.ParseBool(dryrun)
+		if err != nil {
+			return nil, errors.New("Invalid dryrun parameter")
+		}
+		options.DryRun = value
+	}
+	if conflict := query.Get("conflict"); len(conflict) != 0 {
+		options.Conflict = conflict
+	}
+	if !validConflictPolicy(options.Conflict) {
+		return nil, ErrUnknownConflictPolicy
+	}
+
+	return options, nil
+}
+
+func validConflictPolicy(conflict string) bool {
+	return conflict == ConflictSkip || conflict == ConflictOverwrite || conflict == ConflictRename
+}
+
+// readArchiveEntry reads a file of an archive, adding its size to total,
+// and returns ErrArchiveTooLarge once the file or the total is over its
+// limit.
+func readArchiveEntry(r io.Reader, total *int64) ([]byte, error) {
+	limit := maxImportEntrySize
+	if remaining := maxImportTotalSize - *total; remaining < limit {
+		limit = remaining
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > limit {
+		return nil, ErrArchiveTooLarge
+	}
+	*total += int64(len(content))
+
+	return content, nil
+}
+
+// readArchiveFiles returns the files of a tar or zip archive by name,
+// within the import limits.
+func readArchiveFiles(data []byte) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	total := int64(0)
+
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) || bytes.HasPrefix(data, []byte("PK\x05\x06")) {
+		reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range reader.File {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			content, err := readArchiveEntry(rc, &total)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			files[f.Name] = content
+		}
+
+		return files, nil
+	}
+
+	reader := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := readArchiveEntry(reader, &total)
+		if err != nil {
+			return nil, err
+		}
+		files[header.Name] = content
+	}
+
+	return files, nil
+}
+
+// readArchive returns the pages of an archive written by Export, in the
+// order of its manifest.
+func readArchive(data []byte) ([]*importedPage, error) {
+	files, err := readArchiveFiles(data)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestData, ok := files["manifest.json"]
+	if !ok {
+		return nil, ErrNoManifest
+	}
+	manifest := &ExportManifest{}
+	if err := json.Unmarshal(manifestData, manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Version > exportVersion {
+		return nil, fmt.Errorf("Unsupported archive version %d", manifest.Version)
+	}
+
+	results := []*importedPage{}
+	for _, exported := range manifest.Pages {
+		imported := &importedPage{source: exported.Path, page: &Page{}}
+		if data, ok := files[exported.Path+"/page.json"]; ok {
+			if err := json.Unmarshal(data, imported.page); err != nil {
+				return nil, fmt.Errorf("Invalid %s/page.json: %v", exported.Path, err)
+			}
+		}
+		imported.page = &Page{Title: exported.Title, DisplayTitle: imported.page.DisplayTitle, Redirect: imported.page.Redirect, Body: string(files[exported.Path+"/body.txt"]), Tags: imported.page.Tags}
+
+		for _, id := range exported.Revisions {
+			data, ok := files[exported.Path+"/revisions/"+encodeFilename(id)+".json"]
+			if !ok {
+				continue
+			}
+			revision := &Revision{}
+			if err := json.Unmarshal(data, revision); err != nil {
+				return nil, fmt.Errorf("Invalid revision %s of %s: %v", id, exported.Path, err)
+			}
+			imported.revisions = append(imported.revisions, revision)
+		}
+
+		for _, a := range exported.Attachments {
+			data, ok := files[exported.Path+"/attachments/"+encodeFilename(a.Name)]
+			if !ok {
+				continue
+			}
+			imported.attachments = append(imported.attachments, &upload{attachment: &Attachment{Name: a.Name, ContentType: a.ContentType, Author: a.Author}, data: data})
+		}
+
+		results = append(results, imported)
+	}
+
+	return results, nil
+}
+
+// readDirectory returns a page for every .txt and .md file below
+// directory, titled by its path without the extension, so that
+// Team/Backend.md becomes Team/Backend, sorted by title. Hidden files are
+// left out.
+func readDirectory(directory string) ([]*importedPage, error) {
+	results := []*importedPage{}
+	err := filepath.Walk(directory, func(path string, file os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(file.Name(), ".") && path != directory {
+			if file.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		extension := filepath.Ext(file.Name())
+		if file.IsDir() || (extension != ".txt" && extension != ".md") {
+			return nil
+		}
+
+		relative, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		title := filepath.ToSlash(strings.TrimSuffix(relative, extension))
+		results = append(results, &importedPage{source: filepath.ToSlash(relative), page: &Page{Title: title, Body: string(data)}})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byImportedTitle(results))
+
+	return results, nil
+}
+
+// Import adds pages to the store, with their revisions and attachments,
+// and reports what was done with each. New pages keep their revisions;
+// overwritten pages get their imported content as a new revision. In a
+// dry run nothing is stored.
+func Import(store PageStore, attachments AttachmentStore, pages []*importedPage, options *ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{DryRun: options.DryRun, Created: []*ImportResult{}, Updated: []*ImportResult{}, Skipped: []*ImportResult{}}
+	// titles created by this import, which a dry run does not store
+	created := map[string]bool{}
+	exists := func(title string) bool {
+		p := &Page{Title: title}
+		return created[title] || p.Exists(store)
+	}
+
+	for _, imported := range pages {
+		p := imported.page
+		result := &ImportResult{Title: NormalizeTitle(p.Title), Source: imported.source}
+		err := p.validate()
+		for _, u := range imported.attachments {
+			if err == nil && !ValidAttachmentName(u.attachment.Name) {
+				err = ErrInvalidAttachmentName
+			}
+		}
+		if err != nil {
+			result.Reason = err.Error()
+			report.Skipped = append(report.Skipped, result)
+			continue
+		}
+
+		update := false
+		if exists(p.Title) {
+			switch options.Conflict {
+			case ConflictSkip:
+				result.Reason = ErrPageExists.Error()
+				report.Skipped = append(report.Skipped, result)
+				continue
+			case ConflictOverwrite:
+				update = true
+			case ConflictRename:
+				title := ""
+				for i := 2; i <= maxRenames && len(title) == 0; i++ {
+					candidate := fmt.Sprintf("%s (%d)", p.Title, i)
+					if ValidTitle(candidate) && !exists(candidate) {
+						title = candidate
+					}
+				}
+				if len(title) == 0 {
+					result.Reason = ErrPageExists.Error()
+					report.Skipped = append(report.Skipped, result)
+					continue
+				}
+				result.RenamedFrom = p.Title
+				result.Title = title
+				p.Title = title
+			}
+		}
+
+		if !options.DryRun {
+			if err := importPage(store, attachments, imported, update, options.Author); err == ErrInvalidTitle {
+				result.Reason = err.Error()
+				report.Skipped = append(report.Skipped, result)
+				continue
+			} else if err != nil {
+				return report, err
+			}
+		}
+
+		if update {
+			report.Updated = append(report.Updated, result)
+		} else {
+			created[p.Title] = true
+			report.Created = append(report.Created, result)
+		}
+	}
+
+	return report, nil
+}
+
+// importPage stores one imported page. A new page is stored revision by
+// revision, keeping their authors and times, and then once more if its
+// imported content differs from its last revision.
+func importPage(store PageStore, attachments AttachmentStore, imported *importedPage, update bool, author string) error {
+	p := imported.page
+
+	if !update {
+		for _, revision := range imported.revisions {
+			stored := &Page{Title: p.Title, DisplayTitle: p.DisplayTitle, Redirect: p.Redirect, Body: revision.Body, Tags: normalizeTags(revision.Tags)}
+			r := &Revision{Author: revision.Author, Timestamp: revision.Timestamp, Body: stored.Body, Tags: stored.Tags, Revert: revision.Revert}
+			if err := store.Put(stored, r); err != nil {
+				return err
+			}
+		}
+	}
+
+	if n := len(imported.revisions); update || n == 0 || imported.revisions[n-1].Body != p.Body || strings.Join(normalizeTags(imported.revisions[n-1].Tags), "\n") != strings.Join(p.Tags, "\n") {
+		if err := p.Save(store, &Revision{Author: author}); err != nil {
+			return err
+		}
+	}
+
+	for _, u := range imported.attachments {
+		if err := attachments.Put(p.Title, u.attachment, u.data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CreateImportHandler imports an archive written by the export handler.
+// Only the admin user may import pages. Archives that expand past the
+// import limits are rejected with 413 Request Entity Too Large.
+func CreateImportHandler(store PageStore, attachments AttachmentStore, adminuserid string, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, POST")
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization")
+
+		switch r.Method {
+		case "OPTIONS":
+			return
+		case "POST":
+			user := authenticatedUser(r)
+			if len(user) == 0 || user != adminuserid {
+				ReturnError(w, r, http.StatusForbidden, errors.New("Only the admin user may import pages"))
+				return
+			}
+
+			options, err := ParseImportOptions(r.URL.Query())
+			if err != nil {
+				ReturnError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			options.Author = user
+
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			pages, err := readArchive(body)
+			if err == ErrArchiveTooLarge {
+				ReturnError(w, r, http.StatusRequestEntityTooLarge, err)
+				return
+			} else if err != nil {
+				ReturnError(w, r, http.StatusBadRequest, err)
+				return
+			}
+
+			report, err := Import(store, attachments, pages, options)
+			if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			jsonResponse, _ := json.Marshal(report)
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			w.Write(jsonResponse)
+		}
+	}
+}
+
+// RunImportCommand imports the directory or archive named in args into the
+// stores and writes the report to stdout, for
+//
+//	rest-wiki-site [flags] import [-dryrun] [-conflict policy] [-author name] <directory or archive>
+func RunImportCommand(args []string, store PageStore, attachments AttachmentStore, stdout io.Writer) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryrun := flags.Bool("dryrun", false, "report what would be imported without storing it")
+	conflict := flags.String("conflict", ConflictSkip, "what to do with pages that exist: skip, overwrite or rename")
+	author := flags.String("author", "import", "author of the imported revisions")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("expected one directory or archive to import")
+	}
+	if !validConflictPolicy(*conflict) {
+		return ErrUnknownConflictPolicy
+	}
+
+	source := flags.Arg(0)
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+
+	var pages []*importedPage
+	if info.IsDir() {
+		pages, err = readDirectory(source)
+	} else {
+		var data []byte
+		if data, err = ioutil.ReadFile(source); err == nil {
+			pages, err = readArchive(data)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	report, err := Import(store, attachments, pages, &ImportOptions{DryRun: *dryrun, Conflict: *conflict, Author: *author})
+	if report != nil {
+		jsonReport, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Fprintln(stdout, string(jsonReport))
+	}
+
+	return err
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ImportTitles returns the titles of a report's results, joined by commas.
+func ImportTitles(results []interface{}) string {
+	titles := []string{}
+	for _, result := range results {
+		titles = append(titles, result.(map[string]interface{})["title"].(string))
+	}
+
+	return strings.Join(titles, ",")
+}
+
+func TestImportPost(t *testing.T) {
+	// export test pages, one with two revisions and an attachment
+	exported := NewMemoryPageStore()
+	exportedAttachments := NewMemoryAttachmentStore()
+	p := &Page{Title: "Team/Backend", DisplayTitle: "Backend team", Tags: []string{"test"}}
+	for _, body := range []string{"Test result", "Test result updated"} {
+		p.Body = body
+		if err := p.Save(exported, &Revision{Author: "other"}); err != nil {
+			t.Fatalf("creating test page returned error %v", err)
+		}
+	}
+	other := &Page{Title: "TestPage", Body: "Other result"}
+	if err := other.Save(exported, &Revision{Author: "other"}); err != nil {
+		t.Fatalf("creating test page returned error %v", err)
+	}
+	if err := exportedAttachments.Put("Team/Backend", &Attachment{Name: "diagram.png", ContentType: "image/png"}, []byte("PNG")); err != nil {
+		t.Fatalf("storing attachment returned error %v", err)
+	}
+	archives := map[string][]byte{}
+	for _, format := range []string{"tar", "zip"} {
+		var archive bytes.Buffer
+		if err := Export(&archive, format, exported, exportedAttachments); err != nil {
+			t.Fatalf("exporting %s returned error %v", format, err)
+		}
+		archives[format] = archive.Bytes()
+	}
+
+	for _, test := range []struct {
+		format   string
+		query    string
+		created  string
+		updated  string
+		skipped  string
+		testPage string
+	}{
+		{"tar", "", "Team/Backend", "", "TestPage", "Test result"},
+		{"zip", "?conflict=skip", "Team/Backend", "", "TestPage", "Test result"},
+		{"tar", "?conflict=overwrite", "Team/Backend", "TestPage", "", "Other result"},
+		{"zip", "?conflict=rename", "Team/Backend,TestPage (2)", "", "", "Test result"},
+		{"tar", "?conflict=overwrite&dryrun=true", "Team/Backend", "TestPage", "", "Test result"},
+	} {
+		store := NewMemoryPageStore()
+		attachments := NewMemoryAttachmentStore()
+		existing := &Page{Title: "TestPage", Body: "Test result"}
+		if err := existing.Save(store, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("creating test page returned error %v", err)
+		}
+		router := CreateRouter(store, attachments, "test", 30*60, "test", "test", "*", 1<<20)
+
+		// get authorization
+		a, err := GetAuthorization(router)
+		if err != nil {
+			t.Fatalf("retrieving authorization returned error %v", err)
+		}
+
+		r, dat, err := MakeRequest(router, "POST", "/import"+test.query, archives[test.format], a)
+		if err != nil {
+			t.Fatalf("running request returned error %v", err)
+		}
+		if r.Code != 200 {
+			t.Fatalf("got response code = %d importing %s%s, expected %d", r.Code, test.format, test.query, 200)
+		}
+		for key, expected := range map[string]string{"created": test.created, "updated": test.updated, "skipped": test.skipped} {
+			results, _ := dat[key].([]interface{})
+			if titles := ImportTitles(results); titles != expected {
+				t.Errorf("got %s pages %q importing %s%s, expected %q", key, titles, test.format, test.query, expected)
+			}
+		}
+
+		if p, err := store.Get("TestPage"); err != nil || p.Body != test.testPage {
+			t.Errorf("got %v, %v loading existing page after importing %s%s, expected body %q", p, err, test.format, test.query, test.testPage)
+		}
+		if dryrun, _ := dat["dryRun"].(bool); dryrun {
+			if _, err := store.Get("Team/Backend"); err != ErrPageNotFound {
+				t.Errorf("got error %v loading page after dry run, expected %v", err, ErrPageNotFound)
+			}
+			continue
+		}
+
+		// new pages keep their history and attachments
+		p, err := store.Get("Team/Backend")
+		if err != nil {
+			t.Fatalf("loading imported page returned error %v", err)
+		}
+		if p.Body != "Test result updated" || p.DisplayTitle != "Backend team" || len(p.Tags) != 1 {
+			t.Errorf("got imported page %+v, expected its body, display title and tags", p)
+		}
+		revisions, err := store.Revisions("Team/Backend")
+		if err != nil || len(revisions) != 2 || revisions[0].Author != "other" {
+			t.Errorf("got revisions %v, %v, expected the two imported revisions", revisions, err)
+		}
+		if items, err := attachments.List("Team/Backend"); err != nil || len(items) != 1 {
+			t.Errorf("got attachments %v, %v, expected the imported attachment", items, err)
+		}
+	}
+}
+
+func TestImportPostUnauthenticated(t *testing.T) {
+	handler := CreateImportHandler(NewMemoryPageStore(), NewMemoryAttachmentStore(), "test", "*")
+	if r := MakeUnauthenticatedRequest(handler, "/import", "POST", "/import"); r.Code != 403 {
+		t.Errorf("got response code = %d without a signed-in user, expected %d", r.Code, 403)
+	}
+}
+
+func TestImportPostInvalid(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// an archive with a title the router cannot serve
+	var archive bytes.Buffer
+	writer := tar.NewWriter(&archive)
+	manifest, _ := json.Marshal(&ExportManifest{Version: exportVersion, Pages: []*ExportedPage{{Title: "Team/revisions", Path: "pages/Team%2Frevisions"}, {Title: "Valid", Path: "pages/Valid"}}})
+	for name, content := range map[string][]byte{"pages/Team%2Frevisions/body.txt": []byte("x"), "pages/Valid/body.txt": []byte("x"), "manifest.json": manifest} {
+		writer.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		writer.Write(content)
+	}
+	writer.Close()
+
+	// users other than the admin may not import
+	other := &Authentication{Username: "other", Timestamp: time.Now().Unix()}
+	other.CreateSignature("test")
+	if r, _, _ := MakeRequest(router, "POST", "/import", archive.Bytes(), other); r.Code != 403 {
+		t.Errorf("got response code = %d importing as other user, expected %d", r.Code, 403)
+	}
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	for url, body := range map[string][]byte{
+		"/import?conflict=merge": archive.Bytes(),
+		"/import?dryrun=maybe":   archive.Bytes(),
+		"/import":                []byte("not an archive"),
+	} {
+		if r, _, _ := MakeRequest(router, "POST", url, body, a); r.Code != 400 {
+			t.Errorf("got response code = %d posting to %s, expected %d", r.Code, url, 400)
+		}
+	}
+
+	r, dat, _ := MakeRequest(router, "POST", "/import", archive.Bytes(), a)
+	if r.Code != 200 {
+		t.Fatalf("got response code = %d importing, expected %d", r.Code, 200)
+	}
+	created, _ := dat["created"].([]interface{})
+	skipped, _ := dat["skipped"].([]interface{})
+	if ImportTitles(created) != "Valid" || ImportTitles(skipped) != "Team/revisions" {
+		t.Errorf("got report %v, expected the invalid title skipped", dat)
+	}
+	if reason := skipped[0].(map[string]interface{})["reason"]; reason != ErrInvalidTitle.Error() {
+		t.Errorf("got reason %v, expected %v", reason, ErrInvalidTitle.Error())
+	}
+}
+
+func TestImportPostTooLarge(t *testing.T) {
+	defer func(size, entry, total int64) {
+		maxImportSize, maxImportEntrySize, maxImportTotalSize = size, entry, total
+	}(maxImportSize, maxImportEntrySize, maxImportTotalSize)
+	maxImportSize, maxImportEntrySize, maxImportTotalSize = 16<<10, 4<<10, 10<<10
+
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	// zip archives of pages whose bodies are zeros, which compress to far
+	// less than they expand to
+	archive := func(sizes ...int) []byte {
+		var buffer bytes.Buffer
+		writer := zip.NewWriter(&buffer)
+		manifest := &ExportManifest{Version: exportVersion}
+		for i, size := range sizes {
+			path := "pages/Page" + strconv.Itoa(i)
+			manifest.Pages = append(manifest.Pages, &ExportedPage{Title: "Page" + strconv.Itoa(i), Path: path})
+			f, _ := writer.CreateHeader(&zip.FileHeader{Name: path + "/body.txt", Method: zip.Deflate})
+			f.Write(make([]byte, size))
+		}
+		data, _ := json.Marshal(manifest)
+		f, _ := writer.Create("manifest.json")
+		f.Write(data)
+		writer.Close()
+
+		return buffer.Bytes()
+	}
+
+	for name, test := range map[string]struct {
+		body []byte
+		code int
+	}{
+		"within the limits":  {archive(4<<10, 4<<10), 200},
+		"large body":         {bytes.Repeat([]byte("x"), 17<<10), 413},
+		"large file":         {archive(8 << 10), 413},
+		"large decompressed": {archive(4<<10, 4<<10, 4<<10), 413},
+	} {
+		if r, _, _ := MakeRequest(router, "POST", "/import?dryrun=true", test.body, a); r.Code != test.code {
+			t.Errorf("got response code = %d importing %s, expected %d", r.Code, name, test.code)
+		}
+	}
+}
+
+func TestImportCommand(t *testing.T) {
+	directory, err := ioutil.TempDir("", "rest-wiki-site")
+	if err != nil {
+		t.Fatalf("creating directory returned error %v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	for name, content := range map[string]string{
+		"Home.md":              "# Home",
+		"Team/Backend.txt":     "Backend",
+		".hidden.md":           "hidden",
+		".git/HEAD.txt":        "hidden",
+		"Team/diagram.png":     "PNG",
+		"Team/revisions.md":    "reserved",
+		"Team/Backend/Logs.md": "Logs",
+	} {
+		filename := filepath.Join(directory, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			t.Fatalf("creating directory returned error %v", err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatalf("writing file returned error %v", err)
+		}
+	}
+
+	store := NewMemoryPageStore()
+	var output bytes.Buffer
+	if err := RunImportCommand([]string{"-dryrun", directory}, store, NewMemoryAttachmentStore(), &output); err != nil {
+		t.Fatalf("running dry run returned error %v", err)
+	}
+	if pages, _ := store.List(); len(pages) != 0 {
+		t.Errorf("got %d pages after dry run, expected none", len(pages))
+	}
+
+	output.Reset()
+	if err := RunImportCommand([]string{"-author", "importer", directory}, store, NewMemoryAttachmentStore(), &output); err != nil {
+		t.Fatalf("running import returned error %v", err)
+	}
+	report := &ImportReport{}
+	if err := json.Unmarshal(output.Bytes(), report); err != nil {
+		t.Fatalf("parsing report returned error %v", err)
+	}
+	titles := []string{}
+	for _, result := range report.Created {
+		titles = append(titles, result.Title)
+	}
+	if strings.Join(titles, ",") != "Home,Team/Backend,Team/Backend/Logs" || len(report.Skipped) != 1 || report.Skipped[0].Source != "Team/revisions.md" {
+		t.Errorf("got report %+v, expected the pages created and the reserved title skipped", report)
+	}
+	if p, err := store.Get("Team/Backend"); err != nil || p.Body != "Backend" || p.Metadata.Author != "importer" {
+		t.Errorf("got %+v, %v loading imported page, expected its body and author", p, err)
+	}
+
+	for _, args := range [][]string{{}, {"-conflict", "merge", directory}, {filepath.Join(directory, "missing")}} {
+		if err := RunImportCommand(args, store, NewMemoryAttachmentStore(), &output); err == nil {
+			t.Errorf("running import with %v returned no error", args)
+		}
+	}
+}
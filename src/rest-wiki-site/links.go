@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// wikiLink matches [[Page Title]] and [[Page Title|label]].
+var wikiLink = regexp.MustCompile(`\[\[([^\[\]|]+)(\|[^\[\]]*)?\]\]`)
+
+// parseLinks returns the titles linked from body, sorted and each once.
+// Links to invalid titles are ignored.
+func parseLinks(body string) []string {
+	seen := map[string]bool{}
+	results := []string{}
+	for _, match := range wikiLink.FindAllStringSubmatch(body, -1) {
+		title := NormalizeTitle(strings.TrimSpace(match[1]))
+		if ValidTitle(title) && !seen[title] {
+			seen[title] = true
+			results = append(results, title)
+		}
+	}
+	sort.Strings(results)
+
+	return results
+}
+
+// LinkGraph records which pages link to which, from the [[links]] in their
+// bodies and their redirects. It is kept current as a PageListener. It is
+// safe for concurrent use.
+type LinkGraph struct {
+	mu        sync.RWMutex
+	links     map[string][]string
+	backlinks map[string]map[string]bool
+}
+
+type WantedPage struct {
+	Title      string   `json:"title"`
+	LinkedFrom []string `json:"linkedFrom"`
+}
+
+type WantedPages struct {
+	Items []*WantedPage `json:"items"`
+}
+
+func NewLinkGraph() *LinkGraph {
+	return &LinkGraph{links: map[string][]string{}, backlinks: map[string]map[string]bool{}}
+}
+
+// Build adds the links of every page in the store.
+func (g *LinkGraph) Build(store PageStore) error {
+	pages, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	for _, item := range pages {
+		p, err := store.Get(item.Title)
+		if err == ErrPageNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		g.PageSaved(p)
+	}
+
+	return nil
+}
+
+func (g *LinkGraph) PageSaved(p *Page) {
+	links := parseLinks(p.Body)
+	if len(p.Redirect) != 0 {
+		links = append(links, p.Redirect)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.remove(p.Title)
+	g.links[p.Title] = links
+	for _, link := range links {
+		if g.backlinks[link] == nil {
+			g.backlinks[link] = map[string]bool{}
+		}
+		g.backlinks[link][p.Title] = true
+	}
+}
+
+func (g *LinkGraph) PageRemoved(title string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.remove(title)
+}
+
+func (g *LinkGraph) remove(title string) {
+	for _, link := range g.links[title] {
+		delete(g.backlinks[link], title)
+		if len(g.backlinks[link]) == 0 {
+			delete(g.backlinks, link)
+		}
+	}
+	delete(g.links, title)
+}
+
+// Backlinks returns the other pages linking to title, sorted.
+func (g *LinkGraph) Backlinks(title string) []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	results := []string{}
+	for from := range g.backlinks[title] {
+		if from != title {
+			results = append(results, from)
+		}
+	}
+	sort.Strings(results)
+
+	return results
+}
+
+// Wanted returns the missing pages that are linked to, sorted by title.
+func (g *LinkGraph) Wanted() []*WantedPage {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	results := []*WantedPage{}
+	for title, from := range g.backlinks {
+		if _, exists := g.links[title]; exists {
+			continue
+		}
+
+		wanted := &WantedPage{Title: title, LinkedFrom: []string{}}
+		for link := range from {
+			wanted.LinkedFrom = append(wanted.LinkedFrom, link)
+		}
+		sort.Strings(wanted.LinkedFrom)
+		results = append(results, wanted)
+	}
+	sort.Sort(byWantedTitle(results))
+
+	return results
+}
+
+// Orphans returns the pages that no other page links to, sorted.
+func (g *LinkGraph) Orphans() []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	results := []string{}
+	for title := range g.links {
+		orphan := true
+		for from := range g.backlinks[title] {
+			if from != title {
+				orphan = false
+				break
+			}
+		}
+		if orphan {
+			results = append(results, title)
+		}
+	}
+	sort.Strings(results)
+
+	return results
+}
+
+type byWantedTitle []*WantedPage
+
+func (a byWantedTitle) Len() int           { return len(a) }
+func (a byWantedTitle) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byWantedTitle) Less(i, j int) bool { return a[i].Title < a[j].Title }
+
+// titlePages lists titles in the shape of a page list.
+func titlePages(titles []string) *Pages {
+	results := &Pages{Items: make([]*Page, len(titles))}
+	for i, title := range titles {
+		results.Items[i] = &Page{Title: title}
+	}
+
+	return results
+}
+
+func CreateBacklinksHandler(graph *LinkGraph, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization")
+
+		switch r.Method {
+		case "OPTIONS":
+			return
+		case "GET":
+			jsonResponse, _ := json.Marshal(titlePages(graph.Backlinks(GetTitle(r))))
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			w.Write(jsonResponse)
+		}
+	}
+}
+
+func CreateWantedReportHandler(graph *LinkGraph, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization")
+
+		switch r.Method {
+		case "OPTIONS":
+			return
+		case "GET":
+			jsonResponse, _ := json.Marshal(&WantedPages{Items: graph.Wanted()})
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			w.Write(jsonResponse)
+		}
+	}
+}
+
+func CreateOrphansReportHandler(graph *LinkGraph, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization")
+
+		switch r.Method {
+		case "OPTIONS":
+			return
+		case "GET":
+			jsonResponse, _ := json.Marshal(titlePages(graph.Orphans()))
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			w.Write(jsonResponse)
+		}
+	}
+}
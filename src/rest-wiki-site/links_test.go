@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLinks(t *testing.T) {
+	body := "See [[Team/Backend]] and [[ Runbook | the runbook]], again [[Team/Backend]]. Not [[../Secret]], [[]] or [single]."
+	if links := strings.Join(parseLinks(body), ","); links != "Runbook,Team/Backend" {
+		t.Errorf("got links %s, expected %s", links, "Runbook,Team/Backend")
+	}
+}
+
+func CheckTitles(dat map[string]interface{}, expected string, t *testing.T) {
+	if titles := strings.Join(ListTitles(dat), ","); titles != expected {
+		t.Errorf("got titles %s, expected %s", titles, expected)
+	}
+}
+
+func TestReportsGet(t *testing.T) {
+	store := NewMemoryPageStore()
+	for title, body := range map[string]string{
+		"Home":    "Start at [[Guide]] or [[Missing]].",
+		"Guide":   "Back [[Home]]. Also [[Guide]] and [[Missing]].",
+		"Lonely":  "Links to [[Elsewhere]].",
+		"Archive": "Nothing here.",
+	} {
+		p := &Page{Title: title, Body: body}
+		if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("creating test page returned error %v", err)
+		}
+	}
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	get := func(url string) map[string]interface{} {
+		r, dat, err := MakeRequest(router, "GET", url, nil, a)
+		if err != nil {
+			t.Fatalf("running request returned error %v", err)
+		} else if r.Code != 200 {
+			t.Fatalf("got response code = %d from %s, expected %d", r.Code, url, 200)
+		}
+		return dat
+	}
+	wanted := func() string {
+		results := []string{}
+		items, _ := get("/report/wanted")["items"].([]interface{})
+		for _, item := range items {
+			item := item.(map[string]interface{})
+			from := []string{}
+			for _, title := range item["linkedFrom"].([]interface{}) {
+				from = append(from, title.(string))
+			}
+			results = append(results, item["title"].(string)+"<"+strings.Join(from, "+"))
+		}
+		return strings.Join(results, ",")
+	}
+
+	CheckTitles(get("/page/Missing/backlinks"), "Guide,Home", t)
+	CheckTitles(get("/page/Guide/backlinks"), "Home", t)
+	CheckTitles(get("/report/orphans"), "Archive,Lonely", t)
+	if w := wanted(); w != "Elsewhere<Lonely,Missing<Guide+Home" {
+		t.Errorf("got wanted pages %s, expected %s", w, "Elsewhere<Lonely,Missing<Guide+Home")
+	}
+
+	// links are updated on save
+	if _, _, err := MakeRequest(router, "POST", "/page/Missing", []byte(`{"body":"Now [[Archive]]."}`), a); err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	CheckTitles(get("/report/orphans"), "Lonely", t)
+	if w := wanted(); w != "Elsewhere<Lonely" {
+		t.Errorf("got wanted pages %s after save, expected %s", w, "Elsewhere<Lonely")
+	}
+
+	// and on delete
+	if _, _, err := MakeRequest(router, "DELETE", "/page/Lonely", []byte{}, a); err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if w := wanted(); w != "" {
+		t.Errorf("got wanted pages %s after delete, expected none", w)
+	}
+
+	// and on move, where a redirect keeps links working
+	if _, _, err := MakeRequest(router, "POST", "/page/Guide/move", []byte(`{"destination":"Docs/Guide"}`), a); err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	CheckTitles(get("/page/Docs/Guide/backlinks"), "", t)
+	if w := wanted(); w != "Guide<Docs/Guide+Home" {
+		t.Errorf("got wanted pages %s after move, expected %s", w, "Guide<Docs/Guide+Home")
+	}
+	if _, _, err := MakeRequest(router, "POST", "/page/Guide", []byte(`{"redirect":"Docs/Guide"}`), a); err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	CheckTitles(get("/page/Docs/Guide/backlinks"), "Guide", t)
+	CheckTitles(get("/page/Home/backlinks"), "Docs/Guide", t)
+	if w := wanted(); w != "" {
+		t.Errorf("got wanted pages %s after redirect, expected none", w)
+	}
+}
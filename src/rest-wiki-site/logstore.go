@@ -0,0 +1,706 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrCorruptLog = errors.New("Page log is corrupt")
+
+// errBadRecord is returned by readLogRecord for a record that is cut short
+// or does not match its checksum.
+var errBadRecord = errors.New("bad log record")
+
+// logFilename is the name of the log in the data directory.
+const logFilename = "pages.log"
+
+// logHeaderSize is the size of the header before every record: the length
+// of its JSON and the CRC-32 checksum of it, both big-endian.
+const logHeaderSize = 8
+
+// compactMinRecords is the smallest log that is compacted.
+const compactMinRecords = 1000
+
+// LogPageStore keeps every change to the pages in a single append-only
+// log, and an index of their tags, metadata and revisions in memory, so
+// that listing pages reads nothing from disk. Bodies are read from the log
+// when they are needed.
+//
+// Every change is appended and synced before it is applied to the index,
+// and the log is replayed into the index when the store is opened. A
+// record left incomplete at the end of the log by a crash is truncated
+// then; a damaged record anywhere else is reported as ErrCorruptLog.
+// Compact rewrites the log with only what the store holds now.
+type LogPageStore struct {
+	Directory string
+
+	mu      sync.RWMutex
+	file    *os.File
+	size    int64
+	records int
+	pages   map[string]*logPage
+	trash   map[string]*logTrashedPage
+}
+
+// logRecord is a change in the log. A put record carries the saved page
+// or revision or both, a delete record the trashed page, and a move record
+// the destination.
+type logRecord struct {
+	Op          string       `json:"op"`
+	Title       string       `json:"title"`
+	Destination string       `json:"destination,omitempty"`
+	Page        *Page        `json:"page,omitempty"`
+	Revision    *Revision    `json:"revision,omitempty"`
+	Trashed     *TrashedPage `json:"trashed,omitempty"`
+	// SharedBody is set when the revision's body is the page's, which is
+	// then stored only once.
+	SharedBody bool `json:"sharedBody,omitempty"`
+}
+
+// logPage is a page in the index, with the offsets of the records holding
+// its body and those of its revisions.
+type logPage struct {
+	page      *Page
+	offset    int64
+	revisions []*logRevision
+}
+
+type logRevision struct {
+	revision *Revision
+	offset   int64
+}
+
+type logTrashedPage struct {
+	trashed *TrashedPage
+	page    *logPage
+}
+
+// NewLogPageStore creates the data directory and the log in it if they do
+// not exist yet, and reads the log into the index.
+func NewLogPageStore(directory string) (*LogPageStore, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(directory, logFilename), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &LogPageStore{Directory: directory, file: f}
+	if err := s.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// StartLogCompactor compacts the log every interval, when it has grown to
+// more than twice what a compaction would write.
+func StartLogCompactor(store *LogPageStore, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if !store.wasteful() {
+				continue
+			}
+			if err := store.Compact(); err != nil {
+				log.Printf("compacting page log: %v", err)
+			}
+		}
+	}()
+}
+
+func (s *LogPageStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
+
+func encodeLogRecord(record *logRecord) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, logHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(data[4:8], crc32.ChecksumIEEE(payload))
+	copy(data[logHeaderSize:], payload)
+
+	return data, nil
+}
+
+// readLogRecord reads the record at the start of r, of which remaining
+// bytes are left in the log, and returns it with its size. For a bad
+// record the size is how far it claims to extend.
+func readLogRecord(r io.Reader, remaining int64) (*logRecord, int64, error) {
+	header := make([]byte, logHeaderSize)
+	if _, err := io.ReadFull(r, header); err == io.ErrUnexpectedEOF {
+		return nil, remaining, errBadRecord
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if length == 0 || logHeaderSize+length > remaining {
+		return nil, logHeaderSize + length, errBadRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, logHeaderSize + length, errBadRecord
+	}
+
+	record := &logRecord{}
+	if err := json.Unmarshal(payload, record); err != nil {
+		return nil, logHeaderSize + length, errBadRecord
+	}
+
+	return record, logHeaderSize + length, nil
+}
+
+// readAt returns the record at offset in the log.
+func (s *LogPageStore) readAt(offset int64) (*logRecord, error) {
+	record, _, err := readLogRecord(io.NewSectionReader(s.file, offset, s.size-offset), s.size-offset)
+	if err == errBadRecord {
+		return nil, ErrCorruptLog
+	}
+
+	return record, err
+}
+
+// zeroed reports whether the log holds only zeros from offset on, as a
+// filesystem may leave after a crash during a write.
+func (s *LogPageStore) zeroed(offset int64, size int64) (bool, error) {
+	reader := bufio.NewReader(io.NewSectionReader(s.file, offset, size-offset))
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		if b != 0 {
+			return false, nil
+		}
+	}
+}
+
+// validRecordAfter reports whether a complete, valid record starts
+// anywhere in the log after offset. Record payloads are JSON, which
+// escapes the bytes a record header starts with, so one found inside a
+// torn record's payload is not mistaken for the next record.
+func (s *LogPageStore) validRecordAfter(offset int64, size int64) (bool, error) {
+	for start := offset + 1; start+logHeaderSize < size; start++ {
+		_, _, err := readLogRecord(io.NewSectionReader(s.file, start, size-start), size-start)
+		if err == nil {
+			return true, nil
+		} else if err != errBadRecord {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// load replays the log into an empty index, truncating a torn record at
+// its end.
+func (s *LogPageStore) load() error {
+	s.pages = map[string]*logPage{}
+	s.trash = map[string]*logTrashedPage{}
+	s.records = 0
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	reader := bufio.NewReader(io.NewSectionReader(s.file, 0, size))
+	offset := int64(0)
+	for offset < size {
+		record, length, err := readLogRecord(reader, size-offset)
+		if err == errBadRecord {
+			// a record reaching the end of the log may be torn, unless its
+			// length was damaged and valid records follow it
+			torn := false
+			if offset+length >= size {
+				followed, err := s.validRecordAfter(offset, size)
+				if err != nil {
+					return err
+				}
+				torn = !followed
+			}
+			if !torn {
+				if torn, err = s.zeroed(offset, size); err != nil {
+					return err
+				}
+			}
+			if !torn {
+				return fmt.Errorf("%v: bad record at offset %d", ErrCorruptLog, offset)
+			}
+
+			log.Printf("truncating torn record at offset %d of %s", offset, s.file.Name())
+			if err := s.file.Truncate(offset); err != nil {
+				return err
+			}
+			if err := syncFile(s.file); err != nil {
+				return err
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if err := s.apply(record, offset); err != nil {
+			return fmt.Errorf("%v: %v at offset %d", ErrCorruptLog, err, offset)
+		}
+		offset += length
+	}
+	s.size = offset
+
+	return nil
+}
+
+// apply updates the index with the record at offset.
+func (s *LogPageStore) apply(record *logRecord, offset int64) error {
+	s.records++
+
+	switch record.Op {
+	case "put":
+		entry, ok := s.pages[record.Title]
+		if !ok {
+			entry = &logPage{}
+			s.pages[record.Title] = entry
+		}
+		if record.Revision != nil {
+			summary := *record.Revision
+			summary.Body = ""
+			entry.revisions = append(entry.revisions, &logRevision{revision: &summary, offset: offset})
+		}
+		if record.Page != nil {
+			summary := *record.Page
+			summary.Body = ""
+			entry.page = &summary
+			entry.offset = offset
+		}
+	case "delete":
+		entry, ok := s.pages[record.Title]
+		if !ok || record.Trashed == nil {
+			return ErrPageNotFound
+		}
+		s.trash[record.Title] = &logTrashedPage{trashed: record.Trashed, page: entry}
+		delete(s.pages, record.Title)
+	case "restore":
+		t, ok := s.trash[record.Title]
+		if !ok {
+			return ErrPageNotFound
+		}
+		s.pages[record.Title] = t.page
+		delete(s.trash, record.Title)
+	case "purge":
+		delete(s.trash, record.Title)
+	case "move":
+		entry, ok := s.pages[record.Title]
+		if !ok || entry.page == nil {
+			return ErrPageNotFound
+		}
+		entry.page.Title = record.Destination
+		s.pages[record.Destination] = entry
+		delete(s.pages, record.Title)
+	default:
+		return fmt.Errorf("unknown operation %q", record.Op)
+	}
+
+	return nil
+}
+
+// append writes the record to the end of the log, syncs it and applies
+// it. A record that fails to be written is cut off again.
+func (s *LogPageStore) append(record *logRecord) error {
+	data, err := encodeLogRecord(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.file.WriteAt(data, s.size)
+	if err == nil {
+		err = syncFile(s.file)
+	}
+	if err != nil {
+		s.file.Truncate(s.size)
+		return err
+	}
+
+	offset := s.size
+	s.size += int64(len(data))
+
+	return s.apply(record, offset)
+}
+
+// page returns the live page with the title from the index.
+func (s *LogPageStore) page(title string) (*logPage, bool) {
+	entry, ok := s.pages[title]
+	if !ok || entry.page == nil {
+		return nil, false
+	}
+
+	return entry, true
+}
+
+func (s *LogPageStore) Get(title string) (*Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.page(title)
+	if !ok {
+		return nil, ErrPageNotFound
+	}
+	record, err := s.readAt(entry.offset)
+	if err != nil {
+		return nil, err
+	}
+
+	result := *entry.page
+	metadata := *entry.page.Metadata
+	result.Metadata = &metadata
+	result.Body = record.Page.Body
+
+	return &result, nil
+}
+
+func (s *LogPageStore) Put(p *Page, r *Revision) error {
+	if !ValidTitle(p.Title) {
+		return ErrInvalidTitle
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var previous *PageMetadata
+	r.ID = "1"
+	if entry, ok := s.pages[p.Title]; ok {
+		if entry.page != nil {
+			previous = entry.page.Metadata
+		}
+		r.ID = strconv.Itoa(len(entry.revisions) + 1)
+	}
+	metadata := updateMetadata(previous, p, r)
+
+	revision := *r
+	record := &logRecord{Op: "put", Title: p.Title, Revision: &revision, SharedBody: r.Body == p.Body}
+	record.Page = &Page{Title: p.Title, DisplayTitle: p.DisplayTitle, Redirect: p.Redirect, Body: p.Body, Tags: p.Tags, Metadata: metadata}
+	if record.SharedBody {
+		revision.Body = ""
+	}
+	if err := s.append(record); err != nil {
+		return err
+	}
+	p.Metadata = metadata
+
+	return nil
+}
+
+func (s *LogPageStore) Delete(title string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.page(title); !ok {
+		return ErrPageNotFound
+	}
+
+	return s.append(&logRecord{Op: "delete", Title: title, Trashed: &TrashedPage{Title: title, Deleted: time.Now().UTC()}})
+}
+
+func (s *LogPageStore) List() ([]*Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := make([]*Page, 0, len(s.pages))
+	for title := range s.pages {
+		if entry, ok := s.page(title); ok {
+			p := *entry.page
+			metadata := *p.Metadata
+			p.Metadata = &metadata
+			results = append(results, &p)
+		}
+	}
+	sort.Sort(byTitle(results))
+
+	return results, nil
+}
+
+func (s *LogPageStore) Revisions(title string) ([]*Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.pages[title]
+	if !ok || (entry.page == nil && len(entry.revisions) == 0) {
+		return nil, ErrPageNotFound
+	}
+
+	results := make([]*Revision, len(entry.revisions))
+	for i, item := range entry.revisions {
+		summary := *item.revision
+		results[i] = &summary
+	}
+
+	return results, nil
+}
+
+func (s *LogPageStore) Revision(title string, id string) (*Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.pages[title]
+	if !ok {
+		return nil, ErrRevisionNotFound
+	}
+	for _, item := range entry.revisions {
+		if item.revision.ID != id {
+			continue
+		}
+
+		record, err := s.readAt(item.offset)
+		if err != nil {
+			return nil, err
+		}
+		result := *item.revision
+		result.Body = record.Revision.Body
+		if record.SharedBody {
+			result.Body = record.Page.Body
+		}
+
+		return &result, nil
+	}
+
+	return nil, ErrRevisionNotFound
+}
+
+func (s *LogPageStore) Trash() ([]*TrashedPage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := make([]*TrashedPage, 0, len(s.trash))
+	for _, t := range s.trash {
+		trashed := *t.trashed
+		results = append(results, &trashed)
+	}
+	sort.Sort(byDeletion(results))
+
+	return results, nil
+}
+
+func (s *LogPageStore) Restore(title string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.trash[title]; !ok {
+		return ErrPageNotFound
+	}
+	if _, ok := s.page(title); ok {
+		return ErrPageExists
+	}
+
+	return s.append(&logRecord{Op: "restore", Title: title})
+}
+
+func (s *LogPageStore) Purge(title string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.trash[title]; !ok {
+		return ErrPageNotFound
+	}
+
+	return s.append(&logRecord{Op: "purge", Title: title})
+}
+
+func (s *LogPageStore) Move(title string, destination string) error {
+	if !ValidTitle(destination) {
+		return ErrInvalidTitle
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.page(title); !ok {
+		return ErrPageNotFound
+	}
+	if _, ok := s.page(destination); ok {
+		return ErrPageExists
+	}
+
+	return s.append(&logRecord{Op: "move", Title: title, Destination: destination})
+}
+
+// liveRecords returns the number of records a compaction would write.
+func (s *LogPageStore) liveRecords() int {
+	count := len(s.trash)
+	for _, entry := range s.pages {
+		count += len(entry.revisions)
+	}
+	for _, t := range s.trash {
+		count += len(t.page.revisions)
+	}
+
+	return count
+}
+
+// wasteful reports whether the log has grown to more than twice what a
+// compaction would write.
+func (s *LogPageStore) wasteful() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.records >= compactMinRecords && s.records > 2*s.liveRecords()
+}
+
+// compactPage writes the records of a page's revisions, the last with
+// the page itself.
+func (s *LogPageStore) compactPage(w io.Writer, title string, entry *logPage) error {
+	for i, item := range entry.revisions {
+		record, err := s.readAt(item.offset)
+		if err != nil {
+			return err
+		}
+		revision := *item.revision
+		revision.Body = record.Revision.Body
+		if record.SharedBody {
+			revision.Body = record.Page.Body
+		}
+
+		compacted := &logRecord{Op: "put", Title: title, Revision: &revision}
+		if i == len(entry.revisions)-1 {
+			if compacted.Page, err = s.body(entry); err != nil {
+				return err
+			}
+			compacted.SharedBody = revision.Body == compacted.Page.Body
+			if compacted.SharedBody {
+				revision.Body = ""
+			}
+		}
+		if err := writeLogRecord(w, compacted); err != nil {
+			return err
+		}
+	}
+
+	if len(entry.revisions) == 0 && entry.page != nil {
+		p, err := s.body(entry)
+		if err != nil {
+			return err
+		}
+		return writeLogRecord(w, &logRecord{Op: "put", Title: title, Page: p})
+	}
+
+	return nil
+}
+
+// body returns the page of an index entry with its body.
+func (s *LogPageStore) body(entry *logPage) (*Page, error) {
+	record, err := s.readAt(entry.offset)
+	if err != nil {
+		return nil, err
+	}
+	p := *entry.page
+	p.Body = record.Page.Body
+
+	return &p, nil
+}
+
+func writeLogRecord(w io.Writer, record *logRecord) error {
+	data, err := encodeLogRecord(record)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+
+	return err
+}
+
+// Compact replaces the log with one holding only the records needed for
+// the pages, their revisions and the trash as they are now. The new log
+// is written beside the old one and renamed over it.
+func (s *LogPageStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filename := filepath.Join(s.Directory, logFilename)
+	f, err := os.OpenFile(filepath.Join(s.Directory, ".tmp-"+logFilename), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = s.writeCompacted(f)
+	if err == nil {
+		err = syncFile(f)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	// make the rename itself durable
+	if d, err := os.Open(s.Directory); err == nil {
+		syncFile(d)
+		d.Close()
+	}
+
+	s.file.Close()
+	s.file = f
+
+	return s.load()
+}
+
+// writeCompacted writes the trash before the pages, since a page may have
+// reused the title of a trashed one.
+func (s *LogPageStore) writeCompacted(f *os.File) error {
+	writer := bufio.NewWriter(f)
+
+	titles := []string{}
+	for title := range s.trash {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+	for _, title := range titles {
+		t := s.trash[title]
+		if err := s.compactPage(writer, title, t.page); err != nil {
+			return err
+		}
+		if err := writeLogRecord(writer, &logRecord{Op: "delete", Title: title, Trashed: t.trashed}); err != nil {
+			return err
+		}
+	}
+
+	titles = titles[:0]
+	for title := range s.pages {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+	for _, title := range titles {
+		if err := s.compactPage(writer, title, s.pages[title]); err != nil {
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogPageStore(t *testing.T) {
+	directory, err := ioutil.TempDir("", "rest-wiki-site")
+	if err != nil {
+		t.Fatalf("creating data directory returned error %v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	store, err := NewLogPageStore(filepath.Join(directory, "data"))
+	if err != nil {
+		t.Fatalf("opening log store returned error %v", err)
+	}
+	CheckPageStore(store, t)
+	expected, _ := store.List()
+	trash, _ := store.Trash()
+	store.Close()
+
+	// the log is replayed when it is opened again
+	store, err = NewLogPageStore(filepath.Join(directory, "data"))
+	if err != nil {
+		t.Fatalf("reopening log store returned error %v", err)
+	}
+	defer store.Close()
+	pages, err := store.List()
+	if err != nil || len(pages) != len(expected) {
+		t.Fatalf("got pages %v, %v after reopening, expected %v", pages, err, expected)
+	}
+	for i, p := range pages {
+		if p.Title != expected[i].Title || *p.Metadata != *expected[i].Metadata {
+			t.Errorf("got page %+v after reopening, expected %+v", p, expected[i])
+		}
+	}
+	if items, err := store.Trash(); err != nil || len(items) != len(trash) {
+		t.Errorf("got trash %v, %v after reopening, expected %v", items, err, trash)
+	}
+}
+
+func TestLogPageStoreTornRecord(t *testing.T) {
+	directory, err := ioutil.TempDir("", "rest-wiki-site")
+	if err != nil {
+		t.Fatalf("creating data directory returned error %v", err)
+	}
+	defer os.RemoveAll(directory)
+	filename := filepath.Join(directory, logFilename)
+
+	store, err := NewLogPageStore(directory)
+	if err != nil {
+		t.Fatalf("opening log store returned error %v", err)
+	}
+	for _, title := range []string{"TestPage", "OtherPage"} {
+		p := &Page{Title: title, Body: "Test result"}
+		if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("saving page returned error %v", err)
+		}
+	}
+	store.Close()
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("reading log returned error %v", err)
+	}
+
+	for name, tail := range map[string][]byte{
+		"header":  data[:logHeaderSize/2],
+		"record":  data[:len(data)/3],
+		"zeros":   make([]byte, 64),
+		"garbage": append(append([]byte{}, data[:logHeaderSize]...), strings.Repeat("x", int(binary.BigEndian.Uint32(data)))...),
+	} {
+		if err := ioutil.WriteFile(filename, append(append([]byte{}, data...), tail...), 0600); err != nil {
+			t.Fatalf("writing log returned error %v", err)
+		}
+
+		store, err := NewLogPageStore(directory)
+		if err != nil {
+			t.Fatalf("opening log with torn %s returned error %v", name, err)
+		}
+		if info, err := os.Stat(filename); err != nil || info.Size() != int64(len(data)) {
+			t.Errorf("got log of %v, %v bytes after torn %s, expected %d", info.Size(), err, name, len(data))
+		}
+		if pages, err := store.List(); err != nil || len(pages) != 2 {
+			t.Errorf("got pages %v, %v after torn %s, expected 2", pages, err, name)
+		}
+
+		// writing continues where the log was cut off
+		p := &Page{Title: "TestPage", Body: "Test result updated"}
+		if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("saving page after torn %s returned error %v", name, err)
+		}
+		store.Close()
+		store, err = NewLogPageStore(directory)
+		if err != nil {
+			t.Fatalf("reopening log after torn %s returned error %v", name, err)
+		}
+		if p, err := store.Get("TestPage"); err != nil || p.Body != "Test result updated" {
+			t.Errorf("got %v, %v loading page after torn %s, expected the update", p, err, name)
+		}
+		store.Close()
+	}
+
+	// damage before the end of the log is not taken for a torn write
+	damaged := append([]byte{}, data...)
+	damaged[logHeaderSize+1] ^= 0xff
+	if err := ioutil.WriteFile(filename, damaged, 0600); err != nil {
+		t.Fatalf("writing log returned error %v", err)
+	}
+	if _, err := NewLogPageStore(directory); err == nil || !strings.HasPrefix(err.Error(), ErrCorruptLog.Error()) {
+		t.Errorf("got error %v opening damaged log, expected %v", err, ErrCorruptLog)
+	}
+
+	// so is a damaged length that claims the rest of the log, which would
+	// otherwise lose the records after it
+	damaged = append([]byte{}, data...)
+	binary.BigEndian.PutUint32(damaged, uint32(len(data)))
+	if err := ioutil.WriteFile(filename, damaged, 0600); err != nil {
+		t.Fatalf("writing log returned error %v", err)
+	}
+	if _, err := NewLogPageStore(directory); err == nil || !strings.HasPrefix(err.Error(), ErrCorruptLog.Error()) {
+		t.Errorf("got error %v opening log with damaged length, expected %v", err, ErrCorruptLog)
+	}
+	if info, err := os.Stat(filename); err != nil || info.Size() != int64(len(data)) {
+		t.Errorf("got log of %v, %v bytes after damaged length, expected it left alone", info.Size(), err)
+	}
+}
+
+func TestLogPageStoreCompact(t *testing.T) {
+	directory, err := ioutil.TempDir("", "rest-wiki-site")
+	if err != nil {
+		t.Fatalf("creating data directory returned error %v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	store, err := NewLogPageStore(directory)
+	if err != nil {
+		t.Fatalf("opening log store returned error %v", err)
+	}
+	defer func() { store.Close() }()
+
+	// a page with history, a trashed page whose title was reused, and pages
+	// that were moved and purged
+	p := &Page{Title: "TestPage", Tags: []string{"test"}}
+	for _, body := range []string{"Test result", "Test result updated"} {
+		p.Body = body
+		if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("saving page returned error %v", err)
+		}
+	}
+	for _, title := range []string{"Reused", "Reused", "Moved", "Purged"} {
+		other := &Page{Title: title, Body: "Other result"}
+		if err := other.Save(store, &Revision{Author: "other"}); err != nil {
+			t.Fatalf("saving page returned error %v", err)
+		}
+		if title != "Moved" {
+			if err := store.Delete(title); err != nil {
+				t.Fatalf("deleting page returned error %v", err)
+			}
+		}
+	}
+	if err := store.Purge("Purged"); err != nil {
+		t.Fatalf("purging page returned error %v", err)
+	}
+	reused := &Page{Title: "Reused", Body: "Reused result"}
+	if err := reused.Save(store, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("saving page returned error %v", err)
+	}
+	if err := store.Move("Moved", "Team/Moved"); err != nil {
+		t.Fatalf("moving page returned error %v", err)
+	}
+
+	// a revert stores its body apart from the page's
+	if err := store.Put(&Page{Title: "TestPage", Body: "Test result", Tags: []string{"test"}}, &Revision{Author: "test", Body: "Reverted"}); err != nil {
+		t.Fatalf("storing page returned error %v", err)
+	}
+
+	before, _ := os.Stat(filepath.Join(directory, logFilename))
+	if err := store.Compact(); err != nil {
+		t.Fatalf("compacting returned error %v", err)
+	}
+	after, _ := os.Stat(filepath.Join(directory, logFilename))
+	if after.Size() >= before.Size() {
+		t.Errorf("got log of %d bytes after compacting, expected less than %d", after.Size(), before.Size())
+	}
+
+	for i := 0; i < 2; i++ {
+		if pages, err := store.List(); err != nil || len(pages) != 3 || pages[0].Title != "Reused" || pages[1].Title != "Team/Moved" || pages[2].Title != "TestPage" {
+			t.Errorf("got pages %v, %v after compacting, expected Reused, Team/Moved and TestPage", pages, err)
+		}
+		if p, err := store.Get("TestPage"); err != nil || p.Body != "Test result" || p.Metadata.Revisions != 3 || len(p.Tags) != 1 {
+			t.Errorf("got %+v, %v loading page after compacting, expected its body, tags and metadata", p, err)
+		}
+		for id, body := range map[string]string{"1": "Test result", "2": "Test result updated", "3": "Reverted"} {
+			if r, err := store.Revision("TestPage", id); err != nil || r.Body != body {
+				t.Errorf("got %+v, %v loading revision %s after compacting, expected body %q", r, err, id, body)
+			}
+		}
+		if revisions, err := store.Revisions("Team/Moved"); err != nil || len(revisions) != 1 {
+			t.Errorf("got revisions %v, %v of moved page after compacting, expected 1", revisions, err)
+		}
+		if trash, err := store.Trash(); err != nil || len(trash) != 1 || trash[0].Title != "Reused" {
+			t.Errorf("got trash %v, %v after compacting, expected Reused", trash, err)
+		}
+
+		// the compacted log is replayed the same way
+		store.Close()
+		if store, err = NewLogPageStore(directory); err != nil {
+			t.Fatalf("reopening log store returned error %v", err)
+		}
+	}
+
+	// restoring the trashed page brings back its own revision
+	if err := store.Delete("Reused"); err != nil {
+		t.Fatalf("deleting page returned error %v", err)
+	}
+	if err := store.Restore("Reused"); err != nil {
+		t.Fatalf("restoring page returned error %v", err)
+	}
+	if p, err := store.Get("Reused"); err != nil || p.Body != "Reused result" {
+		t.Errorf("got %+v, %v loading restored page, expected %q", p, err, "Reused result")
+	}
+}
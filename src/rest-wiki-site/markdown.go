@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// The renderer handles the common subset of Markdown: ATX headings,
+// paragraphs, emphasis, code spans and fenced or indented code blocks,
+// block quotes, nested lists, pipe tables, rules, links, images and
+// [[wiki links]]. Raw HTML is escaped rather than passed through and only
+// http, https, mailto and relative link targets are kept, so the output is
+// safe to embed in a page.
+
+var (
+	headingLine   = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	ruleLine      = regexp.MustCompile(`^ {0,3}(?:(?:-[ \t]*){3,}|(?:\*[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	fenceLine     = regexp.MustCompile("^ {0,3}(```+|~~~+)[ \t]*([^`]*)$")
+	listItemLine  = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])(?:[ \t]+|$)`)
+	quoteLine     = regexp.MustCompile(`^ {0,3}> ?`)
+	tableDivider  = regexp.MustCompile(`^ {0,3}\|?[ \t]*:?-+:?[ \t]*(?:\|[ \t]*:?-+:?[ \t]*)*\|?[ \t]*$`)
+	indentedCode  = regexp.MustCompile(`^(?: {4}|\t)`)
+	blankLine     = regexp.MustCompile(`^[ \t]*$`)
+	orderedMarker = regexp.MustCompile(`^\d`)
+)
+
+// maxNesting is how deeply lists, block quotes, links and emphasis may
+// nest. Deeper markup is rendered as text, so that rendering time stays
+// proportional to the size of the page.
+const maxNesting = 32
+
+// markdownRenderer renders a page body. exists tells it which wiki links
+// lead to existing pages and depth is how deeply the blocks being
+// rendered are nested in lists and block quotes.
+type markdownRenderer struct {
+	exists func(title string) bool
+	depth  int
+	out    bytes.Buffer
+}
+
+// renderMarkdown converts body to HTML, marking wiki links to titles for
+// which exists returns false as missing.
+func renderMarkdown(body string, exists func(title string) bool) string {
+	m := &markdownRenderer{exists: exists}
+	body = strings.Replace(strings.Replace(body, "\r\n", "\n", -1), "\r", "\n", -1)
+	m.renderBlocks(strings.Split(body, "\n"))
+
+	return m.out.String()
+}
+
+// startsBlock reports whether line interrupts a paragraph.
+func startsBlock(line string) bool {
+	return headingLine.MatchString(line) || ruleLine.MatchString(line) || fenceLine.MatchString(line) || quoteLine.MatchString(line) || listItemLine.MatchString(line)
+}
+
+func (m *markdownRenderer) renderBlocks(lines []string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+
+		switch {
+		case blankLine.MatchString(line):
+			i++
+		case fenceLine.MatchString(line):
+			match := fenceLine.FindStringSubmatch(line)
+			fence, language := match[1], strings.Fields(match[2]+" ")
+			code := []string{}
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				code = append(code, lines[i])
+			}
+			i++
+			m.out.WriteString("<pre><code")
+			if len(language) > 0 {
+				fmt.Fprintf(&m.out, " class=\"language-%s\"", html.EscapeString(language[0]))
+			}
+			m.out.WriteString(">")
+			if len(code) > 0 {
+				m.out.WriteString(html.EscapeString(strings.Join(code, "\n")) + "\n")
+			}
+			m.out.WriteString("</code></pre>\n")
+		case headingLine.MatchString(line):
+			match := headingLine.FindStringSubmatch(line)
+			fmt.Fprintf(&m.out, "<h%d>%s</h%d>\n", len(match[1]), m.renderInline(match[2]), len(match[1]))
+			i++
+		case ruleLine.MatchString(line):
+			m.out.WriteString("<hr>\n")
+			i++
+		case quoteLine.MatchString(line) && m.depth < maxNesting:
+			quoted := []string{}
+			for ; i < len(lines) && quoteLine.MatchString(lines[i]); i++ {
+				quoted = append(quoted, quoteLine.ReplaceAllString(lines[i], ""))
+			}
+			m.out.WriteString("<blockquote>\n")
+			m.depth++
+			m.renderBlocks(quoted)
+			m.depth--
+			m.out.WriteString("</blockquote>\n")
+		case listItemLine.MatchString(line) && m.depth < maxNesting:
+			i = m.renderList(lines, i)
+		case indentedCode.MatchString(line):
+			code := []string{}
+			for ; i < len(lines) && (indentedCode.MatchString(lines[i]) || blankLine.MatchString(lines[i])); i++ {
+				code = append(code, indentedCode.ReplaceAllString(lines[i], ""))
+			}
+			for len(code) > 0 && blankLine.MatchString(code[len(code)-1]) {
+				code = code[:len(code)-1]
+			}
+			m.out.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "\n</code></pre>\n")
+		case strings.Contains(line, "|") && i+1 < len(lines) && tableDivider.MatchString(lines[i+1]):
+			i = m.renderTable(lines, i)
+		default:
+			paragraph := []string{strings.TrimSpace(line)}
+			for i++; i < len(lines) && !blankLine.MatchString(lines[i]) && !startsBlock(lines[i]); i++ {
+				paragraph = append(paragraph, strings.TrimSpace(lines[i]))
+			}
+			m.out.WriteString("<p>" + m.renderInline(strings.Join(paragraph, "\n")) + "</p>\n")
+		}
+	}
+}
+
+// renderList renders the list starting at lines[start] and returns the
+// index of the first line after it. Lines indented past an item's marker
+// belong to the item, so lists nest by indentation.
+func (m *markdownRenderer) renderList(lines []string, start int) int {
+	ordered := orderedMarker.MatchString(strings.TrimSpace(lines[start]))
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+	}
+	m.out.WriteString("<" + tag + ">\n")
+
+	i := start
+	for i < len(lines) {
+		match := listItemLine.FindStringSubmatch(lines[i])
+		if match == nil || orderedMarker.MatchString(match[2]) != ordered {
+			break
+		}
+
+		indent := len(match[0])
+		item := []string{lines[i][indent:]}
+		for i++; i < len(lines); i++ {
+			if blankLine.MatchString(lines[i]) {
+				// a blank line continues the item only if indented text follows
+				if i+1 < len(lines) && len(lines[i+1])-len(strings.TrimLeft(lines[i+1], " \t")) >= indent && !blankLine.MatchString(lines[i+1]) {
+					item = append(item, "")
+					continue
+				}
+				break
+			}
+			leading := len(lines[i]) - len(strings.TrimLeft(lines[i], " \t"))
+			if leading >= indent {
+				item = append(item, lines[i][indent:])
+			} else if !startsBlock(lines[i]) && len(item) > 0 && !blankLine.MatchString(item[len(item)-1]) {
+				// lazy continuation of the item's paragraph
+				item = append(item, strings.TrimSpace(lines[i]))
+			} else {
+				break
+			}
+		}
+
+		sub := &markdownRenderer{exists: m.exists, depth: m.depth + 1}
+		sub.renderBlocks(item)
+		content := sub.out.String()
+		// tight items hold their text without a paragraph
+		if strings.HasPrefix(content, "<p>") && strings.Count(content, "<p>") == 1 {
+			content = strings.Replace(strings.Replace(content, "<p>", "", 1), "</p>\n", "\n", 1)
+			content = strings.TrimSuffix(content, "\n")
+		}
+		m.out.WriteString("<li>" + content + "</li>\n")
+
+		// a blank line between items of the same list is skipped
+		if i+1 < len(lines) && blankLine.MatchString(lines[i]) && listItemLine.MatchString(lines[i+1]) {
+			i++
+		}
+	}
+
+	m.out.WriteString("</" + tag + ">\n")
+
+	return i
+}
+
+// splitTableRow splits a pipe table row into its trimmed cells.
+func splitTableRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, "\\|") {
+		line = line[:len(line)-1]
+	}
+
+	cells := []string{}
+	var cell bytes.Buffer
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' && i+1 < len(line) && line[i+1] == '|' {
+			cell.WriteByte('|')
+			i++
+		} else if line[i] == '|' {
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		} else {
+			cell.WriteByte(line[i])
+		}
+	}
+
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+// renderTable renders the table whose header is lines[start] and returns
+// the index of the first line after it.
+func (m *markdownRenderer) renderTable(lines []string, start int) int {
+	header := splitTableRow(lines[start])
+	alignments := []string{}
+	for _, divider := range splitTableRow(lines[start+1]) {
+		switch {
+		case strings.HasPrefix(divider, ":") && strings.HasSuffix(divider, ":"):
+			alignments = append(alignments, "center")
+		case strings.HasSuffix(divider, ":"):
+			alignments = append(alignments, "right")
+		case strings.HasPrefix(divider, ":"):
+			alignments = append(alignments, "left")
+		default:
+			alignments = append(alignments, "")
+		}
+	}
+
+	row := func(tag string, cells []string) {
+		m.out.WriteString("<tr>")
+		for j := range header {
+			cell := ""
+			if j < len(cells) {
+				cell = cells[j]
+			}
+			m.out.WriteString("<" + tag)
+			if j < len(alignments) && len(alignments[j]) != 0 {
+				fmt.Fprintf(&m.out, " style=\"text-align: %s\"", alignments[j])
+			}
+			m.out.WriteString(">" + m.renderInline(cell) + "</" + tag + ">")
+		}
+		m.out.WriteString("</tr>\n")
+	}
+
+	m.out.WriteString("<table>\n<thead>\n")
+	row("th", header)
+	m.out.WriteString("</thead>\n")
+
+	i := start + 2
+	if i < len(lines) && !blankLine.MatchString(lines[i]) && strings.Contains(lines[i], "|") {
+		m.out.WriteString("<tbody>\n")
+		for ; i < len(lines) && !blankLine.MatchString(lines[i]) && strings.Contains(lines[i], "|"); i++ {
+			row("td", splitTableRow(lines[i]))
+		}
+		m.out.WriteString("</tbody>\n")
+	}
+	m.out.WriteString("</table>\n")
+
+	return i
+}
+
+// safeURL reports whether target may be used as a link or image address.
+func safeURL(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "mailto":
+		return true
+	}
+
+	return false
+}
+
+// pageURL returns the address of a page's API resource.
+func pageURL(title string) string {
+	segments := strings.Split(title, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	return "/page/" + strings.Join(segments, "/")
+}
+
+// isPunctuation reports whether c may be escaped with a backslash.
+func isPunctuation(c byte) bool {
+	return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
+
+// isWordByte reports whether c is part of a word, for intraword underscores.
+func isWordByte(c byte) bool {
+	return c >= 0x80 || c == '_' || ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// renderInline renders the spans of a block's text.
+func (m *markdownRenderer) renderInline(text string) string {
+	return m.renderSpans(text, matchBrackets(text), 0, len(text), 0)
+}
+
+// renderSpans renders the spans of text[start:end], which is nested depth
+// deep in links and emphasis. matches are the brackets of the whole text
+// matched by matchBrackets, so that nested spans share them. Every search
+// for the end of a span that fails is remembered, so that no text is
+// searched again for the same delimiter and rendering stays linear in the
+// text.
+func (m *markdownRenderer) renderSpans(text string, matches []int, start, end, depth int) string {
+	var out, plain bytes.Buffer
+	flush := func() {
+		out.WriteString(html.EscapeString(plain.String()))
+		plain.Reset()
+	}
+
+	unclosedCode := map[int]bool{}
+	unclosedEmphasis := map[string]bool{}
+	unclosedWikiLink := false
+	wikiLinkEnd := -1
+
+	for i := start; i < end; {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < end && isPunctuation(text[i+1]):
+			plain.WriteByte(text[i+1])
+			i += 2
+			continue
+		case c == '\\' && i+1 < end && text[i+1] == '\n':
+			flush()
+			out.WriteString("<br>\n")
+			i += 2
+			continue
+		case c == '`':
+			run := len(text[i:end]) - len(strings.TrimLeft(text[i:end], "`"))
+			delimiter := text[i : i+run]
+			if !unclosedCode[run] {
+				if closing := strings.Index(text[i+run:end], delimiter); closing >= 0 {
+					code := strings.TrimSpace(strings.Replace(text[i+run:i+run+closing], "\n", " ", -1))
+					flush()
+					out.WriteString("<code>" + html.EscapeString(code) + "</code>")
+					i += run + closing + run
+					continue
+				}
+				unclosedCode[run] = true
+			}
+			plain.WriteString(delimiter)
+			i += run
+			continue
+		case strings.HasPrefix(text[i:end], "[[") && !unclosedWikiLink:
+			// the first ]] after a wiki link that failed is also the first
+			// after any later [[ before it
+			if wikiLinkEnd < i+2 {
+				wikiLinkEnd = strings.Index(text[i+2:end], "]]")
+				if wikiLinkEnd >= 0 {
+					wikiLinkEnd += i + 2
+				}
+			}
+			if wikiLinkEnd < 0 {
+				unclosedWikiLink = true
+			} else if link, ok := m.renderWikiLink(text[i+2:wikiLinkEnd], depth); ok {
+				flush()
+				out.WriteString(link)
+				i = wikiLinkEnd + 2
+				continue
+			}
+		case (c == '[' || (c == '!' && strings.HasPrefix(text[i+1:end], "["))) && depth < maxNesting:
+			if link, length, ok := m.renderLink(text, matches, i, end, depth); ok {
+				flush()
+				out.WriteString(link)
+				i += length
+				continue
+			}
+		case (c == '*' || c == '_') && depth < maxNesting:
+			if span, length, ok := m.renderEmphasis(text, matches, start, i, end, depth, unclosedEmphasis); ok {
+				flush()
+				out.WriteString(span)
+				i += length
+				continue
+			}
+		}
+
+		plain.WriteByte(c)
+		i++
+	}
+	flush()
+
+	return out.String()
+}
+
+// matchBrackets returns for every opening bracket and parenthesis in text
+// the position of the one closing it, or -1. Brackets escaped with a
+// backslash are skipped, but parentheses are not, as in link targets.
+func matchBrackets(text string) []int {
+	matches := make([]int, len(text))
+	brackets, parentheses := []int{}, []int{}
+	escaped := false
+	for i := 0; i < len(text); i++ {
+		matches[i] = -1
+		switch c := text[i]; {
+		case c == '(':
+			parentheses = append(parentheses, i)
+		case c == ')' && len(parentheses) > 0:
+			matches[parentheses[len(parentheses)-1]] = i
+			parentheses = parentheses[:len(parentheses)-1]
+		case escaped:
+		case c == '[':
+			brackets = append(brackets, i)
+		case c == ']' && len(brackets) > 0:
+			matches[brackets[len(brackets)-1]] = i
+			brackets = brackets[:len(brackets)-1]
+		}
+		escaped = !escaped && text[i] == '\\'
+	}
+
+	return matches
+}
+
+// renderWikiLink renders the inside of a [[Title]] or [[Title|label]] link
+// nested depth deep.
+func (m *markdownRenderer) renderWikiLink(inside string, depth int) (string, bool) {
+	parts := strings.SplitN(inside, "|", 2)
+	title := NormalizeTitle(strings.TrimSpace(parts[0]))
+	if !ValidTitle(title) {
+		return "", false
+	}
+
+	label := html.EscapeString(defaultDisplayTitle(title))
+	if len(parts) == 2 && len(strings.TrimSpace(parts[1])) != 0 {
+		text := strings.TrimSpace(parts[1])
+		label = m.renderSpans(text, matchBrackets(text), 0, len(text), depth+1)
+	}
+
+	class := "wikilink"
+	if m.exists != nil && !m.exists(title) {
+		class += " missing"
+	}
+
+	return fmt.Sprintf("<a href=\"%s\" class=\"%s\">%s</a>", html.EscapeString(pageURL(title)), class, label), true
+}
+
+// renderLink renders a [text](target) link or ![alt](target) image at
+// text[i], ending before text[end], returning its HTML and length.
+// matches are the brackets of text matched by matchBrackets; a bracket
+// matched at or after end is not closed within the span.
+func (m *markdownRenderer) renderLink(text string, matches []int, i, end, depth int) (string, int, bool) {
+	image := text[i] == '!'
+	open := i
+	if image {
+		open++
+	}
+
+	// the closing bracket, allowing nested brackets in the text, and the
+	// closing parenthesis, allowing balanced ones in the target
+	label := matches[open]
+	if label < 0 || label+1 >= end || text[label+1] != '(' || matches[label+1] < 0 || matches[label+1] >= end {
+		return "", 0, false
+	}
+	closing := matches[label+1]
+
+	destination := strings.Fields(text[label+2 : closing])
+	length := closing + 1 - i
+	target := ""
+	if len(destination) > 0 {
+		target = strings.TrimSuffix(strings.TrimPrefix(destination[0], "<"), ">")
+	}
+
+	if !safeURL(target) {
+		// keep the text of links to unsafe targets
+		if image {
+			return html.EscapeString(text[open+1 : label]), length, true
+		}
+		return m.renderSpans(text, matches, open+1, label, depth+1), length, true
+	}
+	if image {
+		return fmt.Sprintf("<img src=\"%s\" alt=\"%s\">", html.EscapeString(target), html.EscapeString(text[open+1:label])), length, true
+	}
+
+	return fmt.Sprintf("<a href=\"%s\">%s</a>", html.EscapeString(target), m.renderSpans(text, matches, open+1, label, depth+1)), length, true
+}
+
+// renderEmphasis renders the *emphasis* or **strong emphasis** starting at
+// text[i], within the span text[start:end], returning its HTML and length.
+// Delimiters found not to be closed in the rest of the span are added to
+// unclosed and not searched for again.
+func (m *markdownRenderer) renderEmphasis(text string, matches []int, start, i, end, depth int, unclosed map[string]bool) (string, int, bool) {
+	c := text[i]
+	delimiter := string(c)
+	tag := "em"
+	if strings.HasPrefix(text[i:end], delimiter+delimiter) {
+		delimiter += delimiter
+		tag = "strong"
+	}
+
+	// underscores inside words are not emphasis
+	if c == '_' && i > start && isWordByte(text[i-1]) {
+		return "", 0, false
+	}
+
+	inner := i + len(delimiter)
+	if inner >= end || text[inner] == ' ' || text[inner] == '\n' || unclosed[delimiter] {
+		return "", 0, false
+	}
+
+	for j := inner + 1; j+len(delimiter) <= end; j++ {
+		if text[j] == '\\' {
+			j++
+			continue
+		}
+		if text[j] == '`' {
+			// skip code spans
+			if closing := strings.IndexByte(text[j+1:end], '`'); closing >= 0 {
+				j += closing + 1
+			}
+			continue
+		}
+		if !strings.HasPrefix(text[j:end], delimiter) || text[j-1] == ' ' || text[j-1] == '\n' {
+			continue
+		}
+		if len(delimiter) == 1 && strings.HasPrefix(text[j:end], delimiter+delimiter) {
+			// the start of a nested strong span
+			j++
+			continue
+		}
+		if c == '_' && j+len(delimiter) < end && isWordByte(text[j+len(delimiter)]) {
+			continue
+		}
+
+		return "<" + tag + ">" + m.renderSpans(text, matches, inner, j, depth+1) + "</" + tag + ">", j + len(delimiter) - i, true
+	}
+	unclosed[delimiter] = true
+
+	return "", 0, false
+}
+
+// renderPage renders the body of p, resolving its wiki links in store.
+func renderPage(store PageStore, p *Page) string {
+	return renderMarkdown(p.Body, func(title string) bool {
+		_, err := store.Get(title)
+		return err == nil
+	})
+}
+
+// renderHTMLDocument renders p as a standalone HTML document.
+func renderHTMLDocument(store PageStore, p *Page) string {
+	title := p.DisplayTitle
+	if len(title) == 0 {
+		title = defaultDisplayTitle(p.Title)
+	}
+
+	return "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>" + html.EscapeString(title) + "</title>\n</head>\n<body>\n" + renderPage(store, p) + "</body>\n</html>\n"
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	exists := func(title string) bool { return title == "Home" || title == "Team/Runbook" }
+
+	tests := []struct {
+		markdown string
+		expected string
+	}{
+		{"# Title\n\n## Sub *title* ##", "<h1>Title</h1>\n<h2>Sub <em>title</em></h2>\n"},
+		{"Some **bold**, _em_ and `co<de>`\nnext line", "<p>Some <strong>bold</strong>, <em>em</em> and <code>co&lt;de&gt;</code>\nnext line</p>\n"},
+		{"snake_case_name and 2 * 3 * 4", "<p>snake_case_name and 2 * 3 * 4</p>\n"},
+		{"- one\n- two\n  - nested\n- three", "<ul>\n<li>one</li>\n<li>two\n<ul>\n<li>nested</li>\n</ul></li>\n<li>three</li>\n</ul>\n"},
+		{"1. first\n2. second", "<ol>\n<li>first</li>\n<li>second</li>\n</ol>\n"},
+		{"```go\nfmt.Println(\"<hi>\")\n```", "<pre><code class=\"language-go\">fmt.Println(&#34;&lt;hi&gt;&#34;)\n</code></pre>\n"},
+		{"    indented\n    code", "<pre><code>indented\ncode\n</code></pre>\n"},
+		{"> quoted\n> text", "<blockquote>\n<p>quoted\ntext</p>\n</blockquote>\n"},
+		{"| A | B |\n|:--|--:|\n| 1 | 2 |", "<table>\n<thead>\n<tr><th style=\"text-align: left\">A</th><th style=\"text-align: right\">B</th></tr>\n</thead>\n<tbody>\n<tr><td style=\"text-align: left\">1</td><td style=\"text-align: right\">2</td></tr>\n</tbody>\n</table>\n"},
+		{"---", "<hr>\n"},
+		{"[[Home]], [[Team/Runbook|the runbook]] and [[Nowhere]]", "<p><a href=\"/page/Home\" class=\"wikilink\">Home</a>, <a href=\"/page/Team/Runbook\" class=\"wikilink\">the runbook</a> and <a href=\"/page/Nowhere\" class=\"wikilink missing\">Nowhere</a></p>\n"},
+		{"[site](https://example.com/?a=1&b=2) ![logo](/logo.png)", "<p><a href=\"https://example.com/?a=1&amp;b=2\">site</a> <img src=\"/logo.png\" alt=\"logo\"></p>\n"},
+		{"café ünïcode | not a table", "<p>café ünïcode | not a table</p>\n"},
+		{"[a [nested] label](/x_(y)) and \\[not](/a link)", "<p><a href=\"/x_(y)\">a [nested] label</a> and [not](/a link)</p>\n"},
+		{"| a \\| b | c |\n|---|---|\n| 1 | 2 |", "<table>\n<thead>\n<tr><th>a | b</th><th>c</th></tr>\n</thead>\n<tbody>\n<tr><td>1</td><td>2</td></tr>\n</tbody>\n</table>\n"},
+
+		// sanitising
+		{"<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"[click](javascript:alert(1))", "<p>click</p>\n"},
+		{"[x](\"onmouseover=\"alert(1))", "<p><a href=\"&#34;onmouseover=&#34;alert(1)\">x</a></p>\n"},
+		{"![x](data:text/html;base64,PHNjcmlwdD4=)", "<p>x</p>\n"},
+	}
+	for _, test := range tests {
+		if html := renderMarkdown(test.markdown, exists); html != test.expected {
+			t.Errorf("rendering %q got\n%s\nexpected\n%s", test.markdown, html, test.expected)
+		}
+	}
+}
+
+// renderTime returns the shortest of a few renderings of markdown, leaving
+// out pauses such as garbage collection.
+func renderTime(markdown string) time.Duration {
+	shortest := time.Duration(0)
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		renderMarkdown(markdown, nil)
+		if elapsed := time.Since(start); i == 0 || elapsed < shortest {
+			shortest = elapsed
+		}
+	}
+
+	return shortest
+}
+
+// CheckLinearRendering renders inputs of size n and 4n made by generate.
+// Rendering in linear time takes about four times as long for the larger
+// one, and in quadratic time sixteen times as long, whatever the speed of
+// the machine.
+func CheckLinearRendering(name string, generate func(n int) string, n int, t *testing.T) {
+	small, large := generate(n), generate(4*n)
+	if html := renderMarkdown(large, nil); len(html) == 0 {
+		t.Errorf("rendering %s got no HTML", name)
+	}
+
+	if smallTime, largeTime := renderTime(small), renderTime(large); largeTime > 10*smallTime {
+		t.Errorf("rendering %s took %v for %d bytes and %v for %d bytes, expected linear time", name, smallTime, len(small), largeTime, len(large))
+	}
+}
+
+func TestRenderMarkdownLarge(t *testing.T) {
+	// inputs that are slow to render if text is searched again for every
+	// delimiter
+	for name, generate := range map[string]func(n int) string{
+		"plain":      func(n int) string { return strings.Repeat("plain text ", n) },
+		"emphasis":   func(n int) string { return strings.Repeat("*a _b ", n) },
+		"strong":     func(n int) string { return strings.Repeat("**a __b ", n) },
+		"code":       func(n int) string { return strings.Repeat("`a ``b ", n) },
+		"brackets":   func(n int) string { return strings.Repeat("[", 4*n) },
+		"links":      func(n int) string { return strings.Repeat("[a](", n) },
+		"wiki links": func(n int) string { return strings.Repeat("[[a ", n) },
+		"table":      func(n int) string { return "| a | b |\n|---|---|\n| " + strings.Repeat("cell ", 2*n) + " |" },
+	} {
+		CheckLinearRendering(name, generate, 5000, t)
+	}
+}
+
+func TestRenderMarkdownNested(t *testing.T) {
+	// inputs that are slow to render if nested spans and blocks are
+	// parsed again at every level
+	for name, generate := range map[string]func(n int) string{
+		"links":        func(n int) string { return strings.Repeat("[", n) + "a" + strings.Repeat("](x)", n) },
+		"images":       func(n int) string { return strings.Repeat("![", n) + "a" + strings.Repeat("](x)", n) },
+		"emphasis":     func(n int) string { return strings.Repeat("*a __b ", n/2) + strings.Repeat("b__ a* ", n/2) },
+		"list markers": func(n int) string { return strings.Repeat(strings.Repeat("- ", n/10)+"item\n", 50) },
+	} {
+		CheckLinearRendering(name, generate, 4000, t)
+	}
+
+	// markup nested too deeply is kept as text
+	link := strings.Repeat("[a ", maxNesting+1) + "b" + strings.Repeat("](x)", maxNesting+1)
+	if html := renderMarkdown(link, nil); strings.Count(html, "<a ") != maxNesting || !strings.Contains(html, "[a b](x)") {
+		t.Errorf("rendering deeply nested links got %s", html)
+	}
+	list := strings.Repeat("- ", maxNesting+1) + "item"
+	if html := renderMarkdown(list, nil); strings.Count(html, "<ul>") != maxNesting || !strings.Contains(html, "<li>- item</li>") {
+		t.Errorf("rendering deeply nested lists got %s", html)
+	}
+}
+
+func TestPageGetNegotiated(t *testing.T) {
+	store := NewMemoryPageStore()
+	p := &Page{Title: "TestPage", Body: "# Test\n\nSee [[OtherPage]] <b>now</b>."}
+	if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("creating test page returned error %v", err)
+	}
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	for _, test := range []struct {
+		accept      string
+		code        int
+		contentType string
+		contains    string
+	}{
+		{"", 200, "text/json; charset=utf-8", "\"body\":"},
+		{"application/json", 200, "application/json; charset=utf-8", "\"body\":"},
+		{"text/html, application/json;q=0.9", 200, "text/html; charset=utf-8", "<h1>Test</h1>\n<p>See <a href=\"/page/OtherPage\" class=\"wikilink missing\">OtherPage</a> &lt;b&gt;now&lt;/b&gt;.</p>"},
+		{"text/markdown", 200, "text/markdown; charset=utf-8", "# Test\n\nSee [[OtherPage]] <b>now</b>."},
+		{"text/plain;q=0.5, text/html;q=0.1", 200, "text/plain; charset=utf-8", "<b>now</b>"},
+		{"image/png", 406, "text/json; charset=utf-8", "errors"},
+	} {
+		r, _, _ := MakeRequestWithHeaders(router, "GET", "/page/TestPage", nil, map[string]string{"Accept": test.accept}, a)
+		if r.Code != test.code {
+			t.Errorf("got response code = %d for %q, expected %d", r.Code, test.accept, test.code)
+		}
+		if contentType := r.Header().Get("Content-Type"); contentType != test.contentType {
+			t.Errorf("got content type %s for %q, expected %s", contentType, test.accept, test.contentType)
+		}
+		if !strings.Contains(r.Body.String(), test.contains) {
+			t.Errorf("got body %s for %q, expected it to contain %s", r.Body.String(), test.accept, test.contains)
+		}
+	}
+
+	// the JSON can include the rendered body
+	_, dat, err := MakeRequest(router, "GET", "/page/TestPage?rendered=true", nil, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if rendered, _ := dat["rendered"].(string); !strings.HasPrefix(rendered, "<h1>Test</h1>") {
+		t.Errorf("got rendered %q, expected HTML", rendered)
+	}
+
+	// representations of missing pages
+	if r, _, _ := MakeRequestWithHeaders(router, "GET", "/page/MissingPage", nil, map[string]string{"Accept": "text/html"}, a); r.Code != 404 {
+		t.Errorf("got response code = %d for missing page, expected %d", r.Code, 404)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+)
+
+// maxRedirects limits how many redirects are followed to reach a page.
+const maxRedirects = 5
+
+// followRedirect returns the page that p redirects to, following chains of
+// redirects, with RedirectedFrom set to p's title. A redirect to a missing
+// page, a loop or too long a chain stops at the last page reached.
+func followRedirect(store PageStore, p *Page) (*Page, error) {
+	from := p.Title
+	seen := map[string]bool{p.Title: true}
+	for i := 0; i < maxRedirects && len(p.Redirect) != 0 && !seen[p.Redirect]; i++ {
+		target, err := store.Get(p.Redirect)
+		if err == ErrPageNotFound {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		seen[target.Title] = true
+		p = target
+	}
+
+	if p.Title != from {
+		p.RedirectedFrom = from
+	}
+
+	return p, nil
+}
+
+type MoveRequest struct {
+	Destination string `json:"destination"`
+	// Redirect leaves a page at the old title redirecting to the new one.
+	Redirect bool `json:"redirect"`
+}
+
+// CreateMoveHandler renames a page, keeping its revisions, metadata and
+// attachments.
+func CreateMoveHandler(store PageStore, attachments AttachmentStore, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		title := GetTitle(r)
+
+		w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, POST")
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization, If-Match")
+
+		switch r.Method {
+		case "OPTIONS":
+			return
+		case "POST":
+			p, err := store.Get(title)
+			if err == ErrPageNotFound {
+				ReturnError(w, r, http.StatusNotFound, err)
+				return
+			} else if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			if err := CheckPreconditions(r, p.ETag()); err != nil {
+				ReturnError(w, r, http.StatusPreconditionFailed, err)
+				return
+			}
+
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			move := &MoveRequest{}
+			if err := json.Unmarshal(body, move); err != nil {
+				ReturnError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			destination := NormalizeTitle(move.Destination)
+			if len(destination) == 0 {
+				ReturnError(w, r, http.StatusBadRequest, errors.New("No destination provided"))
+				return
+			}
+			if !ValidTitle(destination) || destination == title {
+				ReturnError(w, r, http.StatusBadRequest, ErrInvalidTitle)
+				return
+			}
+
+			err = authoredStore(store, r).Move(title, destination)
+			if err == ErrPageExists {
+				ReturnError(w, r, http.StatusConflict, err)
+				return
+			} else if err == ErrInvalidTitle {
+				ReturnError(w, r, http.StatusBadRequest, err)
+				return
+			} else if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			if err := attachments.Move(title, destination); err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			if move.Redirect {
+				stub := &Page{Title: title, Redirect: destination}
+				if err := stub.Save(store, &Revision{Author: authenticatedUser(r)}); err != nil {
+					ReturnError(w, r, http.StatusInternalServerError, err)
+					return
+				}
+			}
+
+			p, err = loadPage(store, destination)
+			if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			jsonResponse, _ := json.Marshal(p)
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			w.Write(jsonResponse)
+		}
+	}
+}
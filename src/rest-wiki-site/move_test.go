@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMovePost(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// create test page with two revisions
+	p := &Page{Title: "TestPage", Body: "Test result"}
+	for _, body := range []string{"Test result", "Test result updated"} {
+		p.Body = body
+		if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("creating test page returned error %v", err)
+		}
+	}
+	other := &Page{Title: "OtherPage", Body: "Test result"}
+	if err := other.Save(store, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("creating test page returned error %v", err)
+	}
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	// invalid moves
+	for destination, code := range map[string]int{
+		"":          400,
+		"TestPage":  400,
+		"../Secret": 400,
+		"OtherPage": 409,
+	} {
+		postBytes, err := json.Marshal(map[string]string{"destination": destination})
+		if err != nil {
+			t.Fatalf("serializing post data returned error %v", err)
+		}
+		if r, _, err := MakeRequest(router, "POST", "/page/TestPage/move", postBytes, a); err != nil {
+			t.Fatalf("running request returned error %v", err)
+		} else if r.Code != code {
+			t.Errorf("got response code = %d moving to %q, expected %d", r.Code, destination, code)
+		}
+	}
+	if r, _, err := MakeRequest(router, "POST", "/page/MissingPage/move", []byte(`{"destination":"NewPage"}`), a); err != nil {
+		t.Fatalf("running request returned error %v", err)
+	} else if r.Code != 404 {
+		t.Errorf("got response code = %d moving missing page, expected %d", r.Code, 404)
+	}
+
+	// move, leaving a redirect
+	postBytes, err := json.Marshal(map[string]interface{}{"destination": "Archive/TestPage", "redirect": true})
+	if err != nil {
+		t.Fatalf("serializing post data returned error %v", err)
+	}
+	r, dat, err := MakeRequest(router, "POST", "/page/TestPage/move", postBytes, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+
+	// authorization headers
+	CheckAuthHeader("test", "test", r, t)
+
+	if title, _ := dat["title"].(string); title != "Archive/TestPage" {
+		t.Errorf("got title %s, expected %s", title, "Archive/TestPage")
+	}
+	CheckMetadata(dat["metadata"], "test", len("Test result updated"), 2, t)
+	if revisions, err := store.Revisions("Archive/TestPage"); err != nil || len(revisions) != 2 {
+		t.Errorf("got revisions %v and error %v for moved page, expected %d", revisions, err, 2)
+	}
+
+	// the old title redirects
+	_, dat, err = MakeRequest(router, "GET", "/page/TestPage", nil, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if title, _ := dat["title"].(string); title != "Archive/TestPage" {
+		t.Errorf("got title %s following redirect, expected %s", title, "Archive/TestPage")
+	}
+	if from, _ := dat["redirectedFrom"].(string); from != "TestPage" {
+		t.Errorf("got redirected from %s, expected %s", from, "TestPage")
+	}
+	if body, _ := dat["body"].(string); body != "Test result updated" {
+		t.Errorf("got body %s following redirect, expected %s", body, "Test result updated")
+	}
+
+	_, dat, err = MakeRequest(router, "GET", "/page/TestPage?redirect=no", nil, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if target, _ := dat["redirect"].(string); target != "Archive/TestPage" {
+		t.Errorf("got redirect %s, expected %s", target, "Archive/TestPage")
+	}
+	if _, ok := dat["redirectedFrom"]; ok {
+		t.Errorf("got redirected from %v without following, expected none", dat["redirectedFrom"])
+	}
+
+	// move without a redirect
+	if _, _, err := MakeRequest(router, "POST", "/page/OtherPage/move", []byte(`{"destination":"Archive/OtherPage"}`), a); err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if _, err := store.Get("OtherPage"); err != ErrPageNotFound {
+		t.Errorf("got error %v loading old title, expected %v", err, ErrPageNotFound)
+	}
+}
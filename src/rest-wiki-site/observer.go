@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+)
+
+// PageListener is told about every change made through an
+// ObservedPageStore, after the change has been stored.
+type PageListener interface {
+	PageSaved(p *Page)
+	PageRemoved(title string)
+}
+
+// ObservedPageStore passes every call through to PageStore and notifies
+// its listeners of saved, deleted, restored and moved pages, so that
+// indexes built over the store stay current. Each change is stored and
+// notified under one lock, so that listeners are told of changes in the
+// order they were stored.
+type ObservedPageStore struct {
+	PageStore
+
+	mu        *sync.Mutex
+	listeners []PageListener
+}
+
+func NewObservedPageStore(store PageStore, listeners ...PageListener) *ObservedPageStore {
+	return &ObservedPageStore{PageStore: store, mu: &sync.Mutex{}, listeners: listeners}
+}
+
+func (s *ObservedPageStore) Put(p *Page, r *Revision) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.PageStore.Put(p, r); err != nil {
+		return err
+	}
+
+	for _, l := range s.listeners {
+		l.PageSaved(p)
+	}
+
+	return nil
+}
+
+func (s *ObservedPageStore) Delete(title string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.PageStore.Delete(title); err != nil {
+		return err
+	}
+
+	for _, l := range s.listeners {
+		l.PageRemoved(title)
+	}
+
+	return nil
+}
+
+func (s *ObservedPageStore) Move(title string, destination string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.PageStore.Move(title, destination); err != nil {
+		return err
+	}
+
+	p, err := s.PageStore.Get(destination)
+	if err != nil {
+		return err
+	}
+	for _, l := range s.listeners {
+		l.PageRemoved(title)
+		l.PageSaved(p)
+	}
+
+	return nil
+}
+
+func (s *ObservedPageStore) Restore(title string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.PageStore.Restore(title); err != nil {
+		return err
+	}
+
+	p, err := s.PageStore.Get(title)
+	if err != nil {
+		return err
+	}
+	for _, l := range s.listeners {
+		l.PageSaved(p)
+	}
+
+	return nil
+}
+
+// ForAuthor attributes changes to author in the underlying store, if it
+// records authors.
+func (s *ObservedPageStore) ForAuthor(author string) PageStore {
+	store := s.PageStore
+	if authored, ok := store.(AuthoredPageStore); ok {
+		store = authored.ForAuthor(author)
+	}
+
+	return &ObservedPageStore{PageStore: store, mu: s.mu, listeners: s.listeners}
+}
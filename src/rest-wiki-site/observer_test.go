@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pausedPageStore holds its first save after storing it until resumed.
+type pausedPageStore struct {
+	PageStore
+	stored  chan bool
+	resumed chan bool
+	saves   int32
+}
+
+func (s *pausedPageStore) Put(p *Page, r *Revision) error {
+	err := s.PageStore.Put(p, r)
+	if atomic.AddInt32(&s.saves, 1) == 1 {
+		s.stored <- true
+		<-s.resumed
+	}
+
+	return err
+}
+
+// lastSavedListener records the body of the last page it was told of.
+type lastSavedListener struct {
+	mu   sync.Mutex
+	body string
+}
+
+func (l *lastSavedListener) PageSaved(p *Page) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.body = p.Body
+}
+
+func (l *lastSavedListener) PageRemoved(title string) {}
+
+func TestObservedPageStoreOrder(t *testing.T) {
+	paused := &pausedPageStore{PageStore: NewMemoryPageStore(), stored: make(chan bool), resumed: make(chan bool)}
+	listener := &lastSavedListener{}
+	store := NewObservedPageStore(paused, listener)
+
+	// the second save is stored after the first, so listeners must hear of
+	// it last, even while the first is still being notified
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := store.Put(&Page{Title: "TestPage", Body: "first"}, &Revision{Author: "test"}); err != nil {
+			t.Errorf("saving page returned error %v", err)
+		}
+	}()
+	<-paused.stored
+	go func() {
+		defer wg.Done()
+		if err := store.ForAuthor("other").Put(&Page{Title: "TestPage", Body: "second"}, &Revision{Author: "other"}); err != nil {
+			t.Errorf("saving page returned error %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	paused.resumed <- true
+	wg.Wait()
+
+	if p, err := paused.Get("TestPage"); err != nil || p.Body != listener.body {
+		t.Errorf("got stored page %+v, %v and last notified body %q, expected them to match", p, err, listener.body)
+	}
+}
@@ -3,163 +3,231 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"github.com/gorilla/mux"
+	"errors"
 	"io/ioutil"
 	"net/http"
-	"os"
 	"regexp"
 	"strings"
+	"time"
 )
 
 var validPath = regexp.MustCompile("^/(edit|save|view)/([a-zA-Z0-9]+)$")
 
 type Page struct {
-	Title string `json:"title"`
-	Body  string `json:"body,omitempty"`
+	Title          string        `json:"title"`
+	DisplayTitle   string        `json:"displayTitle,omitempty"`
+	Redirect       string        `json:"redirect,omitempty"`
+	Body           string        `json:"body,omitempty"`
+	Tags           []string      `json:"tags,omitempty"`
+	Excerpt        string        `json:"excerpt,omitempty"`
+	Metadata       *PageMetadata `json:"metadata,omitempty"`
+	Breadcrumbs    []*Breadcrumb `json:"breadcrumbs,omitempty"`
+	RedirectedFrom string        `json:"redirectedFrom,omitempty"`
+	Rendered       string        `json:"rendered,omitempty"`
 }
 
-func (p *Page) Filename() string {
-	return "data/" + p.Title + ".txt"
+// PageMetadata is maintained by the store on every save and cannot be set
+// by clients.
+type PageMetadata struct {
+	Created   time.Time `json:"created"`
+	Modified  time.Time `json:"modified"`
+	Author    string    `json:"author"`
+	Size      int       `json:"size"`
+	Revisions int       `json:"revisions"`
 }
 
-func (p *Page) Exists() bool {
-	filename := p.Filename()
-
-	// make sure directory exists
-	switch _, err := os.Stat("data/"); {
-	case err != nil && os.IsNotExist(err):
-		os.Mkdir("data", 0600)
-	case err != nil:
-		panic(err)
+// Modified returns when the page was last saved, if known.
+func (p *Page) Modified() time.Time {
+	if p.Metadata == nil {
+		return time.Time{}
 	}
 
-	if _, err := os.Stat(filename); err != nil {
-		return false
-	} else {
-		return true
-	}
+	return p.Metadata.Modified
+}
+
+// ETag identifies the page's current content: every field a client can
+// change, but not the metadata or what is derived from the body.
+func (p *Page) ETag() string {
+	content, _ := json.Marshal(&Page{Title: p.Title, DisplayTitle: p.DisplayTitle, Redirect: p.Redirect, Body: p.Body, Tags: p.Tags})
+
+	return computeETag(content)
 }
 
-func (p *Page) Load() error {
-	if !p.Exists() {
-		return nil
+// HasTags reports whether the page has all (or, if any is set, at least
+// one) of tags.
+func (p *Page) HasTags(tags []string, any bool) bool {
+	for _, tag := range tags {
+		found := false
+		for _, pagetag := range p.Tags {
+			if pagetag == normalizeTag(tag) {
+				found = true
+				break
+			}
+		}
+
+		if found && any {
+			return true
+		} else if !found && !any {
+			return false
+		}
 	}
 
-	filename := p.Filename()
+	return !any || len(tags) == 0
+}
+
+func (p *Page) Exists(store PageStore) bool {
+	_, err := store.Get(p.Title)
 
-	// read file
-	body, err := ioutil.ReadFile(filename)
+	return err == nil
+}
+
+// Load fills in the page from store, or leaves it empty and returns
+// ErrPageNotFound if it is not stored.
+func (p *Page) Load(store PageStore) error {
+	stored, err := store.Get(p.Title)
 	if err != nil {
 		return err
 	}
 
-	p.Body = string(body)
+	p.DisplayTitle = stored.DisplayTitle
+	p.Redirect = stored.Redirect
+	p.Body = stored.Body
+	p.Tags = stored.Tags
+	p.Metadata = stored.Metadata
 
 	return nil
 }
 
-func (p *Page) Save() error {
-	filename := p.Filename()
-
-	// make sure directory exists
-	switch _, err := os.Stat("data/"); {
-	case err != nil && os.IsNotExist(err):
-		os.Mkdir("data", 0600)
-	case err != nil:
-		panic(err)
+// Save stores the page and records it as a new revision described by r.
+func (p *Page) Save(store PageStore, r *Revision) error {
+	if err := p.validate(); err != nil {
+		return err
 	}
 
-	return ioutil.WriteFile(filename, []byte(p.Body), 0600)
+	r.Timestamp = time.Now().UTC()
+	r.Body = p.Body
+	r.Tags = p.Tags
+
+	return store.Put(p, r)
 }
 
-func (p *Page) Delete() error {
-	if !p.Exists() {
-		return nil
+// validate normalizes the page's title, display title, redirect and tags
+// and checks that they can be stored.
+func (p *Page) validate() error {
+	p.Title = NormalizeTitle(p.Title)
+	if !ValidTitle(p.Title) {
+		return ErrInvalidTitle
+	}
+	p.DisplayTitle = NormalizeTitle(strings.TrimSpace(p.DisplayTitle))
+	if len(p.Redirect) != 0 {
+		p.Redirect = NormalizeTitle(p.Redirect)
+		if !ValidTitle(p.Redirect) || p.Redirect == p.Title {
+			return ErrInvalidTitle
+		}
 	}
+	p.Tags = normalizeTags(p.Tags)
 
-	filename := p.Filename()
+	return nil
+}
+
+func (p *Page) Delete(store PageStore) error {
+	if err := store.Delete(p.Title); err != nil && err != ErrPageNotFound {
+		return err
+	}
 
-	return os.Remove(filename)
+	return nil
 }
 
-func loadPage(title string) (*Page, error) {
+func loadPage(store PageStore, title string) (*Page, error) {
 	p := &Page{Title: title}
 
-	if err := p.Load(); err != nil {
+	if err := p.Load(store); err != nil {
 		return p, err
 	}
 
 	return p, nil
 }
 
-type Pages struct {
-	Items []*Page `json:"items"`
-}
-
-func getPages() (*Pages, error) {
-	directory := "data/"
-
-	// make sure directory exists
-	switch _, err := os.Stat(directory); {
-	case err != nil && os.IsNotExist(err):
-		os.Mkdir("data", 0600)
-	case err != nil:
-		panic(err)
-	}
-
-	if files, err := ioutil.ReadDir(directory); err != nil {
-		return nil, err
-	} else {
-		results := &Pages{}
-		for _, file := range files {
-			thispage := &Page{Title: strings.Split(file.Name(), ".")[0]}
-			results.Items = append(results.Items, thispage)
+func CreatePageHandler(store PageStore, attachments AttachmentStore, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := loadPage(store, GetTitle(r))
+		status := http.StatusOK
+
+		// the etag of the stored page, if there is one
+		etag := ""
+		if err == nil {
+			etag = p.ETag()
+		} else if err == ErrPageNotFound {
+			err = nil
 		}
 
-		return results, nil
-	}
-}
-
-func CreatePageListHandler(allowOrigins string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS, POST, PUT, PATCH, DELETE")
 		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization, If-Match, If-None-Match, If-Modified-Since")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Last-Modified, Location")
 
 		switch r.Method {
 		case "OPTIONS":
 			return
-		case "GET":
-			if pages, err := getPages(); err != nil {
-				ReturnError(w, r, http.StatusInternalServerError, err)
+		case "GET", "HEAD":
+			if err != nil {
+				http.NotFound(w, r)
 				return
-			} else {
-				jsonResponse, _ := json.Marshal(pages)
-				w.Header().Set("Content-Type", "text/json; charset=utf-8")
-				w.Write(jsonResponse)
 			}
-		}
-	}
-}
-
-func CreatePageHandler(allowOrigins string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		p, err := loadPage(vars["title"])
+			// follow redirects unless asked for the redirecting page itself
+			if len(p.Redirect) != 0 && r.URL.Query().Get("redirect") != "no" {
+				if p, err = followRedirect(store, p); err != nil {
+					ReturnError(w, r, http.StatusInternalServerError, err)
+					return
+				}
+				etag = p.ETag()
+			}
+			w.Header().Set("Vary", "Accept")
 
-		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS, POST, DELETE")
-		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization")
+			switch mediatype := NegotiateContentType(r.Header.Get("Accept"), "text/json", "application/json", "text/html", "text/markdown", "text/plain"); mediatype {
+			case "":
+				ReturnError(w, r, http.StatusNotAcceptable, errors.New("Pages are available as JSON, HTML, Markdown or plain text"))
+				return
+			case "text/html", "text/markdown", "text/plain":
+				if len(etag) == 0 {
+					http.NotFound(w, r)
+					return
+				}
+
+				content := []byte(p.Body)
+				if mediatype == "text/html" {
+					content = []byte(renderHTMLDocument(store, p))
+				}
+				if CheckNotModified(w, r, computeETag(content), p.Modified()) {
+					return
+				}
+
+				w.Header().Set("Content-Type", mediatype+"; charset=utf-8")
+				w.Write(content)
+				return
+			case "application/json":
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			}
 
-		switch r.Method {
-		case "OPTIONS":
-			return
-		case "GET":
-			if err != nil {
+			if r.URL.Query().Get("rendered") == "true" {
+				p.Rendered = renderPage(store, p)
+				if len(etag) != 0 {
+					etag = computeETag([]byte(etag + p.Rendered))
+				}
+			}
+			if len(etag) != 0 && CheckNotModified(w, r, etag, p.Modified()) {
+				return
+			}
+		case "POST", "PUT", "PATCH":
+			if r.Method == "PATCH" && len(etag) == 0 {
 				http.NotFound(w, r)
 				return
 			}
-		case "POST":
+			if err := CheckPreconditions(r, etag); err != nil {
+				ReturnError(w, r, http.StatusPreconditionFailed, err)
+				return
+			}
+
 			body, err := ioutil.ReadAll(r.Body)
 			if err != nil {
 				ReturnError(w, r, http.StatusInternalServerError, err)
@@ -167,30 +235,71 @@ func CreatePageHandler(allowOrigins string) http.HandlerFunc {
 			}
 			r.Body = ioutil.NopCloser(bytes.NewReader(body))
 
-			err = json.Unmarshal(body, p)
+			// POST updates the fields it is given, PUT replaces the page
+			// and PATCH patches it
+			var content *PageContent
+			switch r.Method {
+			case "POST":
+				content = p.Content()
+				err = json.Unmarshal(body, content)
+				content.Append = ""
+			case "PUT":
+				content, err = readPageContent(r, body)
+			case "PATCH":
+				content, err = patchPageContent(r, body, p.Content())
+			}
 			if err != nil {
-				ReturnError(w, r, http.StatusInternalServerError, err)
+				ReturnError(w, r, http.StatusBadRequest, err)
 				return
 			}
+			p.SetContent(content)
 
-			err = p.Save()
-			if err != nil {
+			err = p.Save(store, &Revision{Author: authenticatedUser(r)})
+			if err == ErrInvalidTitle {
+				ReturnError(w, r, http.StatusBadRequest, err)
+				return
+			} else if err != nil {
 				ReturnError(w, r, http.StatusInternalServerError, err)
 				return
 			}
+			if r.Method == "PUT" && len(etag) == 0 {
+				status = http.StatusCreated
+				w.Header().Set("Location", pageURL(p.Title))
+			}
+			w.Header().Set("ETag", p.ETag())
 		case "DELETE":
-			err = p.Delete()
+			if err := CheckPreconditions(r, etag); err != nil {
+				ReturnError(w, r, http.StatusPreconditionFailed, err)
+				return
+			}
+
+			err = p.Delete(authoredStore(store, r))
 			if err != nil {
 				ReturnError(w, r, http.StatusInternalServerError, err)
 				return
 			}
 
+			// the attachments go to the trash with the page
+			if len(etag) != 0 {
+				if err := attachments.Move(p.Title, trashedAttachmentsTitle(p.Title)); err != nil {
+					ReturnError(w, r, http.StatusInternalServerError, err)
+					return
+				}
+			}
+
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
 
+		if len(p.DisplayTitle) == 0 {
+			p.DisplayTitle = defaultDisplayTitle(p.Title)
+		}
+		p.Breadcrumbs = getBreadcrumbs(store, p.Title)
 		jsonResponse, _ := json.Marshal(p)
-		w.Header().Set("Content-Type", "text/json; charset=utf-8")
+		if len(w.Header().Get("Content-Type")) == 0 {
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+		}
+		w.WriteHeader(status)
 		w.Write(jsonResponse)
 	}
 }
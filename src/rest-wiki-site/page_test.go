@@ -2,11 +2,13 @@ package main
 
 import (
 	"encoding/json"
-	"io/ioutil"
+	"github.com/gorilla/mux"
+	"net/http"
 	"net/http/httptest"
-	"os"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func CheckAuthHeader(expectedusername string, secret string, w *httptest.ResponseRecorder, t *testing.T) {
@@ -37,26 +39,37 @@ func CheckAuthHeader(expectedusername string, secret string, w *httptest.Respons
 	}
 }
 
-func TestPageListGet(t *testing.T) {
-	router := CreateRouter("test", 30*60, "test", "test", "*")
-
-	// remove extraneous files
-	if files, err := ioutil.ReadDir("data/"); err != nil {
-		t.Fatalf("getting file list returned error %v", err)
-	} else {
-		for _, file := range files {
-			if file.Name() != "TestPage.txt" {
-				if err := RemoveIfExists("data/" + file.Name()); err != nil {
-					t.Fatalf("deleting file returned error %v", err)
-				}
-			}
+func CheckMetadata(v interface{}, expectedauthor string, expectedsize int, expectedrevisions int, t *testing.T) {
+	metadata, ok := v.(map[string]interface{})
+	if !ok {
+		t.Fatalf("got metadata %v, expected an object", v)
+	}
+
+	for _, k := range []string{"created", "modified"} {
+		if value, _ := metadata[k].(string); len(value) == 0 || value == (time.Time{}).Format(time.RFC3339) {
+			t.Errorf("got %s %v, expected a time", k, metadata[k])
 		}
 	}
+	if author, _ := metadata["author"].(string); author != expectedauthor {
+		t.Errorf("got author %s, expected %s", author, expectedauthor)
+	}
+	if size, _ := metadata["size"].(float64); int(size) != expectedsize {
+		t.Errorf("got size %v, expected %d", metadata["size"], expectedsize)
+	}
+	if revisions, _ := metadata["revisions"].(float64); int(revisions) != expectedrevisions {
+		t.Errorf("got revisions %v, expected %d", metadata["revisions"], expectedrevisions)
+	}
+}
+
+func TestPageListGet(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
 
-	// create test file
-	err := ioutil.WriteFile("data/TestPage.txt", []byte("Test result"), 0600)
+	// create test page
+	p := &Page{Title: "TestPage", Body: "Test result"}
+	err := p.Save(store, &Revision{Author: "test"})
 	if err != nil {
-		t.Fatalf("creating test file returned error %v", err)
+		t.Fatalf("creating test page returned error %v", err)
 	}
 
 	// get authorization
@@ -99,12 +112,14 @@ func TestPageListGet(t *testing.T) {
 }
 
 func TestPageGet(t *testing.T) {
-	router := CreateRouter("test", 30*60, "test", "test", "*")
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
 
-	// create test file
-	err := ioutil.WriteFile("data/TestPage.txt", []byte("Test result"), 0600)
+	// create test page
+	p := &Page{Title: "TestPage", Body: "Test result"}
+	err := p.Save(store, &Revision{Author: "test"})
 	if err != nil {
-		t.Fatalf("creating test file returned error %v", err)
+		t.Fatalf("creating test page returned error %v", err)
 	}
 
 	// get authorization
@@ -123,7 +138,7 @@ func TestPageGet(t *testing.T) {
 	CheckAuthHeader("test", "test", r, t)
 
 	// required keys
-	for _, k := range []string{"title", "body"} {
+	for _, k := range []string{"title", "displayTitle", "body", "metadata"} {
 		if _, ok := dat[k]; !ok {
 			t.Errorf("no %s in response", k)
 		}
@@ -135,10 +150,16 @@ func TestPageGet(t *testing.T) {
 			if title := v.(string); title != "TestPage" {
 				t.Errorf("got title %s, expected %s", title, "TestPage")
 			}
+		case "displayTitle":
+			if title := v.(string); title != "TestPage" {
+				t.Errorf("got display title %s, expected %s", title, "TestPage")
+			}
 		case "body":
 			if body := v.(string); body != "Test result" {
 				t.Errorf("got body %s, expected %s", body, "Test result")
 			}
+		case "metadata":
+			CheckMetadata(v, "test", len("Test result"), 1, t)
 		default:
 			t.Errorf("unknown response key %s", k)
 		}
@@ -146,12 +167,8 @@ func TestPageGet(t *testing.T) {
 }
 
 func TestPagePostNew(t *testing.T) {
-	router := CreateRouter("test", 30*60, "test", "test", "*")
-
-	err := RemoveIfExists("data/TestPageNew.txt")
-	if err != nil {
-		t.Fatalf("removing existing test page returned error %v", err)
-	}
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
 
 	// get authorization
 	a, err := GetAuthorization(router)
@@ -175,7 +192,7 @@ func TestPagePostNew(t *testing.T) {
 	CheckAuthHeader("test", "test", r, t)
 
 	// required keys
-	for _, k := range []string{"title", "body"} {
+	for _, k := range []string{"title", "displayTitle", "body", "metadata"} {
 		if _, ok := dat[k]; !ok {
 			t.Errorf("no %s in response", k)
 		}
@@ -187,29 +204,38 @@ func TestPagePostNew(t *testing.T) {
 			if title := v.(string); title != "TestPageNew" {
 				t.Errorf("got title %s, expected %s", title, "TestPage")
 			}
+		case "displayTitle":
+			if title := v.(string); title != "TestPageNew" {
+				t.Errorf("got display title %s, expected %s", title, "TestPageNew")
+			}
 		case "body":
 			if body := v.(string); body != "Test result" {
 				t.Errorf("got body %s, expected %s", body, "Test result")
 			}
+		case "metadata":
+			CheckMetadata(v, "test", len("Test result"), 1, t)
 		default:
 			t.Errorf("unknown response key '%s': %v", k, v)
 		}
 	}
 
-	err = RemoveIfExists("data/TestPageNew.txt")
-	if err != nil {
-		t.Fatalf("removing new page returned error %v", err)
+	// check that the page was stored
+	if p, err := store.Get("TestPageNew"); err != nil {
+		t.Fatalf("loading new page returned error %v", err)
+	} else if p.Body != "Test result" {
+		t.Errorf("got stored body %s, expected %s", p.Body, "Test result")
 	}
 }
 
 func TestPageDelete(t *testing.T) {
-	router := CreateRouter("test", 30*60, "test", "test", "*")
-	filename := "data/TestPageNew.txt"
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
 
-	// create test file
-	err := ioutil.WriteFile(filename, []byte("Test result"), 0600)
+	// create test page
+	p := &Page{Title: "TestPageNew", Body: "Test result"}
+	err := p.Save(store, &Revision{Author: "test"})
 	if err != nil {
-		t.Fatalf("creating test file returned error %v", err)
+		t.Fatalf("creating test page returned error %v", err)
 	}
 
 	// get authorization
@@ -226,16 +252,458 @@ func TestPageDelete(t *testing.T) {
 	// authorization headers
 	CheckAuthHeader("test", "test", r, t)
 
-	// check that file no longer exists
-	switch _, err := os.Stat(filename); {
-	case err != nil && os.IsNotExist(err):
-		// do nothing
-	case err != nil:
-		t.Fatalf("new page should no longer exist %v", err)
+	// check that page no longer exists
+	if _, err := store.Get("TestPageNew"); err != ErrPageNotFound {
+		t.Errorf("got error %v loading deleted page, expected %v", err, ErrPageNotFound)
+	}
+}
+
+func TestPageConditionalWrite(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	postBytes, err := json.Marshal(map[string]string{"body": "Test result"})
+	if err != nil {
+		t.Fatalf("serializing post data returned error %v", err)
+	}
+	updateBytes, err := json.Marshal(map[string]string{"body": "Test result updated"})
+	if err != nil {
+		t.Fatalf("serializing post data returned error %v", err)
+	}
+
+	// create only
+	r, _, err := MakeRequestWithHeaders(router, "POST", "/page/TestPage", postBytes, map[string]string{"If-None-Match": "*"}, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if r.Code != 200 {
+		t.Fatalf("got response code = %d, expected %d", r.Code, 200)
+	}
+	etag := r.Header().Get("ETag")
+	if len(etag) == 0 {
+		t.Fatalf("no ETag in response")
+	}
+	r, _, err = MakeRequestWithHeaders(router, "POST", "/page/TestPage", postBytes, map[string]string{"If-None-Match": "*"}, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if r.Code != 412 {
+		t.Errorf("got response code = %d creating existing page, expected %d", r.Code, 412)
+	}
+
+	// GET returns the same etag
+	r, _, err = MakeRequest(router, "GET", "/page/TestPage", nil, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if r.Header().Get("ETag") != etag {
+		t.Errorf("got ETag %s, expected %s", r.Header().Get("ETag"), etag)
+	}
+
+	// update with the current etag, then again with the stale one
+	r, _, err = MakeRequestWithHeaders(router, "POST", "/page/TestPage", updateBytes, map[string]string{"If-Match": etag}, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if r.Code != 200 {
+		t.Errorf("got response code = %d, expected %d", r.Code, 200)
+	}
+	if r.Header().Get("ETag") == etag {
+		t.Errorf("ETag did not change after update")
+	}
+	r, _, err = MakeRequestWithHeaders(router, "POST", "/page/TestPage", postBytes, map[string]string{"If-Match": etag}, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if r.Code != 412 {
+		t.Errorf("got response code = %d with stale ETag, expected %d", r.Code, 412)
+	}
+	r, _, err = MakeRequestWithHeaders(router, "DELETE", "/page/TestPage", []byte{}, map[string]string{"If-Match": etag}, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if r.Code != 412 {
+		t.Errorf("got response code = %d deleting with stale ETag, expected %d", r.Code, 412)
+	}
+
+	if p, err := store.Get("TestPage"); err != nil {
+		t.Fatalf("loading page returned error %v", err)
+	} else if p.Body != "Test result updated" {
+		t.Errorf("got stored body %s, expected %s", p.Body, "Test result updated")
+	}
+
+	// changing only the display title changes the etag too
+	r, _, _ = MakeRequest(router, "GET", "/page/TestPage", nil, a)
+	etag = r.Header().Get("ETag")
+	r, _, _ = MakeRequestWithHeaders(router, "PATCH", "/page/TestPage", []byte(`{"displayTitle":"Test page"}`), map[string]string{"Content-Type": "application/merge-patch+json", "If-Match": etag}, a)
+	if r.Code != 200 {
+		t.Fatalf("got response code = %d changing display title, expected %d", r.Code, 200)
+	}
+	if r.Header().Get("ETag") == etag {
+		t.Errorf("ETag did not change after changing display title")
+	}
+	r, _, _ = MakeRequestWithHeaders(router, "PATCH", "/page/TestPage", []byte(`{"displayTitle":"Other page"}`), map[string]string{"Content-Type": "application/merge-patch+json", "If-Match": etag}, a)
+	if r.Code != 412 {
+		t.Errorf("got response code = %d changing display title with stale ETag, expected %d", r.Code, 412)
+	}
+}
+
+func TestPageConditionalGet(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// create test page
+	p := &Page{Title: "TestPage", Body: "Test result"}
+	if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("creating test page returned error %v", err)
+	}
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	for _, url := range []string{"/page/TestPage", "/page"} {
+		r, _, err := MakeRequest(router, "GET", url, nil, a)
+		if err != nil {
+			t.Fatalf("running request returned error %v", err)
+		}
+		etag := r.Header().Get("ETag")
+		modified := r.Header().Get("Last-Modified")
+		if len(etag) == 0 || (len(modified) == 0) != (url == "/page") {
+			t.Fatalf("got ETag %q and Last-Modified %q from %s, expected both for a page and only an ETag for the list", etag, modified, url)
+		}
+
+		// HEAD returns the same validators
+		r, _, err = MakeRequest(router, "HEAD", url, nil, a)
+		if err != nil {
+			t.Fatalf("running request returned error %v", err)
+		}
+		if r.Code != 200 {
+			t.Errorf("got response code = %d for HEAD %s, expected %d", r.Code, url, 200)
+		}
+		if r.Header().Get("ETag") != etag {
+			t.Errorf("got ETag %s for HEAD %s, expected %s", r.Header().Get("ETag"), url, etag)
+		}
+		CheckAuthHeader("test", "test", r, t)
+
+		// HEAD must still be signed
+		r, _, err = MakeRequest(router, "HEAD", url, nil, nil)
+		if err != nil {
+			t.Fatalf("running request returned error %v", err)
+		}
+		if r.Code != 403 {
+			t.Errorf("got response code = %d for unsigned HEAD %s, expected %d", r.Code, url, 403)
+		}
+
+		conditions := []map[string]string{{"If-None-Match": etag}}
+		if len(modified) != 0 {
+			conditions = append(conditions, map[string]string{"If-Modified-Since": modified})
+		}
+		for _, headers := range conditions {
+			r, _, err = MakeRequestWithHeaders(router, "GET", url, nil, headers, a)
+			if err != nil {
+				t.Fatalf("running request returned error %v", err)
+			}
+			if r.Code != 304 {
+				t.Errorf("got response code = %d for %s with %v, expected %d", r.Code, url, headers, 304)
+			}
+			if r.Body.Len() != 0 {
+				t.Errorf("got body %s with 304 response, expected none", r.Body.String())
+			}
+		}
+
+		// a stale etag gets the full response
+		r, _, err = MakeRequestWithHeaders(router, "GET", url, nil, map[string]string{"If-None-Match": "\"stale\""}, a)
+		if err != nil {
+			t.Fatalf("running request returned error %v", err)
+		}
+		if r.Code != 200 {
+			t.Errorf("got response code = %d for %s with stale ETag, expected %d", r.Code, url, 200)
+		}
+	}
+}
+
+// countingPageStore counts the pages read from a store.
+type countingPageStore struct {
+	PageStore
+	gets int
+}
+
+func (s *countingPageStore) Get(title string) (*Page, error) {
+	s.gets++
+	return s.PageStore.Get(title)
+}
+
+func TestPageGetLoadsOnce(t *testing.T) {
+	store := &countingPageStore{PageStore: NewMemoryPageStore()}
+	p := &Page{Title: "TestPage", Body: "Test result"}
+	if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("creating test page returned error %v", err)
 	}
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
 
-	err = RemoveIfExists(filename)
+	// get authorization
+	a, err := GetAuthorization(router)
 	if err != nil {
-		t.Fatalf("removing new page returned error %v", err)
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	for _, url := range []string{"/page/TestPage", "/page/MissingPage"} {
+		store.gets = 0
+		if _, _, err := MakeRequest(router, "GET", url, nil, a); err != nil {
+			t.Fatalf("running request returned error %v", err)
+		}
+		if store.gets != 1 {
+			t.Errorf("got %d pages read for GET %s, expected %d", store.gets, url, 1)
+		}
+	}
+}
+
+func TestPageHandlerUnauthenticated(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := mux.NewRouter()
+	router.HandleFunc("/page/{title:"+titlePattern+"}", CreatePageHandler(store, NewMemoryAttachmentStore(), "*"))
+
+	// without the authorization handler there is no signed-in user
+	r, _, err := MakeRequestWithHeaders(router, "PUT", "/page/TestPage", []byte("Test result"), map[string]string{"Content-Type": "text/markdown"}, nil)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if r.Code != 201 {
+		t.Errorf("got response code = %d, expected %d", r.Code, 201)
+	}
+	if p, err := store.Get("TestPage"); err != nil || p.Metadata.Author != "" {
+		t.Errorf("got %+v, %v loading page, expected it saved without an author", p, err)
+	}
+}
+
+func TestPageListConditionalGetAfterDelete(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// create test pages
+	for _, title := range []string{"TestPage", "OtherPage"} {
+		p := &Page{Title: title, Body: "Test result"}
+		if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("creating test page returned error %v", err)
+		}
+	}
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	r, _, err := MakeRequest(router, "GET", "/page", nil, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	etag := r.Header().Get("ETag")
+	since := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+
+	// deleting the newest page leaves every listed page unchanged
+	if r, _, _ := MakeRequest(router, "DELETE", "/page/OtherPage", []byte{}, a); r.Code != 204 {
+		t.Fatalf("got response code = %d deleting page, expected %d", r.Code, 204)
+	}
+
+	for _, headers := range []map[string]string{{"If-None-Match": etag}, {"If-Modified-Since": since}} {
+		r, dat, err := MakeRequestWithHeaders(router, "GET", "/page", nil, headers, a)
+		if err != nil {
+			t.Fatalf("running request returned error %v", err)
+		}
+		if r.Code != 200 {
+			t.Errorf("got response code = %d for the list with %v after a delete, expected %d", r.Code, headers, 200)
+		}
+		if items, _ := dat["items"].([]interface{}); len(items) != 1 {
+			t.Errorf("got items %v after a delete, expected one", dat["items"])
+		}
+	}
+}
+
+func TestPageListGetMetadata(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// create test page
+	p := &Page{Title: "TestPage", Body: "Test result"}
+	if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("creating test page returned error %v", err)
+	}
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	for _, test := range []struct {
+		url      string
+		metadata bool
+	}{
+		{"/page", false},
+		{"/page?metadata=true", true},
+	} {
+		_, dat, err := MakeRequest(router, "GET", test.url, nil, a)
+		if err != nil {
+			t.Fatalf("running request returned error %v", err)
+		}
+
+		items, _ := dat["items"].([]interface{})
+		if len(items) != 1 {
+			t.Fatalf("got %d results, expected %d", len(items), 1)
+		}
+		metadata, ok := items[0].(map[string]interface{})["metadata"]
+		if ok != test.metadata {
+			t.Errorf("got metadata %v from %s, expected metadata %v", metadata, test.url, test.metadata)
+		} else if ok {
+			CheckMetadata(metadata, "test", len("Test result"), 1, t)
+		}
+	}
+}
+
+func TestPageHierarchy(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	for _, title := range []string{"Team", "Team/Backend/Runbook", "Team/Frontend", "Other"} {
+		postBytes, err := json.Marshal(map[string]string{"body": "Test result"})
+		if err != nil {
+			t.Fatalf("serializing post data returned error %v", err)
+		}
+		if r, _, err := MakeRequest(router, "POST", "/page/"+title, postBytes, a); err != nil {
+			t.Fatalf("running request returned error %v", err)
+		} else if r.Code != 200 {
+			t.Fatalf("got response code = %d creating %s, expected %d", r.Code, title, 200)
+		}
+	}
+
+	// breadcrumbs
+	_, dat, err := MakeRequest(router, "GET", "/page/Team/Backend/Runbook", nil, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	breadcrumbs, _ := dat["breadcrumbs"].([]interface{})
+	expected := []map[string]interface{}{
+		{"title": "Team", "name": "Team", "exists": true},
+		{"title": "Team/Backend", "name": "Backend", "exists": false},
+	}
+	if len(breadcrumbs) != len(expected) {
+		t.Fatalf("got breadcrumbs %v, expected %v", breadcrumbs, expected)
+	}
+	for i, breadcrumb := range breadcrumbs {
+		for key, value := range expected[i] {
+			if breadcrumb.(map[string]interface{})[key] != value {
+				t.Errorf("got breadcrumb %v, expected %v", breadcrumb, expected[i])
+			}
+		}
+	}
+
+	// children
+	for url, expected := range map[string]string{
+		"/page?parent=Team":         "Team/Frontend",
+		"/page?parent=Team/Backend": "Team/Backend/Runbook",
+		"/page?parent=":             "Other,Team",
+	} {
+		_, dat, err := MakeRequest(router, "GET", url, nil, a)
+		if err != nil {
+			t.Fatalf("running request returned error %v", err)
+		}
+		if titles := strings.Join(ListTitles(dat), ","); titles != expected {
+			t.Errorf("got %s from %s, expected %s", titles, url, expected)
+		}
+	}
+
+	// path traversal and reserved names
+	for url, code := range map[string]int{
+		"/page/Team/../Other":     301,
+		"/page/Team%2F..%2FOther": 301,
+		"/page/Team/diff":         400,
+	} {
+		if r, _, err := MakeRequest(router, "POST", url, []byte("{}"), a); err != nil {
+			t.Fatalf("running request returned error %v", err)
+		} else if r.Code != code {
+			t.Errorf("got response code = %d from %s, expected %d", r.Code, url, code)
+		}
+	}
+	if r, _, err := MakeRequest(router, "GET", "/page?parent=../Team", nil, a); err != nil {
+		t.Fatalf("running request returned error %v", err)
+	} else if r.Code != 400 {
+		t.Errorf("got response code = %d, expected %d", r.Code, 400)
+	}
+	postBytes, err := json.Marshal(map[string]string{"title": "Team/../Other", "body": "Test result"})
+	if err != nil {
+		t.Fatalf("serializing post data returned error %v", err)
+	}
+	// the title in the body is ignored
+	if _, dat, err := MakeRequest(router, "POST", "/page/Team", postBytes, a); err != nil {
+		t.Fatalf("running request returned error %v", err)
+	} else if title, _ := dat["title"].(string); title != "Team" {
+		t.Errorf("got title %s saving with a title in the body, expected %s", title, "Team")
+	}
+}
+
+func TestPageUnicodeTitle(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	postBytes, err := json.Marshal(map[string]string{"body": "Test result"})
+	if err != nil {
+		t.Fatalf("serializing post data returned error %v", err)
+	}
+	if r, _, err := MakeRequest(router, "POST", "/page/Caf%C3%A9/Men%C3%BC_v1.2", postBytes, a); err != nil {
+		t.Fatalf("running request returned error %v", err)
+	} else if r.Code != 200 {
+		t.Fatalf("got response code = %d, expected %d", r.Code, 200)
+	}
+
+	// the decomposed title names the same page
+	_, dat, err := MakeRequest(router, "GET", "/page/Cafe%CC%81/Menu%CC%88_v1.2", nil, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if title, _ := dat["title"].(string); title != "Café/Menü_v1.2" {
+		t.Errorf("got title %q, expected %q", title, "Café/Menü_v1.2")
+	}
+	if title, _ := dat["displayTitle"].(string); title != "Menü v1.2" {
+		t.Errorf("got display title %q, expected %q", title, "Menü v1.2")
+	}
+
+	// display titles can be set
+	postBytes, err = json.Marshal(map[string]string{"displayTitle": " Menu (version 1.2) "})
+	if err != nil {
+		t.Fatalf("serializing post data returned error %v", err)
+	}
+	if _, dat, err := MakeRequest(router, "POST", "/page/Caf%C3%A9/Men%C3%BC_v1.2", postBytes, a); err != nil {
+		t.Fatalf("running request returned error %v", err)
+	} else if title, _ := dat["displayTitle"].(string); title != "Menu (version 1.2)" {
+		t.Errorf("got display title %q, expected %q", title, "Menu (version 1.2)")
+	}
+
+	// control characters
+	if r, _, err := MakeRequest(router, "POST", "/page/Bad%07Title", postBytes, a); err != nil {
+		t.Fatalf("running request returned error %v", err)
+	} else if r.Code != 400 {
+		t.Errorf("got response code = %d, expected %d", r.Code, 400)
 	}
 }
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// excerptLength is roughly how many bytes of body text an excerpt holds.
+const excerptLength = 200
+
+var ErrInvalidCursor = errors.New("Invalid after token")
+
+// pageListFields are the optional item fields of a page list.
+var pageListFields = map[string]bool{"tags": true, "metadata": true, "excerpt": true, "body": true}
+
+// PageListOptions are the query parameters of the page list:
+//
+//	tag, match  - keep pages with all (match=any: any) of the tags
+//	prefix      - keep pages whose title starts with prefix
+//	parent      - keep the pages directly below parent, or the top level
+//	              pages if parent is empty
+//	sort, order - sort by title, modified or size, asc or desc
+//	limit       - return at most limit items, with a link to the next ones
+//	after       - continue after the cursor of a previous response
+//	fields      - comma separated optional fields: tags, metadata, excerpt
+//	              and body; tags are returned by default
+type PageListOptions struct {
+	Tags       []string
+	AnyTag     bool
+	Prefix     string
+	Parent     string
+	Children   bool
+	Sort       string
+	Descending bool
+	Limit      int
+	After      *Page
+	Fields     map[string]bool
+}
+
+// pageCursor identifies the last item of a page list response.
+type pageCursor struct {
+	Sort       string    `json:"s"`
+	Descending bool      `json:"d,omitempty"`
+	Title      string    `json:"t"`
+	Modified   time.Time `json:"m"`
+	Size       int       `json:"z,omitempty"`
+}
+
+func ParsePageListOptions(query url.Values) (*PageListOptions, error) {
+	options := &PageListOptions{
+		Tags:   query["tag"],
+		AnyTag: query.Get("match") == "any",
+		Prefix: NormalizeTitle(query.Get("prefix")),
+		Parent: NormalizeTitle(query.Get("parent")),
+		Sort:   "title",
+		Fields: map[string]bool{"tags": true},
+	}
+
+	if _, ok := query["parent"]; ok {
+		if len(options.Parent) != 0 && !ValidTitle(options.Parent) {
+			return nil, ErrInvalidTitle
+		}
+		options.Children = true
+	}
+
+	if sort := query.Get("sort"); len(sort) != 0 {
+		if sort != "title" && sort != "modified" && sort != "size" {
+			return nil, errors.New("Invalid sort, expected title, modified or size")
+		}
+		options.Sort = sort
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		options.Descending = true
+	default:
+		return nil, errors.New("Invalid order, expected asc or desc")
+	}
+
+	if limit := query.Get("limit"); len(limit) != 0 {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return nil, errors.New("Invalid limit")
+		}
+		options.Limit = n
+	}
+
+	if fields := query.Get("fields"); len(fields) != 0 {
+		options.Fields = map[string]bool{}
+		for _, field := range strings.Split(fields, ",") {
+			if field = strings.TrimSpace(field); field == "title" {
+				continue
+			} else if !pageListFields[field] {
+				return nil, errors.New("Invalid field " + field)
+			}
+			options.Fields[field] = true
+		}
+	}
+	if query.Get("metadata") == "true" {
+		options.Fields["metadata"] = true
+	}
+
+	if after := query.Get("after"); len(after) != 0 {
+		data, err := base64.URLEncoding.DecodeString(after)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		cursor := &pageCursor{}
+		if err := json.Unmarshal(data, cursor); err != nil {
+			return nil, ErrInvalidCursor
+		}
+		if cursor.Sort != options.Sort || cursor.Descending != options.Descending {
+			return nil, ErrInvalidCursor
+		}
+		options.After = &Page{Title: cursor.Title, Metadata: &PageMetadata{Modified: cursor.Modified, Size: cursor.Size}}
+	}
+
+	return options, nil
+}
+
+// compare orders pages by the sort field, then by title.
+func (o *PageListOptions) compare(a *Page, b *Page) int {
+	result := 0
+	switch o.Sort {
+	case "modified":
+		if a.Modified().Before(b.Modified()) {
+			result = -1
+		} else if a.Modified().After(b.Modified()) {
+			result = 1
+		}
+	case "size":
+		result = a.size() - b.size()
+	}
+	if result == 0 {
+		result = strings.Compare(a.Title, b.Title)
+	}
+
+	if o.Descending {
+		return -result
+	}
+	return result
+}
+
+// cursor returns the after token continuing a list after p.
+func (o *PageListOptions) cursor(p *Page) string {
+	data, _ := json.Marshal(&pageCursor{Sort: o.Sort, Descending: o.Descending, Title: p.Title, Modified: p.Modified(), Size: p.size()})
+
+	return base64.URLEncoding.EncodeToString(data)
+}
+
+func (p *Page) size() int {
+	if p.Metadata == nil {
+		return 0
+	}
+
+	return p.Metadata.Size
+}
+
+type sortedPages struct {
+	items   []*Page
+	options *PageListOptions
+}
+
+func (a sortedPages) Len() int           { return len(a.items) }
+func (a sortedPages) Swap(i, j int)      { a.items[i], a.items[j] = a.items[j], a.items[i] }
+func (a sortedPages) Less(i, j int) bool { return a.options.compare(a.items[i], a.items[j]) < 0 }
+
+// excerpt returns the start of body, cut at a word boundary.
+func excerpt(body string) string {
+	if len(body) <= excerptLength {
+		return body
+	}
+
+	end := excerptLength
+	if space := strings.LastIndexFunc(body[:end], unicode.IsSpace); space > 0 {
+		end = space
+	}
+	for end > 0 && !utf8.RuneStart(body[end]) {
+		end--
+	}
+
+	return body[:end] + "…"
+}
+
+type Pages struct {
+	Items []*Page `json:"items"`
+	// Next links to the following items when the list was cut at limit.
+	Next string `json:"next,omitempty"`
+
+	after string
+}
+
+// getPages lists the stored pages matching options, with the fields they
+// ask for.
+func getPages(store PageStore, options *PageListOptions) (*Pages, error) {
+	items, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	results := &Pages{Items: []*Page{}}
+	for _, item := range items {
+		if options.Children && ParentTitle(item.Title) != options.Parent {
+			continue
+		}
+		if item.HasTags(options.Tags, options.AnyTag) && strings.HasPrefix(item.Title, options.Prefix) {
+			results.Items = append(results.Items, item)
+		}
+	}
+	sort.Sort(sortedPages{items: results.Items, options: options})
+
+	if options.After != nil {
+		i := sort.Search(len(results.Items), func(i int) bool { return options.compare(results.Items[i], options.After) > 0 })
+		results.Items = results.Items[i:]
+	}
+	if options.Limit > 0 && len(results.Items) > options.Limit {
+		results.Items = results.Items[:options.Limit]
+		results.after = options.cursor(results.Items[options.Limit-1])
+	}
+
+	for _, item := range results.Items {
+		if len(item.DisplayTitle) == 0 {
+			item.DisplayTitle = defaultDisplayTitle(item.Title)
+		}
+
+		if options.Fields["body"] || options.Fields["excerpt"] {
+			p, err := store.Get(item.Title)
+			if err != nil && err != ErrPageNotFound {
+				return nil, err
+			} else if err == nil {
+				if options.Fields["body"] {
+					item.Body = p.Body
+				}
+				if options.Fields["excerpt"] {
+					item.Excerpt = excerpt(p.Body)
+				}
+			}
+		}
+		if !options.Fields["tags"] {
+			item.Tags = nil
+		}
+		if !options.Fields["metadata"] {
+			item.Metadata = nil
+		}
+	}
+
+	return results, nil
+}
+
+func CreatePageListHandler(store PageStore, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization, If-None-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
+
+		switch r.Method {
+		case "OPTIONS":
+			return
+		case "GET", "HEAD":
+			query := r.URL.Query()
+			options, err := ParsePageListOptions(query)
+			if err != nil {
+				ReturnError(w, r, http.StatusBadRequest, err)
+				return
+			}
+
+			pages, err := getPages(store, options)
+			if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			if len(pages.after) != 0 {
+				query.Set("after", pages.after)
+				pages.Next = r.URL.Path + "?" + query.Encode()
+			}
+
+			// the list has no modification time, as deleting or moving a
+			// page changes it without changing any listed page
+			jsonResponse, _ := json.Marshal(pages)
+			if CheckNotModified(w, r, computeETag(jsonResponse), time.Time{}) {
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			w.Write(jsonResponse)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func CreateSizedPages(store PageStore, t *testing.T) {
+	for title, body := range map[string]string{
+		"Alpha":    "aaaa",
+		"Beta":     "b",
+		"Gamma":    "ccc",
+		"Delta":    "dd",
+		"AlphaTwo": strings.Repeat("word ", 100),
+	} {
+		p := &Page{Title: title, Body: body}
+		if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("creating test page returned error %v", err)
+		}
+	}
+}
+
+func ListTitles(dat map[string]interface{}) []string {
+	titles := []string{}
+	items, _ := dat["items"].([]interface{})
+	for _, item := range items {
+		titles = append(titles, item.(map[string]interface{})["title"].(string))
+	}
+
+	return titles
+}
+
+func TestPageListGetPaged(t *testing.T) {
+	store := NewMemoryPageStore()
+	CreateSizedPages(store, t)
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	for _, test := range []struct {
+		url      string
+		expected string
+	}{
+		{"/page", "Alpha,AlphaTwo,Beta,Delta,Gamma"},
+		{"/page?order=desc", "Gamma,Delta,Beta,AlphaTwo,Alpha"},
+		{"/page?sort=size", "Beta,Delta,Gamma,Alpha,AlphaTwo"},
+		{"/page?sort=size&order=desc&limit=2", "AlphaTwo,Alpha|Gamma,Delta|Beta"},
+		{"/page?limit=2", "Alpha,AlphaTwo|Beta,Delta|Gamma"},
+		{"/page?prefix=Alpha&limit=1", "Alpha|AlphaTwo"},
+	} {
+		// follow the next links, collecting each response's titles
+		results := []string{}
+		for url := test.url; len(url) != 0; {
+			r, dat, err := MakeRequest(router, "GET", url, nil, a)
+			if err != nil {
+				t.Fatalf("running request returned error %v", err)
+			} else if r.Code != 200 {
+				t.Fatalf("got response code = %d from %s, expected %d", r.Code, url, 200)
+			}
+
+			results = append(results, strings.Join(ListTitles(dat), ","))
+			url, _ = dat["next"].(string)
+			if len(results) > 5 {
+				t.Fatalf("got too many next links from %s", test.url)
+			}
+		}
+		if strings.Join(results, "|") != test.expected {
+			t.Errorf("got %s from %s, expected %s", strings.Join(results, "|"), test.url, test.expected)
+		}
+	}
+
+	// invalid parameters
+	for _, url := range []string{"/page?sort=author", "/page?order=up", "/page?limit=0", "/page?fields=secret", "/page?after=bogus", "/page?sort=size&after=eyJzIjoidGl0bGUiLCJ0IjoiQWxwaGEiLCJtIjoiMDAwMS0wMS0wMVQwMDowMDowMFoifQ=="} {
+		if r, _, err := MakeRequest(router, "GET", url, nil, a); err != nil {
+			t.Fatalf("running request returned error %v", err)
+		} else if r.Code != 400 {
+			t.Errorf("got response code = %d from %s, expected %d", r.Code, url, 400)
+		}
+	}
+}
+
+func TestPageListGetFields(t *testing.T) {
+	store := NewMemoryPageStore()
+	CreateSizedPages(store, t)
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	_, dat, err := MakeRequest(router, "GET", "/page?prefix=AlphaTwo&fields=title,excerpt,metadata", nil, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+
+	items, _ := dat["items"].([]interface{})
+	if len(items) != 1 {
+		t.Fatalf("got %d results, expected %d", len(items), 1)
+	}
+	item := items[0].(map[string]interface{})
+	if _, ok := item["body"]; ok {
+		t.Errorf("got body, expected only excerpt")
+	}
+	if excerpt, _ := item["excerpt"].(string); !strings.HasPrefix(excerpt, "word word") || !strings.HasSuffix(excerpt, "word…") || len(excerpt) > excerptLength+len("…") {
+		t.Errorf("got excerpt %q, expected body trimmed to words", excerpt)
+	}
+	CheckMetadata(item["metadata"], "test", len(strings.Repeat("word ", 100)), 1, t)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+)
+
+var ErrInvalidPatch = errors.New("Invalid patch, expected a JSON object")
+
+// PageContent is the part of a page that clients write. The title always
+// comes from the URL and the metadata from the store.
+type PageContent struct {
+	DisplayTitle string   `json:"displayTitle,omitempty"`
+	Redirect     string   `json:"redirect,omitempty"`
+	Body         string   `json:"body,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	// Append is added to the end of the body by a PATCH.
+	Append string `json:"append,omitempty"`
+}
+
+func (p *Page) Content() *PageContent {
+	return &PageContent{DisplayTitle: p.DisplayTitle, Redirect: p.Redirect, Body: p.Body, Tags: p.Tags}
+}
+
+func (p *Page) SetContent(content *PageContent) {
+	p.DisplayTitle = content.DisplayTitle
+	p.Redirect = content.Redirect
+	p.Body = content.Body
+	p.Tags = content.Tags
+}
+
+// isJSONRequest reports whether the request body is JSON. Requests without
+// a content type are taken to be JSON, as POST has always expected.
+func isJSONRequest(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	if len(contentType) == 0 {
+		return true
+	}
+
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch mediatype {
+	case "application/json", "text/json", "application/merge-patch+json":
+		return true
+	}
+
+	return false
+}
+
+// readPageContent returns the complete content given by a PUT: a JSON
+// object of the page's fields, or any other body as the page's body.
+func readPageContent(r *http.Request, body []byte) (*PageContent, error) {
+	if !isJSONRequest(r) {
+		return &PageContent{Body: string(body)}, nil
+	}
+
+	content := &PageContent{}
+	if err := json.Unmarshal(body, content); err != nil {
+		return nil, err
+	}
+	content.Append = ""
+
+	return content, nil
+}
+
+// mergePatch applies a JSON Merge Patch (RFC 7396) to target.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+
+	return targetObject
+}
+
+// patchPageContent returns content changed by a PATCH. A JSON body is a
+// merge patch of the page's fields, which may also hold text to append to
+// the body; any other body is appended to the body as it is.
+func patchPageContent(r *http.Request, body []byte, content *PageContent) (*PageContent, error) {
+	if !isJSONRequest(r) {
+		content.Body += string(body)
+		return content, nil
+	}
+
+	var patch interface{}
+	if err := json.Unmarshal(body, &patch); err != nil {
+		return nil, err
+	}
+	if _, ok := patch.(map[string]interface{}); !ok {
+		return nil, ErrInvalidPatch
+	}
+
+	var target interface{}
+	data, _ := json.Marshal(content)
+	json.Unmarshal(data, &target)
+
+	data, _ = json.Marshal(mergePatch(target, patch))
+	patched := &PageContent{}
+	if err := json.Unmarshal(data, patched); err != nil {
+		return nil, err
+	}
+	patched.Body += patched.Append
+	patched.Append = ""
+
+	return patched, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	// examples from RFC 7396
+	tests := []struct {
+		target   string
+		patch    string
+		expected string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+	}
+	for _, test := range tests {
+		var target, patch interface{}
+		json.Unmarshal([]byte(test.target), &target)
+		json.Unmarshal([]byte(test.patch), &patch)
+		if result, _ := json.Marshal(mergePatch(target, patch)); string(result) != test.expected {
+			t.Errorf("patching %s with %s got %s, expected %s", test.target, test.patch, result, test.expected)
+		}
+	}
+}
+
+func TestPagePut(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	// create from JSON, ignoring the title in the body
+	putBytes := []byte(`{"title":"OtherPage","body":"Test result","tags":["test"]}`)
+	r, dat, err := MakeRequestWithHeaders(router, "PUT", "/page/TestPage", putBytes, map[string]string{"Content-Type": "application/json"}, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+
+	// authorization headers
+	CheckAuthHeader("test", "test", r, t)
+
+	if r.Code != 201 {
+		t.Errorf("got response code = %d creating page, expected %d", r.Code, 201)
+	}
+	if location := r.Header().Get("Location"); location != "/page/TestPage" {
+		t.Errorf("got location %s, expected %s", location, "/page/TestPage")
+	}
+	if title, _ := dat["title"].(string); title != "TestPage" {
+		t.Errorf("got title %s, expected %s", title, "TestPage")
+	}
+	if _, err := store.Get("OtherPage"); err != ErrPageNotFound {
+		t.Errorf("got error %v loading page named in the body, expected %v", err, ErrPageNotFound)
+	}
+
+	// replace with raw text, which clears the tags; repeating it changes nothing
+	for i := 0; i < 2; i++ {
+		r, _, _ := MakeRequestWithHeaders(router, "PUT", "/page/TestPage", []byte("# Replaced\n"), map[string]string{"Content-Type": "text/markdown"}, a)
+		if r.Code != 200 {
+			t.Errorf("got response code = %d replacing page, expected %d", r.Code, 200)
+		}
+	}
+	if p, err := store.Get("TestPage"); err != nil {
+		t.Fatalf("loading page returned error %v", err)
+	} else if p.Body != "# Replaced\n" || len(p.Tags) != 0 {
+		t.Errorf("got body %q and tags %v, expected the replaced body and no tags", p.Body, p.Tags)
+	}
+
+	// invalid JSON
+	if r, _, _ := MakeRequestWithHeaders(router, "PUT", "/page/TestPage", []byte("{"), map[string]string{"Content-Type": "application/json"}, a); r.Code != 400 {
+		t.Errorf("got response code = %d for invalid JSON, expected %d", r.Code, 400)
+	}
+}
+
+func TestPagePatch(t *testing.T) {
+	store := NewMemoryPageStore()
+	p := &Page{Title: "TestPage", DisplayTitle: "Test page", Body: "Test result", Tags: []string{"test"}}
+	if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("creating test page returned error %v", err)
+	}
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	for _, test := range []struct {
+		contentType  string
+		patch        string
+		code         int
+		body         string
+		tags         string
+		displayTitle string
+	}{
+		{"application/merge-patch+json", `{"tags":["a","b"],"displayTitle":null}`, 200, "Test result", "a,b", ""},
+		{"application/merge-patch+json", `{"title":"OtherPage","append":"\nmore"}`, 200, "Test result\nmore", "a,b", ""},
+		{"text/plain", "\nand more", 200, "Test result\nmore\nand more", "a,b", ""},
+		{"application/json", `{"body":"New","tags":null}`, 200, "New", "", ""},
+		{"application/merge-patch+json", `["not","an","object"]`, 400, "New", "", ""},
+		{"application/merge-patch+json", `{"tags":"wrong type"}`, 400, "New", "", ""},
+	} {
+		r, _, _ := MakeRequestWithHeaders(router, "PATCH", "/page/TestPage", []byte(test.patch), map[string]string{"Content-Type": test.contentType}, a)
+		if r.Code != test.code {
+			t.Errorf("got response code = %d patching with %s, expected %d", r.Code, test.patch, test.code)
+		}
+
+		p, err := store.Get("TestPage")
+		if err != nil {
+			t.Fatalf("loading page returned error %v", err)
+		}
+		if p.Body != test.body || strings.Join(p.Tags, ",") != test.tags || p.DisplayTitle != test.displayTitle {
+			t.Errorf("got page %+v after %s, expected body %q, tags %s and display title %q", p, test.patch, test.body, test.tags, test.displayTitle)
+		}
+	}
+
+	// missing pages
+	if r, _, _ := MakeRequest(router, "PATCH", "/page/MissingPage", []byte(`{"body":"x"}`), a); r.Code != 404 {
+		t.Errorf("got response code = %d patching missing page, expected %d", r.Code, 404)
+	}
+
+	// stale patches
+	if r, _, _ := MakeRequestWithHeaders(router, "PATCH", "/page/TestPage", []byte(`{"body":"x"}`), map[string]string{"If-Match": computeETag([]byte("Test result"))}, a); r.Code != 412 {
+		t.Errorf("got response code = %d for stale patch, expected %d", r.Code, 412)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+type Revision struct {
+	ID        string    `json:"id"`
+	Author    string    `json:"author"`
+	Timestamp time.Time `json:"timestamp"`
+	Body      string    `json:"body,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	Revert    string    `json:"revert,omitempty"`
+	// Commit names the git commit of the revision, in stores that keep
+	// pages in git.
+	Commit string `json:"commit,omitempty"`
+}
+
+type Revisions struct {
+	Items []*Revision `json:"items"`
+}
+
+func CreateRevisionListHandler(store PageStore, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		title := GetTitle(r)
+
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization")
+
+		switch r.Method {
+		case "OPTIONS":
+			return
+		case "GET":
+			items, err := store.Revisions(title)
+			if err == ErrPageNotFound {
+				ReturnError(w, r, http.StatusNotFound, err)
+				return
+			} else if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			jsonResponse, _ := json.Marshal(&Revisions{Items: items})
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			w.Write(jsonResponse)
+		}
+	}
+}
+
+func CreateRevisionHandler(store PageStore, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		title := GetTitle(r)
+
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization")
+
+		switch r.Method {
+		case "OPTIONS":
+			return
+		case "GET":
+			revision, err := store.Revision(title, vars["id"])
+			if err == ErrRevisionNotFound {
+				ReturnError(w, r, http.StatusNotFound, err)
+				return
+			} else if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			jsonResponse, _ := json.Marshal(revision)
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			w.Write(jsonResponse)
+		}
+	}
+}
+
+type RevertRequest struct {
+	Revision string `json:"revision"`
+}
+
+// CreateRevertHandler saves the body of an earlier revision as a new
+// revision of the page.
+func CreateRevertHandler(store PageStore, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		title := GetTitle(r)
+
+		w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, POST")
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization")
+
+		switch r.Method {
+		case "OPTIONS":
+			return
+		case "POST":
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			revert := &RevertRequest{}
+			if err := json.Unmarshal(body, revert); err != nil {
+				ReturnError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			if len(revert.Revision) == 0 {
+				ReturnError(w, r, http.StatusBadRequest, errors.New("No revision provided"))
+				return
+			}
+
+			revision, err := store.Revision(title, revert.Revision)
+			if err == ErrRevisionNotFound {
+				ReturnError(w, r, http.StatusNotFound, err)
+				return
+			} else if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			p, err := loadPage(store, title)
+			if err != nil && err != ErrPageNotFound {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			p.Body = revision.Body
+			p.Tags = revision.Tags
+
+			err = p.Save(store, &Revision{Author: authenticatedUser(r), Revert: revision.ID})
+			if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			jsonResponse, _ := json.Marshal(p)
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			w.Write(jsonResponse)
+		}
+	}
+}
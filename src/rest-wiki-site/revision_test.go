@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRevisionListGet(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	// save two versions
+	for _, body := range []string{"Test result", "Test result updated"} {
+		postBytes, err := json.Marshal(map[string]string{"body": body})
+		if err != nil {
+			t.Fatalf("serializing post data returned error %v", err)
+		}
+		if r, _, err := MakeRequest(router, "POST", "/page/TestPage", postBytes, a); err != nil {
+			t.Fatalf("running request returned error %v", err)
+		} else if r.Code != 200 {
+			t.Fatalf("got response code = %d, expected %d", r.Code, 200)
+		}
+	}
+
+	// make request
+	r, dat, err := MakeRequest(router, "GET", "/page/TestPage/revisions", nil, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+
+	// authorization headers
+	CheckAuthHeader("test", "test", r, t)
+
+	items, ok := dat["items"].([]interface{})
+	if !ok {
+		t.Fatalf("no items in response")
+	}
+	if len(items) != 2 {
+		t.Fatalf("got %d results, expected %d", len(items), 2)
+	}
+	for i, expectedid := range []string{"1", "2"} {
+		item := items[i].(map[string]interface{})
+		if id := item["id"].(string); id != expectedid {
+			t.Errorf("got id %s, expected %s", id, expectedid)
+		}
+		if author := item["author"].(string); author != "test" {
+			t.Errorf("got author %s, expected %s", author, "test")
+		}
+		if _, ok := item["timestamp"]; !ok {
+			t.Errorf("no timestamp in revision %s", expectedid)
+		}
+		if _, ok := item["body"]; ok {
+			t.Errorf("unexpected body in revision %s", expectedid)
+		}
+	}
+}
+
+func TestRevisionGet(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// create test revisions
+	for _, body := range []string{"Test result", "Test result updated"} {
+		p := &Page{Title: "TestPage", Body: body}
+		if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("creating test page returned error %v", err)
+		}
+	}
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	// make request
+	r, dat, err := MakeRequest(router, "GET", "/page/TestPage/revisions/1", nil, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+
+	// authorization headers
+	CheckAuthHeader("test", "test", r, t)
+
+	// expected values
+	if id, _ := dat["id"].(string); id != "1" {
+		t.Errorf("got id %s, expected %s", id, "1")
+	}
+	if body, _ := dat["body"].(string); body != "Test result" {
+		t.Errorf("got body %s, expected %s", body, "Test result")
+	}
+
+	// missing revision
+	r, _, err = MakeRequest(router, "GET", "/page/TestPage/revisions/3", nil, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if r.Code != 404 {
+		t.Errorf("got response code = %d, expected %d", r.Code, 404)
+	}
+}
+
+func TestRevertPost(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// create test revisions
+	for _, body := range []string{"Test result", "Test result vandalised"} {
+		p := &Page{Title: "TestPage", Body: body}
+		if err := p.Save(store, &Revision{Author: "other"}); err != nil {
+			t.Fatalf("creating test page returned error %v", err)
+		}
+	}
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	// make request
+	postBytes, err := json.Marshal(map[string]string{"revision": "1"})
+	if err != nil {
+		t.Fatalf("serializing post data returned error %v", err)
+	}
+	r, dat, err := MakeRequest(router, "POST", "/page/TestPage/revert", postBytes, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+
+	// authorization headers
+	CheckAuthHeader("test", "test", r, t)
+
+	if body, _ := dat["body"].(string); body != "Test result" {
+		t.Errorf("got body %s, expected %s", body, "Test result")
+	}
+
+	// check the revert was recorded
+	if p, err := store.Get("TestPage"); err != nil {
+		t.Fatalf("loading page returned error %v", err)
+	} else if p.Body != "Test result" {
+		t.Errorf("got stored body %s, expected %s", p.Body, "Test result")
+	}
+	if revision, err := store.Revision("TestPage", "3"); err != nil {
+		t.Fatalf("loading revision returned error %v", err)
+	} else if revision.Revert != "1" || revision.Author != "test" || revision.Body != "Test result" {
+		t.Errorf("got revision %+v, expected revert of %s by %s", revision, "1", "test")
+	}
+
+	// missing revision
+	postBytes, _ = json.Marshal(map[string]string{"revision": "7"})
+	r, _, err = MakeRequest(router, "POST", "/page/TestPage/revert", postBytes, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if r.Code != 404 {
+		t.Errorf("got response code = %d, expected %d", r.Code, 404)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// snippetContext is roughly how many bytes of body text are shown before
+// and after the first match in a snippet.
+const snippetContext = 80
+
+type searchToken struct {
+	Term  string
+	Start int // byte offset in the body, or -1 outside it
+	End   int
+}
+
+// tokenize splits text into lower-cased runs of letters and digits.
+func tokenize(text string) []searchToken {
+	tokens := []searchToken{}
+	start := -1
+	for i, c := range text {
+		isword := unicode.IsLetter(c) || unicode.IsDigit(c)
+		if isword && start < 0 {
+			start = i
+		} else if !isword && start >= 0 {
+			tokens = append(tokens, searchToken{Term: strings.ToLower(text[start:i]), Start: start, End: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, searchToken{Term: strings.ToLower(text[start:]), Start: start, End: len(text)})
+	}
+
+	return tokens
+}
+
+type indexedPage struct {
+	body string
+	// title tokens, a blank separator, then body tokens; a token's index
+	// is its position in the postings
+	tokens []searchToken
+}
+
+// SearchIndex is an in-memory inverted index over page titles and bodies.
+// It is kept current as a PageListener. It is safe for concurrent use.
+type SearchIndex struct {
+	mu       sync.RWMutex
+	pages    map[string]*indexedPage
+	postings map[string]map[string][]int
+}
+
+type SearchResult struct {
+	Title   string `json:"title"`
+	Score   int    `json:"score"`
+	Snippet string `json:"snippet"`
+}
+
+type SearchResults struct {
+	Query string          `json:"query"`
+	Items []*SearchResult `json:"items"`
+}
+
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{pages: map[string]*indexedPage{}, postings: map[string]map[string][]int{}}
+}
+
+// Build indexes every page in the store.
+func (idx *SearchIndex) Build(store PageStore) error {
+	pages, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	for _, item := range pages {
+		p, err := store.Get(item.Title)
+		if err == ErrPageNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		idx.PageSaved(p)
+	}
+
+	return nil
+}
+
+func (idx *SearchIndex) PageSaved(p *Page) {
+	tokens := tokenize(p.Title)
+	for i := range tokens {
+		tokens[i].Start, tokens[i].End = -1, -1
+	}
+	tokens = append(tokens, searchToken{Start: -1, End: -1})
+	tokens = append(tokens, tokenize(p.Body)...)
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.remove(p.Title)
+	idx.pages[p.Title] = &indexedPage{body: p.Body, tokens: tokens}
+	for i, token := range tokens {
+		if len(token.Term) == 0 {
+			continue
+		}
+		if idx.postings[token.Term] == nil {
+			idx.postings[token.Term] = map[string][]int{}
+		}
+		idx.postings[token.Term][p.Title] = append(idx.postings[token.Term][p.Title], i)
+	}
+}
+
+func (idx *SearchIndex) PageRemoved(title string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.remove(title)
+}
+
+func (idx *SearchIndex) remove(title string) {
+	page, ok := idx.pages[title]
+	if !ok {
+		return
+	}
+
+	for _, token := range page.tokens {
+		if titles, ok := idx.postings[token.Term]; ok {
+			delete(titles, title)
+			if len(titles) == 0 {
+				delete(idx.postings, token.Term)
+			}
+		}
+	}
+	delete(idx.pages, title)
+}
+
+// searchClause is a single word or quoted phrase of a query. All clauses
+// must match. A clause ending in * matches its last term as a prefix.
+type searchClause struct {
+	terms  []string
+	prefix bool
+}
+
+func parseQuery(q string) []*searchClause {
+	clauses := []*searchClause{}
+	for len(q) > 0 {
+		q = strings.TrimLeftFunc(q, unicode.IsSpace)
+		if len(q) == 0 {
+			break
+		}
+
+		var text string
+		if q[0] == '"' {
+			end := strings.IndexByte(q[1:], '"')
+			if end < 0 {
+				text, q = q[1:], ""
+			} else {
+				text, q = q[1:end+1], q[end+2:]
+			}
+		} else {
+			end := strings.IndexFunc(q, unicode.IsSpace)
+			if end < 0 {
+				text, q = q, ""
+			} else {
+				text, q = q[:end], q[end:]
+			}
+		}
+
+		clause := &searchClause{prefix: strings.HasSuffix(text, "*")}
+		for _, token := range tokenize(text) {
+			clause.terms = append(clause.terms, token.Term)
+		}
+		if len(clause.terms) > 0 {
+			clauses = append(clauses, clause)
+		}
+	}
+
+	return clauses
+}
+
+// match returns the starting positions of the clause in each matching page.
+func (idx *SearchIndex) match(clause *searchClause) map[string][]int {
+	// candidate positions of the first term
+	first := map[string][]int{}
+	if clause.prefix && len(clause.terms) == 1 {
+		for term, titles := range idx.postings {
+			if strings.HasPrefix(term, clause.terms[0]) {
+				for title, positions := range titles {
+					first[title] = append(first[title], positions...)
+				}
+			}
+		}
+	} else {
+		first = idx.postings[clause.terms[0]]
+	}
+
+	results := map[string][]int{}
+	for title, positions := range first {
+		tokens := idx.pages[title].tokens
+		for _, position := range positions {
+			matched := position+len(clause.terms) <= len(tokens)
+			for i := 1; matched && i < len(clause.terms); i++ {
+				term := tokens[position+i].Term
+				if clause.prefix && i == len(clause.terms)-1 {
+					matched = len(term) > 0 && strings.HasPrefix(term, clause.terms[i])
+				} else {
+					matched = term == clause.terms[i]
+				}
+			}
+			if matched {
+				results[title] = append(results[title], position)
+			}
+		}
+	}
+
+	return results
+}
+
+// Search returns the pages matching every clause of q, ranked by how
+// often the clauses occur in them.
+func (idx *SearchIndex) Search(q string) []*SearchResult {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	clauses := parseQuery(q)
+	if len(clauses) == 0 {
+		return []*SearchResult{}
+	}
+
+	scores := map[string]int{}
+	highlights := map[string]map[int]bool{}
+	for i, clause := range clauses {
+		matches := idx.match(clause)
+		for title := range scores {
+			if _, ok := matches[title]; !ok {
+				delete(scores, title)
+			}
+		}
+		for title, positions := range matches {
+			if _, ok := scores[title]; !ok && i > 0 {
+				continue
+			}
+			scores[title] += len(positions)
+			if highlights[title] == nil {
+				highlights[title] = map[int]bool{}
+			}
+			for _, position := range positions {
+				for j := range clause.terms {
+					highlights[title][position+j] = true
+				}
+			}
+		}
+	}
+
+	results := make([]*SearchResult, 0, len(scores))
+	for title, score := range scores {
+		results = append(results, &SearchResult{Title: title, Score: score, Snippet: idx.snippet(title, highlights[title])})
+	}
+	sort.Sort(byScore(results))
+
+	return results
+}
+
+// snippet returns HTML-escaped body text around the first highlighted body
+// token, with highlighted tokens wrapped in <mark>.
+func (idx *SearchIndex) snippet(title string, highlights map[int]bool) string {
+	page := idx.pages[title]
+
+	marked := []searchToken{}
+	for i, token := range page.tokens {
+		if highlights[i] && token.Start >= 0 {
+			marked = append(marked, token)
+		}
+	}
+
+	start, end := 0, len(page.body)
+	if len(marked) > 0 {
+		start = marked[0].Start - snippetContext
+	}
+	if start > 0 {
+		// begin at a word boundary
+		if space := strings.IndexFunc(page.body[start:marked[0].Start], unicode.IsSpace); space >= 0 {
+			start += space + 1
+		}
+		for start > 0 && !utf8.RuneStart(page.body[start]) {
+			start--
+		}
+	} else {
+		start = 0
+	}
+	if end > start+2*snippetContext {
+		// end at a word boundary after the first match
+		end = start + 2*snippetContext
+		minimum := start
+		if len(marked) > 0 {
+			if end < marked[0].End {
+				end = marked[0].End
+			}
+			minimum = marked[0].End
+		}
+		if space := strings.LastIndexFunc(page.body[minimum:end], unicode.IsSpace); space >= 0 {
+			end = minimum + space
+		}
+		for end < len(page.body) && !utf8.RuneStart(page.body[end]) {
+			end++
+		}
+	}
+
+	snippet := ""
+	if start > 0 {
+		snippet += "…"
+	}
+	position := start
+	for _, token := range marked {
+		if token.Start < start || token.End > end {
+			continue
+		}
+		snippet += html.EscapeString(page.body[position:token.Start]) + "<mark>" + html.EscapeString(page.body[token.Start:token.End]) + "</mark>"
+		position = token.End
+	}
+	snippet += html.EscapeString(page.body[position:end])
+	if end < len(page.body) {
+		snippet += "…"
+	}
+
+	return snippet
+}
+
+type byScore []*SearchResult
+
+func (a byScore) Len() int      { return len(a) }
+func (a byScore) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byScore) Less(i, j int) bool {
+	if a[i].Score != a[j].Score {
+		return a[i].Score > a[j].Score
+	}
+	return a[i].Title < a[j].Title
+}
+
+func CreateSearchHandler(index *SearchIndex, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization")
+
+		switch r.Method {
+		case "OPTIONS":
+			return
+		case "GET":
+			q := r.URL.Query().Get("q")
+			if len(strings.TrimSpace(q)) == 0 {
+				ReturnError(w, r, http.StatusBadRequest, errors.New("No query provided"))
+				return
+			}
+
+			jsonResponse, _ := json.Marshal(&SearchResults{Query: q, Items: index.Search(q)})
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			w.Write(jsonResponse)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSearchIndex(t *testing.T) {
+	index := NewSearchIndex()
+	index.PageSaved(&Page{Title: "BackendRunbook", Body: "Restart the backend server. If the server fails, page the backend team."})
+	index.PageSaved(&Page{Title: "FrontendRunbook", Body: "Rebuild the frontend bundle, then restart the web server."})
+	index.PageSaved(&Page{Title: "Glossary", Body: "Server: a computer. Backend: the part behind the API."})
+
+	tests := []struct {
+		q        string
+		expected []string
+	}{
+		{"server", []string{"BackendRunbook", "FrontendRunbook", "Glossary"}},
+		{"backend", []string{"BackendRunbook", "Glossary"}},
+		{"restart server", []string{"BackendRunbook", "FrontendRunbook"}},
+		{"\"web server\"", []string{"FrontendRunbook"}},
+		{"\"server web\"", []string{}},
+		{"front*", []string{"FrontendRunbook"}},
+		{"\"the back*\"", []string{"BackendRunbook"}},
+		{"missing", []string{}},
+		{"frontendrunbook", []string{"FrontendRunbook"}},
+	}
+	for _, test := range tests {
+		results := index.Search(test.q)
+		titles := []string{}
+		for _, result := range results {
+			titles = append(titles, result.Title)
+		}
+		if strings.Join(titles, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("search for %s got %v, expected %v", test.q, titles, test.expected)
+		}
+	}
+
+	// ranking by term frequency
+	if results := index.Search("server"); results[0].Score != 2 || results[1].Score != 1 {
+		t.Errorf("got scores %d and %d, expected 2 and 1", results[0].Score, results[1].Score)
+	}
+
+	// removal and replacement
+	index.PageRemoved("Glossary")
+	index.PageSaved(&Page{Title: "FrontendRunbook", Body: "Deprecated."})
+	if results := index.Search("server"); len(results) != 1 || results[0].Title != "BackendRunbook" {
+		t.Errorf("got results %v after update, expected only %s", results, "BackendRunbook")
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	index := NewSearchIndex()
+	body := strings.Repeat("filler words here ", 20) + "the <b>backend</b> server " + strings.Repeat("more filler ", 20)
+	index.PageSaved(&Page{Title: "TestPage", Body: body})
+
+	results := index.Search("backend")
+	if len(results) != 1 {
+		t.Fatalf("got %d results, expected %d", len(results), 1)
+	}
+	snippet := results[0].Snippet
+	if !strings.Contains(snippet, "&lt;b&gt;<mark>backend</mark>&lt;/b&gt; server") {
+		t.Errorf("got snippet %q, expected escaped text with highlighted match", snippet)
+	}
+	if !strings.HasPrefix(snippet, "…filler") || !strings.HasSuffix(snippet, "…") {
+		t.Errorf("got snippet %q, expected text trimmed to words on both sides", snippet)
+	}
+}
+
+func TestSearchGet(t *testing.T) {
+	store := NewMemoryPageStore()
+
+	// pages stored before startup are indexed
+	p := &Page{Title: "TestPage", Body: "Test result"}
+	if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("creating test page returned error %v", err)
+	}
+
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	// pages saved through the API are indexed
+	postBytes, err := json.Marshal(map[string]string{"body": "Another result"})
+	if err != nil {
+		t.Fatalf("serializing post data returned error %v", err)
+	}
+	if _, _, err := MakeRequest(router, "POST", "/page/OtherPage", postBytes, a); err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+
+	r, dat, err := MakeRequest(router, "GET", "/search?q=result", nil, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+
+	// authorization headers
+	CheckAuthHeader("test", "test", r, t)
+
+	if q, _ := dat["query"].(string); q != "result" {
+		t.Errorf("got query %s, expected %s", q, "result")
+	}
+	if items, _ := dat["items"].([]interface{}); len(items) != 2 {
+		t.Errorf("got %d results, expected %d", len(items), 2)
+	} else if snippet := items[0].(map[string]interface{})["snippet"].(string); !strings.Contains(snippet, "<mark>result</mark>") {
+		t.Errorf("got snippet %s, expected highlighted match", snippet)
+	}
+
+	// deleted pages are removed from the index
+	if _, _, err := MakeRequest(router, "DELETE", "/page/TestPage", []byte{}, a); err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	_, dat, err = MakeRequest(router, "GET", "/search?q=result", nil, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if items, _ := dat["items"].([]interface{}); len(items) != 1 {
+		t.Errorf("got %d results after delete, expected %d", len(items), 1)
+	}
+
+	// restored pages are indexed again
+	if _, _, err := MakeRequest(router, "POST", "/trash/TestPage/restore", []byte{}, a); err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	_, dat, err = MakeRequest(router, "GET", "/search?q=result", nil, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if items, _ := dat["items"].([]interface{}); len(items) != 2 {
+		t.Errorf("got %d results after restore, expected %d", len(items), 2)
+	}
+
+	// empty query
+	r, _, err = MakeRequest(router, "GET", "/search?q=", nil, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if r.Code != 400 {
+		t.Errorf("got response code = %d, expected %d", r.Code, 400)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrPageNotFound = errors.New("Page not found")
+var ErrRevisionNotFound = errors.New("Revision not found")
+var ErrPageExists = errors.New("Page already exists")
+
+// PageStore is the storage behind the page handlers.
+type PageStore interface {
+	// Get returns the stored page with its metadata, or ErrPageNotFound.
+	Get(title string) (*Page, error)
+	// Put creates or replaces the page and records r as its newest
+	// revision, assigning r.ID. The page's metadata is updated from r and
+	// set on p.
+	Put(p *Page, r *Revision) error
+	// Delete moves the page and its revisions to the trash, replacing any
+	// earlier trashed page with the same title, or returns ErrPageNotFound.
+	Delete(title string) error
+	// List returns every stored page with its tags and metadata but
+	// without its body.
+	List() ([]*Page, error)
+	// Revisions returns the page's revisions oldest first, without their
+	// bodies, or ErrPageNotFound if the page has neither a body nor any
+	// revisions.
+	Revisions(title string) ([]*Revision, error)
+	// Revision returns a single revision including its body, or
+	// ErrRevisionNotFound.
+	Revision(title string, id string) (*Revision, error)
+	// Trash returns every page in the trash.
+	Trash() ([]*TrashedPage, error)
+	// Restore moves a page and its revisions back out of the trash. It
+	// returns ErrPageNotFound if the page is not in the trash, or
+	// ErrPageExists if the title has been reused since.
+	Restore(title string) error
+	// Purge permanently removes a page from the trash, or returns
+	// ErrPageNotFound.
+	Purge(title string) error
+	// Move gives a page and its revisions and metadata a new title. It
+	// returns ErrPageNotFound if the page does not exist, or ErrPageExists
+	// if the destination does.
+	Move(title string, destination string) error
+}
+
+// AuthoredPageStore is implemented by stores that record who makes every
+// change. Saves are attributed to the author of their revision, and
+// ForAuthor returns the store with its other changes attributed to author.
+type AuthoredPageStore interface {
+	PageStore
+	ForAuthor(author string) PageStore
+}
+
+// MemoryPageStore keeps pages in memory. It is safe for concurrent use.
+type MemoryPageStore struct {
+	mu        sync.RWMutex
+	pages     map[string]*Page
+	revisions map[string][]*Revision
+	trash     map[string]*memoryTrashedPage
+}
+
+type memoryTrashedPage struct {
+	trashed   *TrashedPage
+	page      *Page
+	revisions []*Revision
+}
+
+func NewMemoryPageStore() *MemoryPageStore {
+	return &MemoryPageStore{pages: map[string]*Page{}, revisions: map[string][]*Revision{}, trash: map[string]*memoryTrashedPage{}}
+}
+
+func (s *MemoryPageStore) Get(title string) (*Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.pages[title]
+	if !ok {
+		return nil, ErrPageNotFound
+	}
+	result := *p
+	metadata := *p.Metadata
+	result.Metadata = &metadata
+
+	return &result, nil
+}
+
+func (s *MemoryPageStore) Put(p *Page, r *Revision) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.ID = strconv.Itoa(len(s.revisions[p.Title]) + 1)
+	stored := *r
+	s.revisions[p.Title] = append(s.revisions[p.Title], &stored)
+
+	var previous *PageMetadata
+	if existing, ok := s.pages[p.Title]; ok {
+		previous = existing.Metadata
+	}
+	p.Metadata = updateMetadata(previous, p, r)
+	metadata := *p.Metadata
+	s.pages[p.Title] = &Page{Title: p.Title, DisplayTitle: p.DisplayTitle, Redirect: p.Redirect, Body: p.Body, Tags: append([]string(nil), p.Tags...), Metadata: &metadata}
+
+	return nil
+}
+
+func (s *MemoryPageStore) Delete(title string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pages[title]
+	if !ok {
+		return ErrPageNotFound
+	}
+
+	s.trash[title] = &memoryTrashedPage{
+		trashed:   &TrashedPage{Title: title, Deleted: time.Now().UTC()},
+		page:      p,
+		revisions: s.revisions[title],
+	}
+	delete(s.pages, title)
+	delete(s.revisions, title)
+
+	return nil
+}
+
+func (s *MemoryPageStore) List() ([]*Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := make([]*Page, 0, len(s.pages))
+	for title, p := range s.pages {
+		metadata := *p.Metadata
+		results = append(results, &Page{Title: title, DisplayTitle: p.DisplayTitle, Redirect: p.Redirect, Tags: p.Tags, Metadata: &metadata})
+	}
+	sort.Sort(byTitle(results))
+
+	return results, nil
+}
+
+func (s *MemoryPageStore) Revisions(title string) ([]*Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, exists := s.pages[title]
+	if !exists && len(s.revisions[title]) == 0 {
+		return nil, ErrPageNotFound
+	}
+
+	results := make([]*Revision, len(s.revisions[title]))
+	for i, r := range s.revisions[title] {
+		summary := *r
+		summary.Body = ""
+		results[i] = &summary
+	}
+
+	return results, nil
+}
+
+func (s *MemoryPageStore) Revision(title string, id string) (*Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, r := range s.revisions[title] {
+		if r.ID == id {
+			result := *r
+			return &result, nil
+		}
+	}
+
+	return nil, ErrRevisionNotFound
+}
+
+func (s *MemoryPageStore) Trash() ([]*TrashedPage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := make([]*TrashedPage, 0, len(s.trash))
+	for _, t := range s.trash {
+		trashed := *t.trashed
+		results = append(results, &trashed)
+	}
+	sort.Sort(byDeletion(results))
+
+	return results, nil
+}
+
+func (s *MemoryPageStore) Restore(title string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.trash[title]
+	if !ok {
+		return ErrPageNotFound
+	}
+	if _, ok := s.pages[title]; ok {
+		return ErrPageExists
+	}
+
+	s.pages[title] = t.page
+	s.revisions[title] = t.revisions
+	delete(s.trash, title)
+
+	return nil
+}
+
+func (s *MemoryPageStore) Purge(title string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.trash[title]; !ok {
+		return ErrPageNotFound
+	}
+	delete(s.trash, title)
+
+	return nil
+}
+
+func (s *MemoryPageStore) Move(title string, destination string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pages[title]
+	if !ok {
+		return ErrPageNotFound
+	}
+	if _, ok := s.pages[destination]; ok {
+		return ErrPageExists
+	}
+
+	p.Title = destination
+	s.pages[destination] = p
+	s.revisions[destination] = s.revisions[title]
+	delete(s.pages, title)
+	delete(s.revisions, title)
+
+	return nil
+}
+
+// updateMetadata returns the metadata of p after it is saved as r.
+// previous is the metadata before the save, or nil for a new page.
+func updateMetadata(previous *PageMetadata, p *Page, r *Revision) *PageMetadata {
+	metadata := &PageMetadata{Created: r.Timestamp}
+	if previous != nil {
+		*metadata = *previous
+	}
+	metadata.Modified = r.Timestamp
+	metadata.Author = r.Author
+	metadata.Size = len(p.Body)
+	metadata.Revisions++
+
+	return metadata
+}
+
+type byTitle []*Page
+
+func (a byTitle) Len() int           { return len(a) }
+func (a byTitle) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTitle) Less(i, j int) bool { return a[i].Title < a[j].Title }
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func CheckPageStore(store PageStore, t *testing.T) {
+	// missing page
+	if _, err := store.Get("TestPage"); err != ErrPageNotFound {
+		t.Errorf("got error %v loading missing page, expected %v", err, ErrPageNotFound)
+	}
+	if err := store.Delete("TestPage"); err != ErrPageNotFound {
+		t.Errorf("got error %v deleting missing page, expected %v", err, ErrPageNotFound)
+	}
+
+	// create and replace
+	for _, body := range []string{"Test result", "Test result updated"} {
+		p := &Page{Title: "TestPage", Body: body, Tags: []string{"test"}}
+		if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("saving page returned error %v", err)
+		}
+		if p, err := store.Get("TestPage"); err != nil {
+			t.Fatalf("loading page returned error %v", err)
+		} else if p.Body != body {
+			t.Errorf("got body %s, expected %s", p.Body, body)
+		}
+	}
+
+	// metadata
+	if p, err := store.Get("TestPage"); err != nil {
+		t.Fatalf("loading page returned error %v", err)
+	} else if m := p.Metadata; m == nil {
+		t.Errorf("got no metadata")
+	} else {
+		if len(p.Tags) != 1 || p.Tags[0] != "test" {
+			t.Errorf("got tags %v, expected [test]", p.Tags)
+		}
+		if m.Revisions != 2 || m.Size != len("Test result updated") || m.Author != "test" {
+			t.Errorf("got metadata %+v, expected 2 revisions of size %d by %s", m, len("Test result updated"), "test")
+		}
+		if m.Created.IsZero() || m.Modified.Before(m.Created) {
+			t.Errorf("got created %v and modified %v", m.Created, m.Modified)
+		}
+	}
+
+	// revisions
+	if revisions, err := store.Revisions("TestPage"); err != nil {
+		t.Fatalf("listing revisions returned error %v", err)
+	} else if len(revisions) != 2 {
+		t.Errorf("got %d revisions, expected %d", len(revisions), 2)
+	} else {
+		for i, r := range revisions {
+			if r.ID != strconv.Itoa(i+1) {
+				t.Errorf("got revision id %s, expected %d", r.ID, i+1)
+			}
+			if r.Author != "test" {
+				t.Errorf("got revision author %s, expected %s", r.Author, "test")
+			}
+			if r.Body != "" {
+				t.Errorf("got revision body %s in list, expected none", r.Body)
+			}
+		}
+	}
+	if r, err := store.Revision("TestPage", "1"); err != nil {
+		t.Fatalf("loading revision returned error %v", err)
+	} else if r.Body != "Test result" {
+		t.Errorf("got revision body %s, expected %s", r.Body, "Test result")
+	}
+	if _, err := store.Revision("TestPage", "3"); err != ErrRevisionNotFound {
+		t.Errorf("got error %v loading missing revision, expected %v", err, ErrRevisionNotFound)
+	}
+	if _, err := store.Revisions("MissingPage"); err != ErrPageNotFound {
+		t.Errorf("got error %v listing revisions of missing page, expected %v", err, ErrPageNotFound)
+	}
+
+	// list
+	if err := store.Put(&Page{Title: "OtherPage", Body: "Other result"}, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("saving page returned error %v", err)
+	}
+	if pages, err := store.List(); err != nil {
+		t.Fatalf("listing pages returned error %v", err)
+	} else if len(pages) != 2 {
+		t.Errorf("got %d pages, expected %d", len(pages), 2)
+	}
+
+	// delete
+	if err := store.Delete("TestPage"); err != nil {
+		t.Fatalf("deleting page returned error %v", err)
+	}
+	if _, err := store.Get("TestPage"); err != ErrPageNotFound {
+		t.Errorf("got error %v loading deleted page, expected %v", err, ErrPageNotFound)
+	}
+	if pages, err := store.List(); err != nil {
+		t.Fatalf("listing pages returned error %v", err)
+	} else if len(pages) != 1 || pages[0].Title != "OtherPage" {
+		t.Errorf("got pages %v, expected only %s", pages, "OtherPage")
+	}
+	if _, err := store.Revisions("TestPage"); err != ErrPageNotFound {
+		t.Errorf("got error %v listing revisions of deleted page, expected %v", err, ErrPageNotFound)
+	}
+
+	// trash
+	if trashed, err := store.Trash(); err != nil {
+		t.Fatalf("listing trash returned error %v", err)
+	} else if len(trashed) != 1 || trashed[0].Title != "TestPage" || trashed[0].Deleted.IsZero() {
+		t.Errorf("got trash %v, expected only %s", trashed, "TestPage")
+	}
+	if err := store.Restore("MissingPage"); err != ErrPageNotFound {
+		t.Errorf("got error %v restoring missing page, expected %v", err, ErrPageNotFound)
+	}
+	if err := store.Restore("TestPage"); err != nil {
+		t.Fatalf("restoring page returned error %v", err)
+	}
+	if p, err := store.Get("TestPage"); err != nil {
+		t.Fatalf("loading restored page returned error %v", err)
+	} else if p.Body != "Test result updated" {
+		t.Errorf("got restored body %s, expected %s", p.Body, "Test result updated")
+	}
+	if revisions, err := store.Revisions("TestPage"); err != nil {
+		t.Fatalf("listing revisions of restored page returned error %v", err)
+	} else if len(revisions) != 2 {
+		t.Errorf("got %d revisions of restored page, expected %d", len(revisions), 2)
+	}
+	if trashed, err := store.Trash(); err != nil {
+		t.Fatalf("listing trash returned error %v", err)
+	} else if len(trashed) != 0 {
+		t.Errorf("got trash %v after restore, expected none", trashed)
+	}
+
+	// a reused title cannot be restored over
+	if err := store.Delete("TestPage"); err != nil {
+		t.Fatalf("deleting page returned error %v", err)
+	}
+	if err := store.Put(&Page{Title: "TestPage", Body: "Test result reused"}, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("saving page returned error %v", err)
+	}
+	if err := store.Restore("TestPage"); err != ErrPageExists {
+		t.Errorf("got error %v restoring over existing page, expected %v", err, ErrPageExists)
+	}
+
+	// purge
+	if err := store.Purge("TestPage"); err != nil {
+		t.Fatalf("purging page returned error %v", err)
+	}
+	if err := store.Purge("TestPage"); err != ErrPageNotFound {
+		t.Errorf("got error %v purging purged page, expected %v", err, ErrPageNotFound)
+	}
+	if p, err := store.Get("TestPage"); err != nil {
+		t.Fatalf("loading page returned error %v", err)
+	} else if p.Body != "Test result reused" {
+		t.Errorf("got body %s after purge, expected %s", p.Body, "Test result reused")
+	}
+
+	// move
+	if err := store.Put(&Page{Title: "OtherPage", Body: "Test result"}, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("saving page returned error %v", err)
+	}
+	if err := store.Move("TestPage", "OtherPage"); err != ErrPageExists {
+		t.Errorf("got error %v moving onto existing page, expected %v", err, ErrPageExists)
+	}
+	if err := store.Move("MissingPage", "NewPage"); err != ErrPageNotFound {
+		t.Errorf("got error %v moving missing page, expected %v", err, ErrPageNotFound)
+	}
+	if err := store.Move("TestPage", "Moved/TestPage"); err != nil {
+		t.Fatalf("moving page returned error %v", err)
+	}
+	if _, err := store.Get("TestPage"); err != ErrPageNotFound {
+		t.Errorf("got error %v loading moved page by old title, expected %v", err, ErrPageNotFound)
+	}
+	if p, err := store.Get("Moved/TestPage"); err != nil {
+		t.Fatalf("loading moved page returned error %v", err)
+	} else if p.Title != "Moved/TestPage" || p.Body != "Test result reused" || p.Metadata.Revisions != 1 {
+		t.Errorf("got page %+v after move, expected its body and metadata to be kept", p)
+	}
+	if revisions, err := store.Revisions("Moved/TestPage"); err != nil || len(revisions) != 1 {
+		t.Errorf("got revisions %v and error %v after move, expected %d", revisions, err, 1)
+	}
+
+	// the trash is listed in the order pages were deleted
+	for _, title := range []string{"Trashed/Second", "Trashed/First"} {
+		if err := store.Put(&Page{Title: title, Body: "Test result"}, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("saving page returned error %v", err)
+		}
+		if err := store.Delete(title); err != nil {
+			t.Fatalf("deleting page returned error %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if trashed, err := store.Trash(); err != nil {
+		t.Fatalf("listing trash returned error %v", err)
+	} else if len(trashed) != 2 || trashed[0].Title != "Trashed/Second" || trashed[1].Title != "Trashed/First" {
+		t.Errorf("got trash %v, expected the pages in the order they were deleted", trashed)
+	}
+}
+
+func TestMemoryPageStore(t *testing.T) {
+	CheckPageStore(NewMemoryPageStore(), t)
+}
+
+func TestFilePageStore(t *testing.T) {
+	directory, err := ioutil.TempDir("", "rest-wiki-site")
+	if err != nil {
+		t.Fatalf("creating data directory returned error %v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	store, err := NewFilePageStore(filepath.Join(directory, "data"))
+	if err != nil {
+		t.Fatalf("opening file store returned error %v", err)
+	}
+	if info, err := os.Stat(store.Directory); err != nil {
+		t.Fatalf("data directory was not created: %v", err)
+	} else if info.Mode().Perm() != 0700 {
+		t.Errorf("got data directory mode %v, expected %v", info.Mode().Perm(), os.FileMode(0700))
+	}
+
+	CheckPageStore(store, t)
+}
+
+func TestFilePageStoreFailedWrite(t *testing.T) {
+	directory, err := ioutil.TempDir("", "rest-wiki-site")
+	if err != nil {
+		t.Fatalf("creating data directory returned error %v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	store, err := NewFilePageStore(directory)
+	if err != nil {
+		t.Fatalf("opening file store returned error %v", err)
+	}
+
+	p := &Page{Title: "TestPage", Body: "Test result"}
+	if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("saving page returned error %v", err)
+	}
+
+	// fail every sync
+	defer func(original func(*os.File) error) { syncFile = original }(syncFile)
+	syncFile = func(f *os.File) error {
+		return errors.New("No space left on device")
+	}
+
+	p.Body = "Test result updated"
+	if err := p.Save(store, &Revision{Author: "test"}); err == nil {
+		t.Fatalf("saving page with failing sync returned no error")
+	}
+
+	if stored, err := store.Get("TestPage"); err != nil {
+		t.Fatalf("loading page returned error %v", err)
+	} else if stored.Body != "Test result" {
+		t.Errorf("got body %s after failed write, expected %s", stored.Body, "Test result")
+	}
+
+	// no temporary files are left behind
+	if files, err := ioutil.ReadDir(directory); err != nil {
+		t.Fatalf("reading data directory returned error %v", err)
+	} else {
+		for _, file := range files {
+			if strings.HasPrefix(file.Name(), ".tmp-") {
+				t.Errorf("temporary file %s left after failed write", file.Name())
+			}
+		}
+	}
+}
+
+func TestFilePageStoreIgnoresTemporaryFiles(t *testing.T) {
+	directory, err := ioutil.TempDir("", "rest-wiki-site")
+	if err != nil {
+		t.Fatalf("creating data directory returned error %v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	store, err := NewFilePageStore(directory)
+	if err != nil {
+		t.Fatalf("opening file store returned error %v", err)
+	}
+
+	// simulate a crash between writing and renaming
+	for _, name := range []string{"TestPage.txt", ".tmp-123456", ".tmp-TestPage.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(directory, name), []byte("Test result"), 0600); err != nil {
+			t.Fatalf("creating test file returned error %v", err)
+		}
+	}
+
+	if pages, err := store.List(); err != nil {
+		t.Fatalf("listing pages returned error %v", err)
+	} else if len(pages) != 1 || pages[0].Title != "TestPage" {
+		t.Errorf("got pages %v, expected only %s", pages, "TestPage")
+	}
+}
+
+func TestFilePageStoreNested(t *testing.T) {
+	directory, err := ioutil.TempDir("", "rest-wiki-site")
+	if err != nil {
+		t.Fatalf("creating data directory returned error %v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	store, err := NewFilePageStore(directory)
+	if err != nil {
+		t.Fatalf("opening file store returned error %v", err)
+	}
+
+	for _, title := range []string{"Team", "Team/Backend", "Team/Backend/Runbook"} {
+		p := &Page{Title: title, Body: "Test result"}
+		if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("saving page %s returned error %v", title, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(directory, "Team", "Backend", "Runbook.txt")); err != nil {
+		t.Errorf("nested page was not stored in a subdirectory: %v", err)
+	}
+
+	if pages, err := store.List(); err != nil {
+		t.Fatalf("listing pages returned error %v", err)
+	} else if len(pages) != 3 || pages[0].Title != "Team" || pages[2].Title != "Team/Backend/Runbook" {
+		t.Errorf("got pages %v, expected %d nested pages", pages, 3)
+	}
+
+	// deleting a parent leaves its children and their history alone
+	if err := store.Delete("Team"); err != nil {
+		t.Fatalf("deleting page returned error %v", err)
+	}
+	if revisions, err := store.Revisions("Team/Backend"); err != nil || len(revisions) != 1 {
+		t.Errorf("got revisions %v and error %v for child of deleted page, expected %d", revisions, err, 1)
+	}
+	if err := store.Restore("Team"); err != nil {
+		t.Fatalf("restoring page returned error %v", err)
+	}
+
+	// deleting the last page of a directory removes it
+	if err := store.Delete("Team/Backend/Runbook"); err != nil {
+		t.Fatalf("deleting page returned error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(directory, "Team", "Backend")); !os.IsNotExist(err) {
+		t.Errorf("got error %v checking empty directory, expected it to be removed", err)
+	}
+	if trash, err := store.Trash(); err != nil || len(trash) != 1 || trash[0].Title != "Team/Backend/Runbook" {
+		t.Errorf("got trash %v and error %v, expected %s", trash, err, "Team/Backend/Runbook")
+	}
+
+	// titles escaping the data directory
+	if err := ioutil.WriteFile(filepath.Join(directory, "..", "Secret.txt"), []byte("Secret"), 0600); err == nil {
+		defer os.Remove(filepath.Join(directory, "..", "Secret.txt"))
+	}
+	for _, title := range []string{"../Secret", "Team/../../Secret", "/Secret", "Team//Backend"} {
+		if _, err := store.Get(title); err != ErrPageNotFound {
+			t.Errorf("got error %v loading %s, expected %v", err, title, ErrPageNotFound)
+		}
+		if err := store.Put(&Page{Title: title}, &Revision{Author: "test"}); err != ErrInvalidTitle {
+			t.Errorf("got error %v saving %s, expected %v", err, title, ErrInvalidTitle)
+		}
+	}
+}
+
+func TestFilePageStoreUnicodeTitles(t *testing.T) {
+	directory, err := ioutil.TempDir("", "rest-wiki-site")
+	if err != nil {
+		t.Fatalf("creating data directory returned error %v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	store, err := NewFilePageStore(directory)
+	if err != nil {
+		t.Fatalf("opening file store returned error %v", err)
+	}
+
+	titles := []string{"Café", "日本語/ページ", "v1.2: Notes?", "100% done", ".profile", "Back\\slash"}
+	for _, title := range titles {
+		p := &Page{Title: title, Body: "Test result"}
+		if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("saving page %s returned error %v", title, err)
+		}
+	}
+
+	// every title is stored under a safe name and read back unchanged
+	if _, err := os.Stat(filepath.Join(directory, "v1.2%3A Notes%3F.txt")); err != nil {
+		t.Errorf("page was not stored under its encoded name: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(directory, "%2Eprofile.txt")); err != nil {
+		t.Errorf("page was not stored under its encoded name: %v", err)
+	}
+	if pages, err := store.List(); err != nil {
+		t.Fatalf("listing pages returned error %v", err)
+	} else if len(pages) != len(titles) {
+		t.Errorf("got %d pages, expected %d", len(pages), len(titles))
+	}
+	for _, title := range titles {
+		if p, err := store.Get(title); err != nil {
+			t.Errorf("loading page %s returned error %v", title, err)
+		} else if p.Title != title {
+			t.Errorf("got title %s, expected %s", p.Title, title)
+		}
+	}
+
+	// decomposed titles name the same page
+	p := &Page{Title: "Cafe\u0301", Body: "Test result updated"}
+	if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("saving page returned error %v", err)
+	}
+	if p, err := store.Get("Café"); err != nil || p.Body != "Test result updated" || p.Metadata.Revisions != 2 {
+		t.Errorf("got page %v and error %v, expected the composed page to be updated", p, err)
+	}
+
+	// deleting the last page under encoded directories removes them
+	nested := &Page{Title: "Équipe: Backend/Notes?/Runbook", Body: "Test result"}
+	if err := nested.Save(store, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("saving page returned error %v", err)
+	}
+	if err := store.Delete(nested.Title); err != nil {
+		t.Fatalf("deleting page returned error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(directory, titlePath("Équipe: Backend"))); !os.IsNotExist(err) {
+		t.Errorf("got error %v checking empty directory, expected it to be removed", err)
+	}
+
+	// titles too long for a file name
+	if err := store.Put(&Page{Title: strings.Repeat("日", 100)}, &Revision{}); err != ErrInvalidTitle {
+		t.Errorf("got error %v saving long title, expected %v", err, ErrInvalidTitle)
+	}
+}
+
+func TestFilePageStoreMigrateFilenames(t *testing.T) {
+	directory, err := ioutil.TempDir("", "rest-wiki-site")
+	if err != nil {
+		t.Fatalf("creating data directory returned error %v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	// files written by hand or by earlier versions
+	if err := os.MkdirAll(filepath.Join(directory, ".history", "Cafe\u0301"), 0700); err != nil {
+		t.Fatalf("creating history directory returned error %v", err)
+	}
+	for name, data := range map[string]string{
+		"Cafe\u0301.txt":             "Test result",
+		"Cafe\u0301.json":            `{"title":"Cafe\u0301","tags":["test"]}`,
+		".history/Cafe\u0301/1.json": `{"id":"1","author":"test"}`,
+		"What?.txt":                  "Test result",
+		"Plain.txt":                  "Test result",
+		"100%25.txt":                 "Test result",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(directory, name), []byte(data), 0600); err != nil {
+			t.Fatalf("creating test file returned error %v", err)
+		}
+	}
+
+	store, err := NewFilePageStore(directory)
+	if err != nil {
+		t.Fatalf("opening file store returned error %v", err)
+	}
+	migrated, err := store.MigrateFilenames()
+	if err != nil {
+		t.Fatalf("migrating file names returned error %v", err)
+	} else if strings.Join(migrated, ",") != "Café,What?" {
+		t.Errorf("got migrated pages %v, expected %s", migrated, "Café,What?")
+	}
+
+	if pages, err := store.List(); err != nil {
+		t.Fatalf("listing pages returned error %v", err)
+	} else if len(pages) != 4 {
+		t.Errorf("got pages %v, expected %d", pages, 4)
+	}
+	if p, err := store.Get("Café"); err != nil {
+		t.Fatalf("loading migrated page returned error %v", err)
+	} else if len(p.Tags) != 1 || p.Tags[0] != "test" {
+		t.Errorf("got tags %v, expected the migrated sidecar's", p.Tags)
+	}
+	if revisions, err := store.Revisions("Café"); err != nil || len(revisions) != 1 {
+		t.Errorf("got revisions %v and error %v, expected the migrated history", revisions, err)
+	}
+	if _, err := store.Get("100%"); err != nil {
+		t.Errorf("loading encoded page returned error %v", err)
+	}
+
+	// migrating again changes nothing
+	if migrated, err := store.MigrateFilenames(); err != nil || len(migrated) != 0 {
+		t.Errorf("got migrated pages %v and error %v, expected none", migrated, err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+type TagCounts struct {
+	Items []*TagCount `json:"items"`
+}
+
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// normalizeTags lower-cases tags and returns them sorted without blanks or
+// duplicates.
+func normalizeTags(tags []string) []string {
+	seen := map[string]bool{}
+	results := []string{}
+	for _, tag := range tags {
+		tag = normalizeTag(tag)
+		if len(tag) != 0 && !seen[tag] {
+			seen[tag] = true
+			results = append(results, tag)
+		}
+	}
+	sort.Strings(results)
+
+	if len(results) == 0 {
+		return nil
+	}
+
+	return results
+}
+
+// getTags counts the pages carrying each tag.
+func getTags(store PageStore) (*TagCounts, error) {
+	pages, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{}
+	for _, p := range pages {
+		for _, tag := range p.Tags {
+			counts[tag]++
+		}
+	}
+
+	results := &TagCounts{Items: make([]*TagCount, 0, len(counts))}
+	for tag, count := range counts {
+		results.Items = append(results.Items, &TagCount{Tag: tag, Count: count})
+	}
+	sort.Sort(byTag(results.Items))
+
+	return results, nil
+}
+
+type byTag []*TagCount
+
+func (a byTag) Len() int           { return len(a) }
+func (a byTag) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTag) Less(i, j int) bool { return a[i].Tag < a[j].Tag }
+
+func CreateTagListHandler(store PageStore, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization")
+
+		switch r.Method {
+		case "OPTIONS":
+			return
+		case "GET":
+			tags, err := getTags(store)
+			if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			jsonResponse, _ := json.Marshal(tags)
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			w.Write(jsonResponse)
+		}
+	}
+}
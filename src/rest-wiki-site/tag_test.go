@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func CreateTaggedPages(store PageStore, t *testing.T) {
+	for title, tags := range map[string][]string{
+		"BackendRunbook":  {"backend", "Runbook"},
+		"FrontendRunbook": {"frontend", "runbook "},
+		"BackendDesign":   {"backend", "design"},
+		"Untagged":        nil,
+	} {
+		p := &Page{Title: title, Body: "Test result", Tags: tags}
+		if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("creating test page returned error %v", err)
+		}
+	}
+}
+
+func TestPagePostTags(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	postBytes, err := json.Marshal(map[string]interface{}{"body": "Test result", "tags": []string{"Runbook", "backend", "runbook", ""}})
+	if err != nil {
+		t.Fatalf("serializing post data returned error %v", err)
+	}
+	if r, _, err := MakeRequest(router, "POST", "/page/TestPage", postBytes, a); err != nil {
+		t.Fatalf("running request returned error %v", err)
+	} else if r.Code != 200 {
+		t.Fatalf("got response code = %d, expected %d", r.Code, 200)
+	}
+
+	// tags are normalised and persisted
+	_, dat, err := MakeRequest(router, "GET", "/page/TestPage", nil, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	tags, _ := dat["tags"].([]interface{})
+	if len(tags) != 2 || tags[0].(string) != "backend" || tags[1].(string) != "runbook" {
+		t.Errorf("got tags %v, expected [backend runbook]", tags)
+	}
+}
+
+func TestTagListGet(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+	CreateTaggedPages(store, t)
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	r, dat, err := MakeRequest(router, "GET", "/tag", nil, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+
+	// authorization headers
+	CheckAuthHeader("test", "test", r, t)
+
+	expected := []struct {
+		tag   string
+		count int
+	}{
+		{"backend", 2},
+		{"design", 1},
+		{"frontend", 1},
+		{"runbook", 2},
+	}
+	items, _ := dat["items"].([]interface{})
+	if len(items) != len(expected) {
+		t.Fatalf("got %d tags, expected %d", len(items), len(expected))
+	}
+	for i, e := range expected {
+		item := items[i].(map[string]interface{})
+		if item["tag"].(string) != e.tag || int(item["count"].(float64)) != e.count {
+			t.Errorf("got tag %v, expected %s with count %d", item, e.tag, e.count)
+		}
+	}
+}
+
+func TestPageListGetByTag(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+	CreateTaggedPages(store, t)
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	tests := []struct {
+		url      string
+		expected []string
+	}{
+		{"/page?tag=backend", []string{"BackendDesign", "BackendRunbook"}},
+		{"/page?tag=backend&tag=runbook", []string{"BackendRunbook"}},
+		{"/page?tag=backend&tag=runbook&match=any", []string{"BackendDesign", "BackendRunbook", "FrontendRunbook"}},
+		{"/page?tag=missing", []string{}},
+	}
+	for _, test := range tests {
+		_, dat, err := MakeRequest(router, "GET", test.url, nil, a)
+		if err != nil {
+			t.Fatalf("running request returned error %v", err)
+		}
+
+		items, _ := dat["items"].([]interface{})
+		titles := []string{}
+		for _, item := range items {
+			titles = append(titles, item.(map[string]interface{})["title"].(string))
+		}
+		if len(titles) != len(test.expected) {
+			t.Errorf("got pages %v from %s, expected %v", titles, test.url, test.expected)
+			continue
+		}
+		for i := range titles {
+			if titles[i] != test.expected[i] {
+				t.Errorf("got pages %v from %s, expected %v", titles, test.url, test.expected)
+				break
+			}
+		}
+	}
+}
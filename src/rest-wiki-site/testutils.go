@@ -24,7 +24,8 @@ func SignRequest(r *http.Request, method string, url string, body []byte, a *Aut
 		hasher.Write([]byte(body))
 		bodyhash = hex.EncodeToString(hasher.Sum(nil))
 	}
-	message := fmt.Sprintf("%s\n%s\n%s", method, url, bodyhash)
+	// the server signs the decoded path, without the query string
+	message := fmt.Sprintf("%s\n%s\n%s", method, r.URL.Path, bodyhash)
 
 	// sign message
 	key := []byte(a.Signature)
@@ -84,8 +85,15 @@ func GetAuthorization(router *mux.Router) (*Authentication, error) {
 }
 
 func MakeRequest(router *mux.Router, method string, url string, body []byte, a *Authentication) (*httptest.ResponseRecorder, map[string]interface{}, error) {
+	return MakeRequestWithHeaders(router, method, url, body, nil, a)
+}
+
+func MakeRequestWithHeaders(router *mux.Router, method string, url string, body []byte, headers map[string]string, a *Authentication) (*httptest.ResponseRecorder, map[string]interface{}, error) {
 	w := httptest.NewRecorder()
 	r, _ := http.NewRequest(method, url, bytes.NewBuffer(body))
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
 	if a != nil {
 		SignRequest(r, method, url, body, a)
 	}
@@ -100,6 +108,16 @@ func MakeRequest(router *mux.Router, method string, url string, body []byte, a *
 	return w, dat, nil
 }
 
+// MakeUnauthenticatedRequest serves a request with handler routed at
+// pattern on its own, so that it has no signed-in user.
+func MakeUnauthenticatedRequest(handler http.HandlerFunc, pattern string, method string, url string) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.HandleFunc(pattern, handler)
+	w, _, _ := MakeRequest(router, method, url, nil, nil)
+
+	return w
+}
+
 func RemoveIfExists(filename string) error {
 	switch _, err := os.Stat(filename); {
 	case err != nil && os.IsNotExist(err):
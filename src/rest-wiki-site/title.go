@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"github.com/gorilla/mux"
+	"golang.org/x/text/unicode/norm"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// titleSegmentPattern matches one slash-separated part of a page title.
+// Segments may hold any characters; ValidTitle rejects the unsafe ones.
+const titleSegmentPattern = "[^/]+"
+
+// titlePattern matches a page title: one or more segments separated by
+// slashes, as in Team/Backend/Runbook.
+const titlePattern = titleSegmentPattern + "(?:/" + titleSegmentPattern + ")*"
+
+var ErrInvalidTitle = errors.New("Invalid page title")
+
+// reservedSegments name the sub-resources routed below /page/{title} and
+// /trash/{title}. They cannot follow the first segment of a title, or the
+// page would be shadowed by its parent's sub-resource.
+var reservedSegments = map[string]bool{"revisions": true, "revert": true, "diff": true, "move": true, "backlinks": true, "attachments": true, "restore": true}
+
+// NormalizeTitle returns title in Unicode normalization form C, so that
+// titles which look the same name the same page.
+func NormalizeTitle(title string) string {
+	return norm.NFC.String(title)
+}
+
+// GetTitle returns the normalized title from the request's route.
+func GetTitle(r *http.Request) string {
+	return NormalizeTitle(mux.Vars(r)["title"])
+}
+
+// ValidTitle reports whether title can name a page. Valid titles are
+// normalized, and never contain control characters, leading or trailing
+// spaces, or empty, "." or ".." segments, so they are safe to use as paths.
+func ValidTitle(title string) bool {
+	if len(title) == 0 || !utf8.ValidString(title) || !norm.NFC.IsNormalString(title) {
+		return false
+	}
+
+	for i, segment := range strings.Split(title, "/") {
+		if len(segment) == 0 || segment == "." || segment == ".." || strings.TrimSpace(segment) != segment {
+			return false
+		}
+		if i > 0 && reservedSegments[segment] {
+			return false
+		}
+		if strings.IndexFunc(segment, unicode.IsControl) >= 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// defaultDisplayTitle returns the name a page is shown with when it has no
+// display title of its own: the last segment of its title, with
+// underscores read as spaces.
+func defaultDisplayTitle(title string) string {
+	return strings.Replace(TitleName(title), "_", " ", -1)
+}
+
+// ParentTitle returns the title the page is nested under, or "" for a top
+// level page.
+func ParentTitle(title string) string {
+	if i := strings.LastIndex(title, "/"); i >= 0 {
+		return title[:i]
+	}
+
+	return ""
+}
+
+// TitleName returns the last segment of title.
+func TitleName(title string) string {
+	return title[strings.LastIndex(title, "/")+1:]
+}
+
+// Breadcrumb is one of the ancestors of a page, outermost first.
+type Breadcrumb struct {
+	Title  string `json:"title"`
+	Name   string `json:"name"`
+	Exists bool   `json:"exists"`
+}
+
+func getBreadcrumbs(store PageStore, title string) []*Breadcrumb {
+	results := []*Breadcrumb{}
+	for parent := ParentTitle(title); len(parent) != 0; parent = ParentTitle(parent) {
+		p := &Page{Title: parent}
+		results = append([]*Breadcrumb{{Title: parent, Name: TitleName(parent), Exists: p.Exists(store)}}, results...)
+	}
+
+	return results
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+type TrashedPage struct {
+	Title   string    `json:"title"`
+	Deleted time.Time `json:"deleted"`
+}
+
+// byDeletion orders trashed pages by when they were deleted, then by
+// title.
+type byDeletion []*TrashedPage
+
+func (a byDeletion) Len() int      { return len(a) }
+func (a byDeletion) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byDeletion) Less(i, j int) bool {
+	if !a[i].Deleted.Equal(a[j].Deleted) {
+		return a[i].Deleted.Before(a[j].Deleted)
+	}
+
+	return a[i].Title < a[j].Title
+}
+
+type TrashedPages struct {
+	Items []*TrashedPage `json:"items"`
+}
+
+// trashedAttachmentsSuffix turns the title of a deleted page into the one
+// its attachments are kept under until it is restored or purged. No page
+// has that title, as "attachments" cannot follow the first segment of a
+// title.
+const trashedAttachmentsSuffix = "/attachments"
+
+func trashedAttachmentsTitle(title string) string {
+	return title + trashedAttachmentsSuffix
+}
+
+// purgeAttachments removes the attachments kept for a deleted page.
+func purgeAttachments(attachments AttachmentStore, title string) error {
+	items, err := attachments.List(trashedAttachmentsTitle(title))
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if err := attachments.Delete(trashedAttachmentsTitle(title), item.Name); err != nil && err != ErrAttachmentNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PurgeExpiredTrash permanently removes pages that have been in the trash
+// for longer than retention, with their attachments.
+func PurgeExpiredTrash(store PageStore, attachments AttachmentStore, retention time.Duration) error {
+	items, err := store.Trash()
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-retention)
+	for _, item := range items {
+		if item.Deleted.Before(cutoff) {
+			if err := store.Purge(item.Title); err != nil && err != ErrPageNotFound {
+				return err
+			}
+			if err := purgeAttachments(attachments, item.Title); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// StartTrashPurger runs PurgeExpiredTrash in the background every interval.
+func StartTrashPurger(store PageStore, attachments AttachmentStore, retention time.Duration, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := PurgeExpiredTrash(store, attachments, retention); err != nil {
+				log.Printf("purging trash: %v", err)
+			}
+		}
+	}()
+}
+
+func CreateTrashListHandler(store PageStore, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization")
+
+		switch r.Method {
+		case "OPTIONS":
+			return
+		case "GET":
+			items, err := store.Trash()
+			if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			jsonResponse, _ := json.Marshal(&TrashedPages{Items: items})
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			w.Write(jsonResponse)
+		}
+	}
+}
+
+// CreateTrashRestoreHandler brings a page back from the trash with its
+// attachments.
+func CreateTrashRestoreHandler(store PageStore, attachments AttachmentStore, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		title := GetTitle(r)
+
+		w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, POST")
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization")
+
+		switch r.Method {
+		case "OPTIONS":
+			return
+		case "POST":
+			err := authoredStore(store, r).Restore(title)
+			if err == ErrPageNotFound {
+				ReturnError(w, r, http.StatusNotFound, err)
+				return
+			} else if err == ErrPageExists {
+				ReturnError(w, r, http.StatusConflict, err)
+				return
+			} else if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			if err := attachments.Move(trashedAttachmentsTitle(title), title); err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			p, err := loadPage(store, title)
+			if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			jsonResponse, _ := json.Marshal(p)
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			w.Write(jsonResponse)
+		}
+	}
+}
+
+// CreateTrashPurgeHandler permanently removes a page and its attachments
+// from the trash. Only the admin user may purge pages.
+func CreateTrashPurgeHandler(store PageStore, attachments AttachmentStore, adminuserid string, allowOrigins string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		title := GetTitle(r)
+
+		w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, DELETE")
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Timestamp, Username, Authorization")
+
+		switch r.Method {
+		case "OPTIONS":
+			return
+		case "DELETE":
+			if user := authenticatedUser(r); len(user) == 0 || user != adminuserid {
+				ReturnError(w, r, http.StatusForbidden, errors.New("Only the admin user may purge pages"))
+				return
+			}
+
+			err := authoredStore(store, r).Purge(title)
+			if err == ErrPageNotFound {
+				ReturnError(w, r, http.StatusNotFound, err)
+				return
+			} else if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			if err := purgeAttachments(attachments, title); err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
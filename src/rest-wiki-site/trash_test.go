@@ -0,0 +1,244 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTrashRestore(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// create test page
+	p := &Page{Title: "TestPage", Body: "Test result"}
+	if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("creating test page returned error %v", err)
+	}
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	if r, _, err := MakeRequest(router, "DELETE", "/page/TestPage", []byte{}, a); err != nil {
+		t.Fatalf("running request returned error %v", err)
+	} else if r.Code != 204 {
+		t.Fatalf("got response code = %d, expected %d", r.Code, 204)
+	}
+
+	// list trash
+	r, dat, err := MakeRequest(router, "GET", "/trash", nil, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+
+	// authorization headers
+	CheckAuthHeader("test", "test", r, t)
+
+	if items, _ := dat["items"].([]interface{}); len(items) != 1 {
+		t.Errorf("got %d trashed pages, expected %d", len(items), 1)
+	} else if title := items[0].(map[string]interface{})["title"].(string); title != "TestPage" {
+		t.Errorf("got title %s, expected %s", title, "TestPage")
+	}
+
+	// restore
+	r, dat, err = MakeRequest(router, "POST", "/trash/TestPage/restore", []byte{}, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if r.Code != 200 {
+		t.Errorf("got response code = %d, expected %d", r.Code, 200)
+	}
+	if body, _ := dat["body"].(string); body != "Test result" {
+		t.Errorf("got body %s, expected %s", body, "Test result")
+	}
+	if revisions, err := store.Revisions("TestPage"); err != nil {
+		t.Fatalf("listing revisions returned error %v", err)
+	} else if len(revisions) != 1 {
+		t.Errorf("got %d revisions after restore, expected %d", len(revisions), 1)
+	}
+
+	// nothing left to restore
+	r, _, err = MakeRequest(router, "POST", "/trash/TestPage/restore", []byte{}, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if r.Code != 404 {
+		t.Errorf("got response code = %d, expected %d", r.Code, 404)
+	}
+}
+
+func TestTrashPurge(t *testing.T) {
+	store := NewMemoryPageStore()
+	router := CreateRouter(store, NewMemoryAttachmentStore(), "test", 30*60, "test", "test", "*", 1<<20)
+
+	// create and delete test page
+	p := &Page{Title: "TestPage", Body: "Test result"}
+	if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("creating test page returned error %v", err)
+	}
+	if err := p.Delete(store); err != nil {
+		t.Fatalf("deleting test page returned error %v", err)
+	}
+
+	// users other than the admin may not purge
+	other := &Authentication{Username: "other", Timestamp: time.Now().Unix()}
+	other.CreateSignature("test")
+	r, _, err := MakeRequest(router, "DELETE", "/trash/TestPage", []byte{}, other)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if r.Code != 403 {
+		t.Errorf("got response code = %d, expected %d", r.Code, 403)
+	}
+	handler := CreateTrashPurgeHandler(store, NewMemoryAttachmentStore(), "test", "*")
+	if r := MakeUnauthenticatedRequest(handler, "/trash/{title:"+titlePattern+"}", "DELETE", "/trash/TestPage"); r.Code != 403 {
+		t.Errorf("got response code = %d without a signed-in user, expected %d", r.Code, 403)
+	}
+
+	// get authorization
+	a, err := GetAuthorization(router)
+	if err != nil {
+		t.Fatalf("retrieving authorization returned error %v", err)
+	}
+
+	r, _, err = MakeRequest(router, "DELETE", "/trash/TestPage", []byte{}, a)
+	if err != nil {
+		t.Fatalf("running request returned error %v", err)
+	}
+	if r.Code != 204 {
+		t.Errorf("got response code = %d, expected %d", r.Code, 204)
+	}
+	if trashed, err := store.Trash(); err != nil {
+		t.Fatalf("listing trash returned error %v", err)
+	} else if len(trashed) != 0 {
+		t.Errorf("got trash %v after purge, expected none", trashed)
+	}
+}
+
+func TestPurgeExpiredTrash(t *testing.T) {
+	store := NewMemoryPageStore()
+
+	// create and delete test page
+	p := &Page{Title: "TestPage", Body: "Test result"}
+	if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+		t.Fatalf("creating test page returned error %v", err)
+	}
+	if err := p.Delete(store); err != nil {
+		t.Fatalf("deleting test page returned error %v", err)
+	}
+
+	// still within the retention period
+	if err := PurgeExpiredTrash(store, NewMemoryAttachmentStore(), time.Hour); err != nil {
+		t.Fatalf("purging trash returned error %v", err)
+	}
+	if trashed, err := store.Trash(); err != nil {
+		t.Fatalf("listing trash returned error %v", err)
+	} else if len(trashed) != 1 {
+		t.Errorf("got %d trashed pages, expected %d", len(trashed), 1)
+	}
+
+	// expired
+	if err := PurgeExpiredTrash(store, NewMemoryAttachmentStore(), -time.Hour); err != nil {
+		t.Fatalf("purging trash returned error %v", err)
+	}
+	if trashed, err := store.Trash(); err != nil {
+		t.Fatalf("listing trash returned error %v", err)
+	} else if len(trashed) != 0 {
+		t.Errorf("got %d trashed pages, expected %d", len(trashed), 0)
+	}
+}
+
+func TestTrashAttachments(t *testing.T) {
+	directory, err := ioutil.TempDir("", "rest-wiki-site")
+	if err != nil {
+		t.Fatalf("creating temporary directory returned error %v", err)
+	}
+	defer os.RemoveAll(directory)
+	files, err := NewFileAttachmentStore(directory)
+	if err != nil {
+		t.Fatalf("creating attachment store returned error %v", err)
+	}
+
+	for _, attachments := range []AttachmentStore{NewMemoryAttachmentStore(), files} {
+		store := NewMemoryPageStore()
+		router := CreateRouter(store, attachments, "test", 30*60, "test", "test", "*", 1<<20)
+
+		// get authorization
+		a, err := GetAuthorization(router)
+		if err != nil {
+			t.Fatalf("retrieving authorization returned error %v", err)
+		}
+
+		// create test page with an attachment
+		p := &Page{Title: "TestPage", Body: "Test result"}
+		if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("creating test page returned error %v", err)
+		}
+		if err := attachments.Put("TestPage", &Attachment{Name: "test.txt"}, []byte("test")); err != nil {
+			t.Fatalf("storing attachment returned error %v", err)
+		}
+		listed := func() int {
+			items, err := attachments.List("TestPage")
+			if err != nil {
+				t.Fatalf("listing attachments returned error %v", err)
+			}
+			return len(items)
+		}
+
+		// the attachments go to the trash and come back with the page
+		if r, _, _ := MakeRequest(router, "DELETE", "/page/TestPage", []byte{}, a); r.Code != 204 {
+			t.Fatalf("got response code = %d deleting page, expected %d", r.Code, 204)
+		}
+		if n := listed(); n != 0 {
+			t.Errorf("got %d attachments of a deleted page, expected none", n)
+		}
+		if r, _, _ := MakeRequest(router, "POST", "/trash/TestPage/restore", []byte{}, a); r.Code != 200 {
+			t.Fatalf("got response code = %d restoring page, expected %d", r.Code, 200)
+		}
+		if n := listed(); n != 1 {
+			t.Errorf("got %d attachments of a restored page, expected %d", n, 1)
+		}
+
+		// a page created again after a purge starts without attachments
+		if r, _, _ := MakeRequest(router, "DELETE", "/page/TestPage", []byte{}, a); r.Code != 204 {
+			t.Fatalf("got response code = %d deleting page, expected %d", r.Code, 204)
+		}
+		if r, _, _ := MakeRequest(router, "DELETE", "/trash/TestPage", []byte{}, a); r.Code != 204 {
+			t.Fatalf("got response code = %d purging page, expected %d", r.Code, 204)
+		}
+		if err := p.Save(store, &Revision{Author: "test"}); err != nil {
+			t.Fatalf("creating test page again returned error %v", err)
+		}
+		r, dat, err := MakeRequest(router, "GET", "/page/TestPage/attachments", nil, a)
+		if err != nil {
+			t.Fatalf("running request returned error %v", err)
+		}
+		if r.Code != 200 {
+			t.Errorf("got response code = %d listing attachments, expected %d", r.Code, 200)
+		}
+		if items, _ := dat["items"].([]interface{}); len(items) != 0 {
+			t.Errorf("got attachments %v of a page created again after a purge, expected none", items)
+		}
+		if items, err := attachments.List(trashedAttachmentsTitle("TestPage")); err != nil || len(items) != 0 {
+			t.Errorf("got %v, %v listing the attachments of a purged page, expected none", items, err)
+		}
+
+		// expired pages lose their attachments too
+		if err := attachments.Put("TestPage", &Attachment{Name: "test.txt"}, []byte("test")); err != nil {
+			t.Fatalf("storing attachment returned error %v", err)
+		}
+		if r, _, _ := MakeRequest(router, "DELETE", "/page/TestPage", []byte{}, a); r.Code != 204 {
+			t.Fatalf("got response code = %d deleting page, expected %d", r.Code, 204)
+		}
+		if err := PurgeExpiredTrash(store, attachments, -time.Hour); err != nil {
+			t.Fatalf("purging trash returned error %v", err)
+		}
+		if items, err := attachments.List(trashedAttachmentsTitle("TestPage")); err != nil || len(items) != 0 {
+			t.Errorf("got %v, %v listing the attachments of an expired page, expected none", items, err)
+		}
+	}
+}
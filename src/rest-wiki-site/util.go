@@ -1,10 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
+var ErrPreconditionFailed = errors.New("Precondition failed")
+var ErrRequestTooLarge = errors.New("Request body too large")
+
 type ErrorResponse struct {
 	Errors []string `json:"errors"`
 }
@@ -20,3 +32,142 @@ func ReturnError(w http.ResponseWriter, r *http.Request, status int, e ...error)
 	jsonResponse, _ := json.Marshal(er)
 	w.Write(jsonResponse)
 }
+
+// computeETag returns a strong validator for a representation.
+func computeETag(data []byte) string {
+	hasher := md5.New()
+	hasher.Write(data)
+
+	return "\"" + hex.EncodeToString(hasher.Sum(nil)) + "\""
+}
+
+// matchETag reports whether etag is in an If-Match or If-None-Match header
+// value. Weak validators are compared by their opaque tag.
+func matchETag(header string, etag string) bool {
+	if len(etag) == 0 {
+		return false
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckPreconditions applies If-Match and If-None-Match to a write of a
+// resource whose current ETag is etag, or "" if it does not exist.
+func CheckPreconditions(r *http.Request, etag string) error {
+	if ifmatch := r.Header.Get("If-Match"); len(ifmatch) != 0 && !matchETag(ifmatch, etag) {
+		return ErrPreconditionFailed
+	}
+	if ifnonematch := r.Header.Get("If-None-Match"); len(ifnonematch) != 0 && matchETag(ifnonematch, etag) {
+		return ErrPreconditionFailed
+	}
+
+	return nil
+}
+
+// CheckNotModified sets the ETag and Last-Modified validators of a read
+// and applies If-None-Match and If-Modified-Since to it. When the client's
+// copy is current it writes 304 Not Modified and returns true.
+func CheckNotModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	notmodified := false
+	if ifnonematch := r.Header.Get("If-None-Match"); len(ifnonematch) != 0 {
+		notmodified = matchETag(ifnonematch, etag)
+	} else if ifmodifiedsince := r.Header.Get("If-Modified-Since"); len(ifmodifiedsince) != 0 && !modified.IsZero() {
+		if since, err := http.ParseTime(ifmodifiedsince); err == nil {
+			notmodified = !modified.Truncate(time.Second).After(since)
+		}
+	}
+
+	if notmodified {
+		w.WriteHeader(http.StatusNotModified)
+	}
+
+	return notmodified
+}
+
+// NegotiateContentType returns the first of offers that the Accept header
+// prefers most, or "" if it accepts none of them. Without an Accept header
+// the first offer is returned.
+func NegotiateContentType(accept string, offers ...string) string {
+	if len(strings.TrimSpace(accept)) == 0 {
+		return offers[0]
+	}
+
+	best, bestq := "", 0.0
+	for _, offer := range offers {
+		// the quality of the most specific range matching the offer
+		q, specificity := 0.0, -1
+		for _, mediarange := range strings.Split(accept, ",") {
+			params := strings.Split(mediarange, ";")
+			mediatype := strings.ToLower(strings.TrimSpace(params[0]))
+			rangeq := 1.0
+			for _, param := range params[1:] {
+				if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 && kv[0] == "q" {
+					if parsed, err := strconv.ParseFloat(kv[1], 64); err == nil {
+						rangeq = parsed
+					}
+				}
+			}
+
+			s := -1
+			switch {
+			case mediatype == offer:
+				s = 2
+			case mediatype == "*/*":
+				s = 0
+			case strings.HasSuffix(mediatype, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediatype, "*")):
+				s = 1
+			}
+			if s > specificity {
+				q, specificity = rangeq, s
+			}
+		}
+
+		if q > bestq {
+			best, bestq = offer, q
+		}
+	}
+
+	return best
+}
+
+// CreateSizeLimitedRequestHandler rejects requests whose body is longer
+// than limit bytes with 413 Request Entity Too Large. It reads the body
+// before fn does, so it belongs outside CreateAuthorizedRequestHandler,
+// which would otherwise read all of the body to check its signature.
+func CreateSizeLimitedRequestHandler(limit int64, allowOrigins string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && r.ContentLength != 0 {
+			w.Header().Set("Access-Control-Allow-Origin", allowOrigins)
+			if r.ContentLength > limit {
+				ReturnError(w, r, http.StatusRequestEntityTooLarge, ErrRequestTooLarge)
+				return
+			}
+
+			body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+			if err != nil {
+				ReturnError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			if int64(len(body)) > limit {
+				ReturnError(w, r, http.StatusRequestEntityTooLarge, ErrRequestTooLarge)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+		}
+
+		fn(w, r)
+	}
+}